@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// AdminServer служебный HTTP-сервер (метрики, проверки здоровья и другие административные эндпоинты).
+// Включается переменной окружения ADMIN_ADDR, например ":9090".
+type AdminServer struct {
+	server *http.Server
+	mux    *http.ServeMux
+}
+
+// NewAdminServer создаёт служебный сервер, если задан ADMIN_ADDR, иначе возвращает nil
+func NewAdminServer() *AdminServer {
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	return &AdminServer{
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		mux: mux,
+	}
+}
+
+// Handle регистрирует обработчик на служебном сервере
+func (s *AdminServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start запускает сервер в отдельной горутине
+func (s *AdminServer) Start() {
+	go func() {
+		slog.Info("Служебный HTTP-сервер запущен", "addr", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Ошибка служебного HTTP-сервера", "error", err)
+		}
+	}()
+}
+
+// Shutdown останавливает сервер, дожидаясь завершения активных запросов
+func (s *AdminServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		slog.Error("Ошибка остановки служебного HTTP-сервера", "error", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Префиксы callback_data кнопок под ответами модели
+const (
+	callbackRegenerate = "regen"
+	callbackContinue   = "cont"
+)
+
+// answerKeyboard возвращает кнопки под ответом на обмен turn с подписями на языке lang.
+// Кнопка «Продолжить» показывается, только если ответ оборван по лимиту длины.
+func answerKeyboard(lang string, turn int64, truncated bool) *InlineKeyboardMarkup {
+	id := strconv.FormatInt(turn, 10)
+	row := []InlineKeyboardButton{
+		{Text: T(lang, "btn_regenerate"), CallbackData: callbackRegenerate + ":" + id},
+	}
+	if truncated {
+		row = append(row, InlineKeyboardButton{Text: T(lang, "btn_continue"), CallbackData: callbackContinue + ":" + id})
+	}
+	return &InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{row}}
+}
+
+// answerCallbackQueryRequest параметры метода answerCallbackQuery
+type answerCallbackQueryRequest struct {
+	CallbackQueryID string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+}
+
+// answerCallback подтверждает нажатие кнопки, чтобы Telegram убрал индикатор загрузки
+func (bot *TelegramBot) answerCallback(ctx context.Context, queryID, text string) {
+	req := answerCallbackQueryRequest{CallbackQueryID: queryID, Text: text}
+	if err := bot.callAPI(ctx, "answerCallbackQuery", req, nil); err != nil {
+		slog.ErrorContext(ctx, "Ошибка ответа на нажатие кнопки", "error", err)
+	}
+}
+
+// HandleCallback обрабатывает нажатия inline-кнопок под ответами
+func (bot *TelegramBot) HandleCallback(ctx context.Context, query *CallbackQuery) {
+	if query == nil || query.From == nil {
+		return
+	}
+	ctx = withLanguage(ctx, bot.languageFor(query.From))
+	// Кнопки inline-сообщений (без чата) только подтверждаем
+	if query.Message == nil || query.Message.Chat == nil {
+		bot.answerCallback(ctx, query.ID, "")
+		return
+	}
+
+	chatID := query.Message.Chat.ID
+	userID := query.From.ID
+
+	if !bot.isUserIDAllowed(userID) {
+		metricUnauthorized.Inc()
+		slog.WarnContext(ctx, "Отклонено нажатие кнопки неавторизованным пользователем", "chat_id", chatID, "user_id", userID)
+		bot.answerCallback(ctx, query.ID, "")
+		return
+	}
+
+	action, idStr, _ := strings.Cut(query.Data, ":")
+	if action == callbackTemplate {
+		metricMessagesHandled.Inc("callback")
+		bot.pickTemplate(ctx, query, idStr)
+		return
+	}
+	if action == callbackVote {
+		metricMessagesHandled.Inc("callback")
+		bot.vote(ctx, query, idStr)
+		return
+	}
+	turn, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		bot.answerCallback(ctx, query.ID, "")
+		return
+	}
+
+	metricMessagesHandled.Inc("callback")
+	slog.InfoContext(ctx, "Нажата кнопка", "chat_id", chatID, "user_id", userID, "action", action, "turn", turn)
+
+	if !bot.checkRateLimit(chatID) {
+		metricRateLimited.Inc()
+		bot.answerCallback(ctx, query.ID, tr(ctx, "rate_limited"))
+		return
+	}
+
+	switch action {
+	case callbackRegenerate:
+		bot.regenerate(ctx, query.ID, chatID, userID, turn)
+	case callbackContinue:
+		bot.continueAnswer(ctx, query.ID, chatID, userID, turn)
+	default:
+		bot.answerCallback(ctx, query.ID, "")
+	}
+}
+
+// regenerate заново генерирует ответ на тот же промпт с другим seed
+// и заменяет им предыдущий ответ в истории
+func (bot *TelegramBot) regenerate(ctx context.Context, queryID string, chatID, userID, turn int64) {
+	messages, ok := bot.History.BuildRegenerate(ctx, chatID, turn)
+	if !ok {
+		bot.answerCallback(ctx, queryID, tr(ctx, "answer_unavailable"))
+		return
+	}
+	bot.answerCallback(ctx, queryID, "")
+
+	result := bot.generate(ctx, chatID, userID, messages, map[string]any{"seed": rand.Int31()})
+	if result == nil {
+		return
+	}
+
+	bot.History.ReplaceAnswer(chatID, turn, result.Response)
+	sent := bot.sendAnswer(ctx, chatID, result.Response, answerKeyboard(languageFrom(ctx), turn, result.DoneReason == "length"))
+	bot.History.LinkAnswer(chatID, turn, sent)
+}
+
+// continueAnswer просит модель продолжить оборванный ответ
+// и дописывает продолжение к ответу в истории
+func (bot *TelegramBot) continueAnswer(ctx context.Context, queryID string, chatID, userID, turn int64) {
+	messages, ok := bot.History.BuildContinue(ctx, chatID, turn)
+	if !ok {
+		bot.answerCallback(ctx, queryID, tr(ctx, "answer_unavailable"))
+		return
+	}
+	bot.answerCallback(ctx, queryID, "")
+
+	result := bot.generate(ctx, chatID, userID, messages, nil)
+	if result == nil {
+		return
+	}
+
+	bot.History.AppendAnswer(chatID, turn, result.Response)
+	sent := bot.sendAnswer(ctx, chatID, result.Response, answerKeyboard(languageFrom(ctx), turn, result.DoneReason == "length"))
+	bot.History.AppendAnswerIDs(chatID, turn, sent)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxExpressionLength ограничивает длину выражения для калькулятора
+const maxExpressionLength = 256
+
+// evalExpression вычисляет арифметическое выражение: числа, + - * / % ^,
+// скобки, константы pi и e и функции sqrt, abs, round, floor, ceil,
+// ln, log10, sin, cos, tan. Разбор рекурсивным спуском без eval и рефлексии.
+func evalExpression(expr string) (float64, error) {
+	if len(expr) > maxExpressionLength {
+		return 0, fmt.Errorf("выражение длиннее %d символов", maxExpressionLength)
+	}
+	p := &exprParser{s: strings.ReplaceAll(expr, ",", ".")}
+	v, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return 0, fmt.Errorf("неожиданный символ в позиции %d", p.pos+1)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("результат не является конечным числом")
+	}
+	return v, nil
+}
+
+// exprParser состояние разбора выражения
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// accept пропускает символ c, если он следующий
+func (p *exprParser) accept(c byte) bool {
+	p.skipSpaces()
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// sum разбирает сложение и вычитание
+func (p *exprParser) sum() (float64, error) {
+	v, err := p.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('+'):
+			r, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			v += r
+		case p.accept('-'):
+			r, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			v -= r
+		default:
+			return v, nil
+		}
+	}
+}
+
+// product разбирает умножение, деление и остаток
+func (p *exprParser) product() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('*'):
+			op = '*'
+		case p.accept('/'):
+			op = '/'
+		case p.accept('%'):
+			op = '%'
+		default:
+			return v, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			v *= r
+		case '/', '%':
+			if r == 0 {
+				return 0, fmt.Errorf("деление на ноль")
+			}
+			if op == '/' {
+				v /= r
+			} else {
+				v = math.Mod(v, r)
+			}
+		}
+	}
+}
+
+// unary разбирает унарные плюс и минус
+func (p *exprParser) unary() (float64, error) {
+	if p.accept('-') {
+		v, err := p.unary()
+		return -v, err
+	}
+	if p.accept('+') {
+		return p.unary()
+	}
+	return p.power()
+}
+
+// power разбирает возведение в степень (правоассоциативно)
+func (p *exprParser) power() (float64, error) {
+	base, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if p.accept('^') {
+		exp, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exp), nil
+	}
+	return base, nil
+}
+
+// exprFunctions функции, доступные в выражениях
+var exprFunctions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"round": math.Round,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"ln":    math.Log,
+	"log10": math.Log10,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+}
+
+// primary разбирает число, константу, вызов функции или выражение в скобках
+func (p *exprParser) primary() (float64, error) {
+	p.skipSpaces()
+	if p.accept('(') {
+		v, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, fmt.Errorf("не закрыта скобка")
+		}
+		return v, nil
+	}
+	if p.pos >= len(p.s) {
+		return 0, fmt.Errorf("выражение оборвано")
+	}
+
+	start := p.pos
+	c := p.s[p.pos]
+	switch {
+	case isDigit(c) || c == '.':
+		for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		// Экспоненциальная запись: 1e6, 2.5e-3
+		if p.pos < len(p.s) && (p.s[p.pos] == 'e' || p.s[p.pos] == 'E') {
+			end := p.pos + 1
+			if end < len(p.s) && (p.s[end] == '+' || p.s[end] == '-') {
+				end++
+			}
+			if end < len(p.s) && isDigit(p.s[end]) {
+				for end < len(p.s) && isDigit(p.s[end]) {
+					end++
+				}
+				p.pos = end
+			}
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return 0, fmt.Errorf("некорректное число %q", p.s[start:p.pos])
+		}
+		return v, nil
+	case isLetter(c):
+		for p.pos < len(p.s) && (isLetter(p.s[p.pos]) || isDigit(p.s[p.pos])) {
+			p.pos++
+		}
+		name := strings.ToLower(p.s[start:p.pos])
+		switch name {
+		case "pi":
+			return math.Pi, nil
+		case "e":
+			return math.E, nil
+		}
+		fn, ok := exprFunctions[name]
+		if !ok {
+			return 0, fmt.Errorf("неизвестная функция %q", name)
+		}
+		if !p.accept('(') {
+			return 0, fmt.Errorf("после %s ожидается скобка", name)
+		}
+		arg, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, fmt.Errorf("не закрыта скобка")
+		}
+		return fn(arg), nil
+	default:
+		return 0, fmt.Errorf("неожиданный символ в позиции %d", p.pos+1)
+	}
+}
+
+// isDigit и isLetter проверяют ASCII-символы: выражение разбирается побайтно
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
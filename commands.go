@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Role уровень доступа, необходимый для команды
+type Role int
+
+const (
+	RoleUser Role = iota
+	RoleAdmin
+)
+
+// defaultLanguage язык интерфейса и описаний команд по умолчанию
+const defaultLanguage = "ru"
+
+// Command описание команды бота. Реестр команд используется и для обработки
+// сообщений, и для /help, и для регистрации меню команд через setMyCommands.
+type Command struct {
+	// Name имя команды без косой черты
+	Name string
+	// Usage аргументы команды для справки, например "[md|json]"
+	Usage string
+	// Description описания по кодам языков; описание на defaultLanguage обязательно
+	Description map[string]string
+	Role        Role
+	Handler     func(bot *TelegramBot, ctx context.Context, message *Message, args string)
+}
+
+// describe возвращает описание команды на языке lang или на языке по умолчанию
+func (c Command) describe(lang string) string {
+	if d, ok := c.Description[lang]; ok {
+		return d
+	}
+	return c.Description[defaultLanguage]
+}
+
+// commandRegistry список команд бота в порядке показа в меню и справке.
+// Заполняется в init, так как /help сам обращается к реестру.
+var commandRegistry []Command
+
+func init() {
+	commandRegistry = []Command{
+		{
+			Name: "start",
+			Description: map[string]string{
+				"ru": "приветственное сообщение",
+				"en": "welcome message",
+			},
+			Handler: (*TelegramBot).cmdStart,
+		},
+		{
+			Name: "help",
+			Description: map[string]string{
+				"ru": "эта справка",
+				"en": "this help",
+			},
+			Handler: (*TelegramBot).cmdHelp,
+		},
+		{
+			Name: "usage",
+			Description: map[string]string{
+				"ru": "расход токенов и квоты",
+				"en": "token usage and quotas",
+			},
+			Handler: (*TelegramBot).cmdUsage,
+		},
+		{
+			Name: "stats",
+			Description: map[string]string{
+				"ru": "сводка использования бота",
+				"en": "bot-wide usage summary",
+			},
+			Role:    RoleAdmin,
+			Handler: (*TelegramBot).cmdStats,
+		},
+		{
+			Name: "reset",
+			Description: map[string]string{
+				"ru": "начать новый разговор",
+				"en": "start a new conversation",
+			},
+			Handler: (*TelegramBot).cmdReset,
+		},
+		{
+			Name: "history",
+			Description: map[string]string{
+				"ru": "краткий обзор истории разговора",
+				"en": "conversation history overview",
+			},
+			Handler: (*TelegramBot).cmdHistory,
+		},
+		{
+			Name:  "export",
+			Usage: "[md|json]",
+			Description: map[string]string{
+				"ru": "выгрузить разговор файлом",
+				"en": "export the conversation as a file",
+			},
+			Handler: (*TelegramBot).cmdExport,
+		},
+		{
+			Name:  "lang",
+			Usage: "[ru|en|auto]",
+			Description: map[string]string{
+				"ru": "язык интерфейса",
+				"en": "interface language",
+			},
+			Handler: (*TelegramBot).cmdLang,
+		},
+		{
+			Name:  "tools",
+			Usage: "[on|off]",
+			Description: map[string]string{
+				"ru": "инструменты модели в этом чате",
+				"en": "model tools in this chat",
+			},
+			Handler: (*TelegramBot).cmdTools,
+		},
+		{
+			Name:  "json",
+			Usage: "[{schema}] <prompt>",
+			Description: map[string]string{
+				"ru": "ответ в формате JSON по схеме",
+				"en": "answer as JSON matching a schema",
+			},
+			Handler: (*TelegramBot).cmdJSON,
+		},
+		{
+			Name:  "schedule",
+			Usage: "<daily|weekdays|weekly|at|in> ... <prompt>",
+			Description: map[string]string{
+				"ru": "запланировать запрос",
+				"en": "schedule a prompt",
+			},
+			Handler: (*TelegramBot).cmdSchedule,
+		},
+		{
+			Name:  "schedules",
+			Usage: "[delete <id>]",
+			Description: map[string]string{
+				"ru": "запланированные запросы чата",
+				"en": "scheduled prompts in this chat",
+			},
+			Handler: (*TelegramBot).cmdSchedules,
+		},
+		{
+			Name:  "timezone",
+			Usage: "[Europe/Moscow|UTC+3|auto]",
+			Description: map[string]string{
+				"ru": "часовой пояс для расписаний",
+				"en": "time zone for schedules",
+			},
+			Handler: (*TelegramBot).cmdTimezone,
+		},
+		{
+			Name:  "t",
+			Usage: "[<name> [var=value] <text>]",
+			Description: map[string]string{
+				"ru": "запрос по шаблону",
+				"en": "prompt from a template",
+			},
+			Handler: (*TelegramBot).cmdT,
+		},
+		{
+			Name: "templates",
+			Description: map[string]string{
+				"ru": "список шаблонов",
+				"en": "list templates",
+			},
+			Handler: (*TelegramBot).cmdTemplates,
+		},
+		{
+			Name:  "template",
+			Usage: "<add|delete|show> <name> [text]",
+			Description: map[string]string{
+				"ru": "создать или удалить личный шаблон",
+				"en": "create or delete a personal template",
+			},
+			Handler: (*TelegramBot).cmdTemplate,
+		},
+		{
+			Name:  "sharedtemplate",
+			Usage: "<add|delete> <name> [text]",
+			Description: map[string]string{
+				"ru": "создать или удалить общий шаблон",
+				"en": "create or delete a shared template",
+			},
+			Role:    RoleAdmin,
+			Handler: (*TelegramBot).cmdSharedTemplate,
+		},
+		{
+			Name:  "compare",
+			Usage: "<model1,model2> <prompt> | stats",
+			Description: map[string]string{
+				"ru": "сравнить ответы нескольких моделей",
+				"en": "compare answers from several models",
+			},
+			Handler: (*TelegramBot).cmdCompare,
+		},
+	}
+}
+
+// findCommand ищет команду в реестре по имени (с косой чертой или без)
+func findCommand(name string) (Command, bool) {
+	name = strings.TrimPrefix(name, "/")
+	for _, c := range commandRegistry {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Command{}, false
+}
+
+// parseCommand разделяет команду и аргументы, отбрасывая упоминание бота
+// (в группах команды приходят в виде /help@bot_name). Аргументы могут
+// начинаться с новой строки и занимать несколько строк.
+func parseCommand(text string) (name, args string) {
+	text = strings.TrimSpace(text)
+	name, args = text, ""
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		name, args = text[:i], text[i:]
+	}
+	name, _, _ = strings.Cut(name, "@")
+	return name, strings.TrimSpace(args)
+}
+
+// userRole возвращает роль пользователя
+func (bot *TelegramBot) userRole(userID int64) Role {
+	if bot.Admins[userID] {
+		return RoleAdmin
+	}
+	return RoleUser
+}
+
+// reply отправляет ответ в чат и логирует ошибку отправки
+func (bot *TelegramBot) reply(ctx context.Context, chatID int64, text string) {
+	if err := bot.SendMessage(ctx, chatID, text); err != nil {
+		slog.ErrorContext(ctx, "Ошибка отправки сообщения", "chat_id", chatID, "error", err)
+	}
+}
+
+func (bot *TelegramBot) cmdStart(ctx context.Context, message *Message, _ string) {
+	bot.reply(ctx, message.Chat.ID, tr(ctx, "start"))
+}
+
+// cmdHelp формирует справку из реестра с учётом роли и языка пользователя
+func (bot *TelegramBot) cmdHelp(ctx context.Context, message *Message, _ string) {
+	role := bot.userRole(senderID(message))
+	lang := languageFrom(ctx)
+
+	var b strings.Builder
+	b.WriteString(T(lang, "help_header"))
+	for _, c := range commandRegistry {
+		if c.Role > role {
+			continue
+		}
+		b.WriteString("/" + c.Name)
+		if c.Usage != "" {
+			b.WriteString(" " + c.Usage)
+		}
+		b.WriteString(" - " + c.describe(lang) + "\n")
+	}
+	b.WriteString(T(lang, "help_footer"))
+
+	bot.reply(ctx, message.Chat.ID, b.String())
+}
+
+func (bot *TelegramBot) cmdUsage(ctx context.Context, message *Message, _ string) {
+	bot.reply(ctx, message.Chat.ID, bot.Usage.Report(languageFrom(ctx), senderID(message)))
+}
+
+// cmdStats показывает администратору сводку расхода токенов по всем пользователям
+func (bot *TelegramBot) cmdStats(ctx context.Context, message *Message, _ string) {
+	bot.reply(ctx, message.Chat.ID, bot.Usage.Summary(languageFrom(ctx)))
+}
+
+func (bot *TelegramBot) cmdReset(ctx context.Context, message *Message, _ string) {
+	bot.History.Reset(message.Chat.ID)
+	bot.reply(ctx, message.Chat.ID, tr(ctx, "history_cleared"))
+}
+
+func (bot *TelegramBot) cmdHistory(ctx context.Context, message *Message, _ string) {
+	bot.reply(ctx, message.Chat.ID, bot.History.Overview(languageFrom(ctx), message.Chat.ID))
+}
+
+// cmdExport отправляет историю разговора файлом в формате Markdown или JSON
+func (bot *TelegramBot) cmdExport(ctx context.Context, message *Message, format string) {
+	chatID := message.Chat.ID
+
+	var (
+		data     []byte
+		filename string
+		err      error
+	)
+	switch strings.ToLower(format) {
+	case "", "md", "markdown":
+		data, filename = bot.History.ExportMarkdown(languageFrom(ctx), chatID), "conversation.md"
+	case "json":
+		data, err = bot.History.ExportJSON(chatID)
+		filename = "conversation.json"
+	default:
+		bot.reply(ctx, chatID, tr(ctx, "export_unknown_format"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка экспорта истории", "chat_id", chatID, "error", err)
+		bot.reply(ctx, chatID, tr(ctx, "export_failed"))
+		return
+	}
+
+	if err := bot.SendDocument(ctx, chatID, filename, data, tr(ctx, "export_caption")); err != nil {
+		slog.ErrorContext(ctx, "Ошибка отправки документа", "chat_id", chatID, "error", err)
+	}
+}
+
+// cmdLang показывает или меняет язык интерфейса пользователя.
+// /lang auto возвращает язык из настроек Telegram.
+func (bot *TelegramBot) cmdLang(ctx context.Context, message *Message, arg string) {
+	userID := senderID(message)
+	available := strings.Join(supportedLanguages(), ", ")
+
+	arg = strings.ToLower(arg)
+	switch {
+	case arg == "":
+		bot.reply(ctx, message.Chat.ID, tr(ctx, "lang_current", languageFrom(ctx), available))
+	case arg == "auto":
+		bot.Prefs.Update(userID, func(p *UserPrefs) { p.Lang = "" })
+		ctx = withLanguage(ctx, bot.languageFor(message.From))
+		bot.reply(ctx, message.Chat.ID, tr(ctx, "lang_auto"))
+	case normalizeLanguage(arg) != "":
+		lang := normalizeLanguage(arg)
+		bot.Prefs.Update(userID, func(p *UserPrefs) { p.Lang = lang })
+		bot.reply(ctx, message.Chat.ID, T(lang, "lang_set"))
+	default:
+		bot.reply(ctx, message.Chat.ID, tr(ctx, "lang_unknown", available))
+	}
+}
+
+// cmdTools показывает инструменты модели и включает или выключает их в чате
+func (bot *TelegramBot) cmdTools(ctx context.Context, message *Message, arg string) {
+	chatID := message.Chat.ID
+	lang := languageFrom(ctx)
+
+	switch strings.ToLower(arg) {
+	case "":
+		state := T(lang, "tools_off")
+		if bot.toolsEnabled(chatID) {
+			state = T(lang, "tools_on")
+		}
+		var b strings.Builder
+		for _, t := range toolRegistry {
+			b.WriteString("• " + t.Name + " - " + t.describe(lang) + "\n")
+		}
+		bot.reply(ctx, chatID, T(lang, "tools_status", state, b.String(), bot.Documents.Count(chatID)))
+	case "on", "off":
+		value := strings.ToLower(arg)
+		bot.Prefs.UpdateChat(chatID, func(p *ChatPrefs) { p.Tools = value })
+		bot.reply(ctx, chatID, T(lang, "tools_set", T(lang, "tools_"+value)))
+	default:
+		bot.reply(ctx, chatID, T(lang, "tools_usage"))
+	}
+}
+
+// BotCommand элемент меню команд Telegram
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// BotCommandScope область действия меню команд
+type BotCommandScope struct {
+	Type   string `json:"type"`
+	ChatID int64  `json:"chat_id,omitempty"`
+}
+
+type setMyCommandsRequest struct {
+	Commands     []BotCommand     `json:"commands"`
+	Scope        *BotCommandScope `json:"scope,omitempty"`
+	LanguageCode string           `json:"language_code,omitempty"`
+}
+
+// commandLanguages возвращает все языки, для которых в реестре есть описания
+func commandLanguages() []string {
+	seen := map[string]bool{}
+	var langs []string
+	for _, c := range commandRegistry {
+		for lang := range c.Description {
+			if !seen[lang] {
+				seen[lang] = true
+				langs = append(langs, lang)
+			}
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// botCommands возвращает меню команд для роли на языке lang
+func botCommands(role Role, lang string) []BotCommand {
+	var commands []BotCommand
+	for _, c := range commandRegistry {
+		if c.Role > role {
+			continue
+		}
+		commands = append(commands, BotCommand{Command: c.Name, Description: c.describe(lang)})
+	}
+	return commands
+}
+
+// RegisterCommands регистрирует меню команд через setMyCommands: общее меню
+// для всех пользователей и расширенное для личных чатов администраторов.
+// Описания на языке по умолчанию регистрируются без language_code и
+// показываются пользователям, для языка которых нет отдельного меню.
+func (bot *TelegramBot) RegisterCommands(ctx context.Context) {
+	scopes := []struct {
+		role  Role
+		scope *BotCommandScope
+	}{
+		{RoleUser, &BotCommandScope{Type: "default"}},
+	}
+	for adminID := range bot.Admins {
+		scopes = append(scopes, struct {
+			role  Role
+			scope *BotCommandScope
+		}{RoleAdmin, &BotCommandScope{Type: "chat", ChatID: adminID}})
+	}
+
+	for _, s := range scopes {
+		for _, lang := range commandLanguages() {
+			req := setMyCommandsRequest{
+				Commands: botCommands(s.role, lang),
+				Scope:    s.scope,
+			}
+			if lang != defaultLanguage {
+				req.LanguageCode = lang
+			}
+			if err := bot.callAPI(ctx, "setMyCommands", req, nil); err != nil {
+				slog.ErrorContext(ctx, "Ошибка регистрации меню команд", "scope", s.scope.Type, "language", lang, "error", err)
+			}
+		}
+	}
+	slog.InfoContext(ctx, "Меню команд зарегистрировано", "commands", len(commandRegistry), "admins", len(bot.Admins))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestBotCommandsByRole(t *testing.T) {
+	has := func(commands []BotCommand, name string) bool {
+		for _, c := range commands {
+			if c.Command == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, lang := range commandLanguages() {
+		user, admin := botCommands(RoleUser, lang), botCommands(RoleAdmin, lang)
+		for _, name := range []string{"stats", "sharedtemplate"} {
+			if has(user, name) {
+				t.Errorf("%s: %s в меню пользователя", lang, name)
+			}
+			if !has(admin, name) {
+				t.Errorf("%s: %s нет в меню администратора", lang, name)
+			}
+		}
+		if len(admin) <= len(user) {
+			t.Errorf("%s: меню администратора не шире пользовательского: %d и %d команд", lang, len(admin), len(user))
+		}
+	}
+}
+
+func TestCommandLanguagesSorted(t *testing.T) {
+	langs := commandLanguages()
+	if len(langs) < 2 || !sort.StringsAreSorted(langs) {
+		t.Fatalf("commandLanguages() = %v", langs)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// callbackVote префикс callback_data кнопок голосования за лучший ответ
+const callbackVote = "vote"
+
+// compareLabels метки ответов в сравнении; их число ограничивает COMPARE_MAX_MODELS
+var compareLabels = []string{"A", "B", "C", "D", "E", "F"}
+
+// compareKeep сколько последних сравнений хранится в памяти для голосования
+const compareKeep = 100
+
+// compareResult ответ одной модели в сравнении
+type compareResult struct {
+	Model string
+	Resp  *OllamaResponse
+	Err   error
+	// Elapsed время от отправки запроса до ответа, включая ожидание очереди
+	Elapsed time.Duration
+}
+
+// duration время генерации по данным Ollama или, если их нет, по часам бота
+func (r compareResult) duration() time.Duration {
+	if r.Resp != nil && r.Resp.TotalDuration > 0 {
+		return time.Duration(r.Resp.TotalDuration)
+	}
+	return r.Elapsed
+}
+
+// stats описывает время и токены ответа на языке lang
+func (r compareResult) stats(lang string) string {
+	tokensPerSecond := 0.0
+	if r.Resp.EvalDuration > 0 {
+		tokensPerSecond = float64(r.Resp.EvalCount) / time.Duration(r.Resp.EvalDuration).Seconds()
+	}
+	return T(lang, "compare_stats", r.duration().Seconds(), r.Resp.PromptEvalCount, r.Resp.EvalCount, tokensPerSecond)
+}
+
+// Comparison сравнение ответов моделей на один запрос, ожидающее голосов
+type Comparison struct {
+	ID      int64
+	Prompt  string
+	Results []compareResult
+	// voters пользователи, которые уже проголосовали
+	voters map[int64]bool
+}
+
+// candidateStats ответ модели в сохранённом голосе
+type candidateStats struct {
+	Model            string `json:"model"`
+	DurationMs       int64  `json:"duration_ms"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+}
+
+// Vote выбор пользователем лучшего ответа — локальные данные о предпочтениях.
+// Текст запроса сохраняется как есть, чтобы голоса можно было использовать
+// для дообучения; файл голосов содержит запросы пользователей.
+type Vote struct {
+	Time       time.Time        `json:"time"`
+	UserID     int64            `json:"user_id"`
+	Prompt     string           `json:"prompt"`
+	Winner     string           `json:"winner"`
+	Candidates []candidateStats `json:"candidates"`
+}
+
+// modelTally итог голосования за модель
+type modelTally struct {
+	Model string
+	Wins  int
+	// Votes в скольких голосованиях участвовала модель
+	Votes int
+}
+
+// votesFile формат файла голосов
+type votesFile struct {
+	Votes []Vote `json:"votes"`
+}
+
+// CompareStore хранит последние сравнения в памяти и голоса в JSON-файле
+type CompareStore struct {
+	path string
+
+	mu          sync.Mutex
+	nextID      int64
+	comparisons map[int64]*Comparison
+	order       []int64
+	votes       []Vote
+}
+
+// NewCompareStore создаёт хранилище сравнений с файлом голосов из COMPARE_VOTES_FILE
+func NewCompareStore() *CompareStore {
+	path := os.Getenv("COMPARE_VOTES_FILE")
+	if path == "" {
+		path = "votes.json"
+	}
+	s := &CompareStore{
+		path: path,
+		// Сравнения не переживают перезапуск; ID от текущего времени не дают
+		// кнопкам старых сообщений попасть в новое сравнение
+		nextID:      time.Now().Unix(),
+		comparisons: make(map[int64]*Comparison),
+	}
+	if err := s.load(); err != nil {
+		slog.Error("Ошибка загрузки голосов", "path", path, "error", err)
+	}
+	return s
+}
+
+// Add сохраняет сравнение для голосования и возвращает его ID.
+// Самые старые сравнения вытесняются.
+func (s *CompareStore) Add(c *Comparison) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	c.ID = s.nextID
+	c.voters = make(map[int64]bool)
+	s.comparisons[c.ID] = c
+	s.order = append(s.order, c.ID)
+	if len(s.order) > compareKeep {
+		delete(s.comparisons, s.order[0])
+		s.order = s.order[1:]
+	}
+	return c.ID
+}
+
+var (
+	errComparisonUnavailable = errors.New("сравнение недоступно")
+	errAlreadyVoted          = errors.New("пользователь уже проголосовал")
+)
+
+// Vote записывает голос пользователя за ответ index в сравнении id
+// и возвращает выбранную модель
+func (s *CompareStore) Vote(id, userID int64, index int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.comparisons[id]
+	if !ok || index < 0 || index >= len(c.Results) || c.Results[index].Resp == nil {
+		return "", errComparisonUnavailable
+	}
+	if c.voters[userID] {
+		return "", errAlreadyVoted
+	}
+	c.voters[userID] = true
+
+	vote := Vote{Time: time.Now().UTC(), UserID: userID, Prompt: c.Prompt, Winner: c.Results[index].Model}
+	for _, r := range c.Results {
+		if r.Resp == nil {
+			continue
+		}
+		vote.Candidates = append(vote.Candidates, candidateStats{
+			Model:            r.Model,
+			DurationMs:       r.duration().Milliseconds(),
+			PromptTokens:     r.Resp.PromptEvalCount,
+			CompletionTokens: r.Resp.EvalCount,
+		})
+	}
+	s.votes = append(s.votes, vote)
+	if err := s.save(); err != nil {
+		slog.Error("Ошибка сохранения голосов", "path", s.path, "error", err)
+	}
+	return vote.Winner, nil
+}
+
+// Tally подводит итоги всех голосов по моделям: по доле побед, затем по числу голосований
+func (s *CompareStore) Tally() []modelTally {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byModel := make(map[string]*modelTally)
+	for _, v := range s.votes {
+		for _, c := range v.Candidates {
+			t, ok := byModel[c.Model]
+			if !ok {
+				t = &modelTally{Model: c.Model}
+				byModel[c.Model] = t
+			}
+			t.Votes++
+			if c.Model == v.Winner {
+				t.Wins++
+			}
+		}
+	}
+
+	tally := make([]modelTally, 0, len(byModel))
+	for _, t := range byModel {
+		tally = append(tally, *t)
+	}
+	sort.Slice(tally, func(i, j int) bool {
+		a, b := tally[i], tally[j]
+		if a.Wins*b.Votes != b.Wins*a.Votes {
+			return a.Wins*b.Votes > b.Wins*a.Votes
+		}
+		if a.Votes != b.Votes {
+			return a.Votes > b.Votes
+		}
+		return a.Model < b.Model
+	})
+	return tally
+}
+
+// load читает голоса из файла; отсутствие файла не является ошибкой
+func (s *CompareStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f votesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	s.votes = f.Votes
+	return nil
+}
+
+// save записывает голоса в файл. Вызывается под s.mu.
+func (s *CompareStore) save() error {
+	data, err := json.MarshalIndent(votesFile{Votes: s.votes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// compareMaxModels сколько моделей можно сравнить за раз из COMPARE_MAX_MODELS
+// (по умолчанию 4, не больше числа меток)
+func compareMaxModels() int {
+	n := 4
+	if v := os.Getenv("COMPARE_MAX_MODELS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 2 {
+			n = parsed
+		}
+	}
+	return min(n, len(compareLabels))
+}
+
+// compareAllowedModels модели, разрешённые для /compare: основная модель бота
+// и модели из COMPARE_MODELS. Установленные в Ollama модели, которых нет
+// в настройках, недоступны.
+func compareAllowedModels(model string) []string {
+	return parseModels(model + "," + os.Getenv("COMPARE_MODELS"))
+}
+
+// parseModels разбирает список моделей через запятую без повторов
+func parseModels(list string) []string {
+	var models []string
+	seen := make(map[string]bool)
+	for _, model := range strings.Split(list, ",") {
+		model = strings.TrimSpace(model)
+		if model != "" && !seen[model] {
+			seen[model] = true
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// compareModels отправляет запрос всем моделям параллельно и ждёт все ответы.
+// Число одновременных генераций ограничивает клиент Ollama, поэтому остальные
+// модели ждут очереди.
+func (bot *TelegramBot) compareModels(ctx context.Context, models []string, messages []ChatMessage) []compareResult {
+	results := make([]compareResult, len(models))
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func(i int, model string) {
+			defer wg.Done()
+			start := time.Now()
+			resp, err := bot.Ollama.ChatModel(ctx, model, messages, nil)
+			results[i] = compareResult{Model: model, Resp: resp, Err: err, Elapsed: time.Since(start)}
+		}(i, model)
+	}
+	wg.Wait()
+	return results
+}
+
+// cmdCompare задаёт один вопрос нескольким моделям: /compare m1,m2 запрос.
+// /compare stats показывает итоги голосования. Ответы не сохраняются в истории.
+func (bot *TelegramBot) cmdCompare(ctx context.Context, message *Message, args string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+	lang := languageFrom(ctx)
+
+	list, prompt := cutWord(args)
+	if strings.EqualFold(list, "stats") {
+		bot.reply(ctx, chatID, bot.compareStats(lang))
+		return
+	}
+	models := parseModels(list)
+	if len(models) < 2 || prompt == "" {
+		bot.reply(ctx, chatID, tr(ctx, "compare_usage"))
+		return
+	}
+	if limit := compareMaxModels(); len(models) > limit {
+		bot.reply(ctx, chatID, tr(ctx, "compare_too_many", limit))
+		return
+	}
+	allowed := compareAllowedModels(bot.Ollama.Model)
+	for _, model := range models {
+		if !slices.Contains(allowed, model) {
+			bot.reply(ctx, chatID, tr(ctx, "compare_not_allowed", model, strings.Join(allowed, ", ")))
+			return
+		}
+	}
+
+	// Слишком длинный промпт отклоняется, не занимая места в окне rate limit
+	if len(prompt) > bot.maxPromptLen {
+		bot.reply(ctx, chatID, tr(ctx, "prompt_too_long", bot.maxPromptLen))
+		return
+	}
+	// Каждая модель — отдельная генерация: rate limit и квота учитывают все
+	if !bot.checkRateLimitN(chatID, len(models)) {
+		metricRateLimited.Inc()
+		bot.reply(ctx, chatID, tr(ctx, "rate_limited"))
+		return
+	}
+	messages := bot.History.Standalone(prompt)
+	if !bot.checkQuotaFor(ctx, chatID, userID, int64(len(models)*messagesTokens(messages))) {
+		return
+	}
+	bot.reply(ctx, chatID, tr(ctx, "compare_processing", len(models)))
+
+	slog.InfoContext(ctx, "Сравнение моделей", "chat_id", chatID, "models", strings.Join(models, ","))
+	results := bot.compareModels(ctx, models, messages)
+
+	var summary strings.Builder
+	answered := 0
+	for i, r := range results {
+		label := compareLabels[i]
+		if r.Err != nil {
+			slog.ErrorContext(ctx, "Ошибка модели при сравнении", "chat_id", chatID, "model", r.Model, "error", r.Err)
+			metricCompareAnswers.Inc(r.Model, "error")
+			bot.reply(ctx, chatID, T(lang, "compare_failed", label, r.Model))
+			summary.WriteString(T(lang, "compare_failed", label, r.Model) + "\n")
+			continue
+		}
+		metricCompareAnswers.Inc(r.Model, "ok")
+		answered++
+		bot.Usage.Record(userID, chatID, r.Resp)
+		header := T(lang, "compare_answer", label, r.Model, r.stats(lang))
+		bot.sendAnswer(ctx, chatID, header+"\n\n"+r.Resp.Response, nil)
+		summary.WriteString(header + "\n")
+	}
+
+	// Голосовать имеет смысл, только если ответили хотя бы две модели
+	if answered < 2 {
+		return
+	}
+	id := bot.Compares.Add(&Comparison{Prompt: prompt, Results: results})
+	var buttons []InlineKeyboardButton
+	for i, r := range results {
+		if r.Err == nil {
+			buttons = append(buttons, InlineKeyboardButton{
+				Text:         "👍 " + compareLabels[i],
+				CallbackData: fmt.Sprintf("%s:%d:%d", callbackVote, id, i),
+			})
+		}
+	}
+	_, err := bot.sendMessage(ctx, SendMessageRequest{
+		ChatID:      chatID,
+		Text:        summary.String() + "\n" + T(lang, "compare_vote"),
+		ReplyMarkup: &InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{buttons}},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка отправки сообщения", "chat_id", chatID, "error", err)
+	}
+}
+
+// vote обрабатывает нажатие кнопки голосования: data вида "<id сравнения>:<номер ответа>"
+func (bot *TelegramBot) vote(ctx context.Context, query *CallbackQuery, data string) {
+	idStr, indexStr, _ := strings.Cut(data, ":")
+	id, err1 := strconv.ParseInt(idStr, 10, 64)
+	index, err2 := strconv.Atoi(indexStr)
+	if err1 != nil || err2 != nil {
+		bot.answerCallback(ctx, query.ID, "")
+		return
+	}
+
+	model, err := bot.Compares.Vote(id, query.From.ID, index)
+	switch {
+	case errors.Is(err, errAlreadyVoted):
+		bot.answerCallback(ctx, query.ID, tr(ctx, "compare_voted_twice"))
+	case err != nil:
+		bot.answerCallback(ctx, query.ID, tr(ctx, "compare_expired"))
+	default:
+		metricCompareVotes.Inc(model)
+		slog.InfoContext(ctx, "Голос за ответ модели", "user_id", query.From.ID, "comparison", id, "model", model)
+		bot.answerCallback(ctx, query.ID, tr(ctx, "compare_voted", model))
+	}
+}
+
+// compareStats описывает итоги голосования по моделям на языке lang
+func (bot *TelegramBot) compareStats(lang string) string {
+	tally := bot.Compares.Tally()
+	if len(tally) == 0 {
+		return T(lang, "compare_stats_empty")
+	}
+	var b strings.Builder
+	b.WriteString(T(lang, "compare_stats_header"))
+	for _, t := range tally {
+		b.WriteString(T(lang, "compare_stats_line", t.Model, t.Wins, t.Votes) + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Пользователь и чат, от имени которых консольный режим передаёт сообщения боту
+const (
+	consoleUserID int64 = 1
+	consoleChatID int64 = 1
+)
+
+// handlerTransport выполняет HTTP-запросы обработчиком в том же процессе, без сети
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+// consoleBotAPI подменяет Telegram Bot API в консольном режиме:
+// исходящие сообщения бота печатаются в out вместо отправки в Telegram
+type consoleBotAPI struct {
+	out    io.Writer
+	mu     sync.Mutex
+	nextID atomic.Int64
+}
+
+func (c *consoleBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var result any = true
+
+	switch method := path.Base(r.URL.Path); method {
+	case "getMe":
+		result = User{ID: 0, IsBot: true, FirstName: "console", Username: "console_bot"}
+	case "sendMessage":
+		var req SendMessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		id := c.nextID.Add(1)
+		c.print("%s%s\n", req.Text, formatKeyboard(req.ReplyMarkup))
+		result = Message{MessageID: id, Chat: &Chat{ID: req.ChatID, Type: "private"}, Text: req.Text, Date: time.Now().Unix()}
+	case "editMessageText":
+		var req editMessageTextRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		c.print("[правка сообщения %d]\n%s%s\n", req.MessageID, req.Text, formatKeyboard(req.ReplyMarkup))
+	case "deleteMessage":
+		var req map[string]int64
+		json.NewDecoder(r.Body).Decode(&req)
+		c.print("[сообщение %d удалено]\n", req["message_id"])
+	case "sendChatAction":
+		c.print("[печатает...]\n")
+	case "answerCallbackQuery":
+		var req answerCallbackQueryRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Text != "" {
+			c.print("[%s]\n", req.Text)
+		}
+	case "sendDocument":
+		file, header, err := r.FormFile("document")
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, _ := io.ReadAll(file)
+		c.print("[файл %s, %d байт] %s\n%s\n", header.Filename, len(data), r.FormValue("caption"), data)
+		result = Message{MessageID: c.nextID.Add(1), Chat: &Chat{ID: consoleChatID, Type: "private"}}
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+// print выводит сообщение бота, не перемешивая вывод параллельных запросов
+func (c *consoleBotAPI) print(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.out, format, args...)
+}
+
+// formatKeyboard показывает inline-кнопки строкой вида «[кнопка] [кнопка]»
+func formatKeyboard(markup *InlineKeyboardMarkup) string {
+	if markup == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, row := range markup.InlineKeyboard {
+		b.WriteString("\n")
+		for i, button := range row {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString("[" + button.Text + "]")
+		}
+	}
+	return b.String()
+}
+
+// runConsole передаёт строки из in боту как сообщения тестового пользователя
+// и печатает ответы бота в out. Работает до конца ввода или отмены ctx.
+func runConsole(ctx context.Context, bot *TelegramBot, in io.Reader, out io.Writer) {
+	api := &consoleBotAPI{out: out}
+	bot.Client.Transport = handlerTransport{handler: api}
+	// Консольный пользователь — администратор, чтобы были доступны все команды
+	bot.Admins[consoleUserID] = true
+
+	fmt.Fprintln(out, "Консольный режим. Введите сообщение или команду, Ctrl+D — выход.")
+	// Запланированные запросы выполняются и в консоли, ответы печатаются как сообщения
+	go runScheduler(ctx, bot)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		fmt.Fprint(out, "> ")
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(out)
+			return
+		case line, ok := <-lines:
+			if !ok {
+				fmt.Fprintln(out)
+				return
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			message := &Message{
+				MessageID: api.nextID.Add(1),
+				From:      &User{ID: consoleUserID, FirstName: "console"},
+				Chat:      &Chat{ID: consoleChatID, Type: "private", FirstName: "console"},
+				Text:      line,
+				Date:      time.Now().Unix(),
+			}
+			msgCtx := withCorrelationID(ctx)
+			slog.DebugContext(msgCtx, "Консольное сообщение", "message_id", message.MessageID)
+			bot.HandleMessage(msgCtx, message)
+		}
+	}
+}
+
+// writeFakeError отвечает ошибкой в формате Bot API
+func writeFakeError(w http.ResponseWriter, status int, description string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"ok": false, "error_code": status, "description": description})
+}
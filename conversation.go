@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultNumCtx размер контекста Ollama по умолчанию, если модель не задаёт num_ctx
+	defaultNumCtx = 2048
+	// messageOverheadTokens примерные служебные токены шаблона на одно сообщение
+	messageOverheadTokens = 4
+	// contextLengthRetryMin и contextLengthRetryMax границы паузы перед повторным
+	// запросом /api/show после ошибки; пауза удваивается с каждой ошибкой
+	contextLengthRetryMin = 30 * time.Second
+	contextLengthRetryMax = 10 * time.Minute
+)
+
+// Conversation история диалога одного чата
+type Conversation struct {
+	// Summary краткое содержание вытесненных из истории реплик
+	Summary  string
+	Messages []ChatMessage
+
+	// pending реплики, ожидающие фоновой суммаризации
+	pending     []ChatMessage
+	summarizing bool
+	// summaryUser пользователь, чей обмен вытеснил реплики; ему засчитываются
+	// токены суммаризации
+	summaryUser int64
+	lastTurn    int64
+
+	// answers сопоставляет ID сообщений бота в Telegram с номерами обменов
+	answers map[int64]int64
+	// prompts сопоставляет ID сообщений пользователя с номерами обменов
+	prompts map[int64]int64
+	// answerIDs последние сообщения бота с ответом на каждый обмен
+	answerIDs map[int64][]int64
+}
+
+// ConversationManager хранит историю диалогов по чатам и следит, чтобы
+// промпт помещался в контекстное окно модели: старые реплики вытесняются
+// и в фоне сворачиваются в краткое содержание.
+type ConversationManager struct {
+	ollama       *OllamaClient
+	usage        *UsageTracker
+	systemPrompt string
+	keepMessages int
+	summarize    bool
+
+	mu     sync.Mutex
+	chats  map[int64]*Conversation
+	numCtx int
+	// retryAt и retryDelay откладывают повторный запрос /api/show после ошибки
+	retryAt    time.Time
+	retryDelay time.Duration
+}
+
+// NewConversationManager создаёт менеджер диалогов с настройками из переменных окружения
+func NewConversationManager(ollama *OllamaClient, usage *UsageTracker) *ConversationManager {
+	keep := 4
+	if v := os.Getenv("HISTORY_KEEP_MESSAGES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			// Обмены не разрываются, поэтому нечётное значение округляется вверх
+			// до целого числа обменов
+			keep = n + n%2
+		}
+	}
+
+	numCtx := 0
+	if v := os.Getenv("OLLAMA_NUM_CTX"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			numCtx = n
+		}
+	}
+
+	summarize := true
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("HISTORY_SUMMARIZE"))); v == "false" || v == "0" || v == "no" {
+		summarize = false
+	}
+
+	return &ConversationManager{
+		ollama:       ollama,
+		usage:        usage,
+		systemPrompt: os.Getenv("SYSTEM_PROMPT"),
+		keepMessages: keep,
+		summarize:    summarize,
+		chats:        make(map[int64]*Conversation),
+		numCtx:       numCtx,
+	}
+}
+
+// estimateTokens грубо оценивает число токенов в тексте.
+// Для смешанного русско-английского текста токен в среднем около трёх символов.
+func estimateTokens(text string) int {
+	return utf8.RuneCountInString(text)/3 + 1
+}
+
+// messagesTokens оценивает число токенов в списке сообщений
+func messagesTokens(messages []ChatMessage) int {
+	total := 0
+	for _, m := range messages {
+		total += estimateTokens(m.Content) + messageOverheadTokens
+	}
+	return total
+}
+
+// budget возвращает бюджет токенов на промпт. Размер контекста запрашивается
+// у Ollama (/api/show) один раз; четверть окна оставляется под ответ.
+// После ошибки запроса используется размер по умолчанию, а повторный запрос
+// откладывается, чтобы недоступная Ollama не получала его с каждым сообщением.
+func (m *ConversationManager) budget(ctx context.Context) int {
+	m.mu.Lock()
+	numCtx := m.numCtx
+	wait := time.Now().Before(m.retryAt)
+	m.mu.Unlock()
+
+	if numCtx == 0 && wait {
+		return defaultNumCtx * 3 / 4
+	}
+	if numCtx == 0 {
+		n, err := m.ollama.ContextLength(ctx)
+		if err != nil {
+			m.mu.Lock()
+			m.retryDelay = min(max(2*m.retryDelay, contextLengthRetryMin), contextLengthRetryMax)
+			m.retryAt = time.Now().Add(m.retryDelay)
+			delay := m.retryDelay
+			m.mu.Unlock()
+			slog.WarnContext(ctx, "Не удалось получить размер контекста модели", "error", err, "retry_in", delay)
+			return defaultNumCtx * 3 / 4
+		}
+		if n == 0 {
+			n = defaultNumCtx
+		}
+		slog.InfoContext(ctx, "Размер контекста модели", "model", m.ollama.Model, "num_ctx", n)
+		m.mu.Lock()
+		m.numCtx = n
+		m.mu.Unlock()
+		numCtx = n
+	}
+
+	return numCtx * 3 / 4
+}
+
+// conversation возвращает историю чата, создавая её при необходимости. Вызывается под m.mu.
+func (m *ConversationManager) conversation(chatID int64) *Conversation {
+	conv, ok := m.chats[chatID]
+	if !ok {
+		conv = &Conversation{
+			answers:   make(map[int64]int64),
+			prompts:   make(map[int64]int64),
+			answerIDs: make(map[int64][]int64),
+		}
+		m.chats[chatID] = conv
+	}
+	return conv
+}
+
+// systemMessages возвращает системный промпт и краткое содержание ранних реплик
+func (m *ConversationManager) systemMessages(conv *Conversation) []ChatMessage {
+	var messages []ChatMessage
+	if m.systemPrompt != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: m.systemPrompt})
+	}
+	if conv.Summary != "" {
+		messages = append(messages, ChatMessage{
+			Role:    "system",
+			Content: "Краткое содержание предыдущей части разговора:\n" + conv.Summary,
+		})
+	}
+	return messages
+}
+
+// Standalone собирает промпт без истории: системный промпт и сообщение пользователя
+func (m *ConversationManager) Standalone(userText string) []ChatMessage {
+	var messages []ChatMessage
+	if m.systemPrompt != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: m.systemPrompt})
+	}
+	return append(messages, ChatMessage{Role: "user", Content: userText})
+}
+
+// Build собирает сообщения для /api/chat: системный промпт, краткое содержание,
+// последние реплики, помещающиеся в бюджет, и новое сообщение пользователя.
+// История при этом не изменяется.
+func (m *ConversationManager) Build(ctx context.Context, chatID int64, userText string) []ChatMessage {
+	budget := m.budget(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	return m.buildLocked(ctx, chatID, budget, conv, conv.Messages, ChatMessage{Role: "user", Content: userText})
+}
+
+// buildLocked собирает промпт из системных сообщений, последних реплик history,
+// помещающихся в бюджет, и сообщений tail, которые передаются всегда.
+// Вызывается под m.mu.
+func (m *ConversationManager) buildLocked(ctx context.Context, chatID int64, budget int, conv *Conversation, history []ChatMessage, tail ...ChatMessage) []ChatMessage {
+	system := m.systemMessages(conv)
+
+	used := messagesTokens(system) + messagesTokens(tail)
+	start := len(history)
+	for start > 0 {
+		t := messagesTokens(history[start-1 : start])
+		if used+t > budget {
+			break
+		}
+		used += t
+		start--
+	}
+	if start > 0 {
+		slog.DebugContext(ctx, "История обрезана под бюджет контекста", "chat_id", chatID, "dropped", start, "budget", budget)
+	}
+
+	messages := append(system, history[start:]...)
+	return append(messages, tail...)
+}
+
+// findTurn возвращает индекс сообщения пользователя для обмена turn
+// или -1, если он уже вытеснен из истории. Вызывается под m.mu.
+func findTurn(conv *Conversation, turn int64) int {
+	for i := 0; i+1 < len(conv.Messages); i++ {
+		if conv.Messages[i].turn == turn && conv.Messages[i].Role == "user" {
+			return i
+		}
+	}
+	return -1
+}
+
+// BuildRegenerate собирает промпт для повторной генерации ответа на обмен turn:
+// история до него и исходное сообщение пользователя
+func (m *ConversationManager) BuildRegenerate(ctx context.Context, chatID, turn int64) ([]ChatMessage, bool) {
+	budget := m.budget(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	i := findTurn(conv, turn)
+	if i < 0 {
+		return nil, false
+	}
+	return m.buildLocked(ctx, chatID, budget, conv, conv.Messages[:i], conv.Messages[i]), true
+}
+
+// BuildContinue собирает промпт с просьбой продолжить оборванный ответ на обмен turn
+func (m *ConversationManager) BuildContinue(ctx context.Context, chatID, turn int64) ([]ChatMessage, bool) {
+	budget := m.budget(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	i := findTurn(conv, turn)
+	if i < 0 {
+		return nil, false
+	}
+	return m.buildLocked(ctx, chatID, budget, conv, conv.Messages[:i+2], ChatMessage{
+		Role:    "user",
+		Content: "Продолжи ответ с того места, где остановился, без повторов и вступления.",
+	}), true
+}
+
+// BuildBranch собирает промпт для ответа в контексте ветки разговора:
+// история до обмена turn включительно и новое сообщение пользователя
+func (m *ConversationManager) BuildBranch(ctx context.Context, chatID, turn int64, userText string) ([]ChatMessage, bool) {
+	budget := m.budget(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	i := findTurn(conv, turn)
+	if i < 0 {
+		return nil, false
+	}
+	return m.buildLocked(ctx, chatID, budget, conv, conv.Messages[:i+2], ChatMessage{Role: "user", Content: userText}), true
+}
+
+// LinkAnswer запоминает ID сообщений Telegram, в которых отправлен ответ на обмен turn
+func (m *ConversationManager) LinkAnswer(chatID, turn int64, messageIDs []int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	for _, id := range messageIDs {
+		conv.answers[id] = turn
+	}
+	conv.answerIDs[turn] = append([]int64(nil), messageIDs...)
+}
+
+// AppendAnswerIDs дописывает ID сообщений с продолжением ответа на обмен turn
+// к уже связанным с ним сообщениям
+func (m *ConversationManager) AppendAnswerIDs(chatID, turn int64, messageIDs []int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	for _, id := range messageIDs {
+		conv.answers[id] = turn
+	}
+	conv.answerIDs[turn] = append(conv.answerIDs[turn], messageIDs...)
+}
+
+// LinkPrompt запоминает ID сообщения пользователя, на которое дан ответ в обмене turn
+func (m *ConversationManager) LinkPrompt(chatID, turn, messageID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conversation(chatID).prompts[messageID] = turn
+}
+
+// TurnForPrompt возвращает номер обмена и ID сообщений с ответом бота
+// по ID сообщения пользователя
+func (m *ConversationManager) TurnForPrompt(chatID, messageID int64) (int64, []int64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv, ok := m.chats[chatID]
+	if !ok {
+		return 0, nil, false
+	}
+	turn, ok := conv.prompts[messageID]
+	if !ok {
+		return 0, nil, false
+	}
+	return turn, append([]int64(nil), conv.answerIDs[turn]...), true
+}
+
+// BuildEdit собирает промпт для обмена turn с исправленным текстом пользователя
+func (m *ConversationManager) BuildEdit(ctx context.Context, chatID, turn int64, userText string) ([]ChatMessage, bool) {
+	budget := m.budget(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	i := findTurn(conv, turn)
+	if i < 0 {
+		return nil, false
+	}
+	return m.buildLocked(ctx, chatID, budget, conv, conv.Messages[:i], ChatMessage{Role: "user", Content: userText}), true
+}
+
+// ReplaceTurn заменяет реплику пользователя и ответ модели в обмене turn
+func (m *ConversationManager) ReplaceTurn(chatID, turn int64, userText, answer string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	i := findTurn(conv, turn)
+	if i < 0 {
+		return false
+	}
+	conv.Messages[i].Content = userText
+	conv.Messages[i+1].Content = answer
+	return true
+}
+
+// TurnForAnswer возвращает номер обмена по ID сообщения бота
+func (m *ConversationManager) TurnForAnswer(chatID, messageID int64) (int64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv, ok := m.chats[chatID]
+	if !ok {
+		return 0, false
+	}
+	turn, ok := conv.answers[messageID]
+	return turn, ok
+}
+
+// forgetLinks удаляет привязки сообщений Telegram к обменам, вытесненным
+// из истории. Вызывается под m.mu.
+func forgetLinks(conv *Conversation) {
+	first := conv.lastTurn + 1
+	if len(conv.Messages) > 0 {
+		first = conv.Messages[0].turn
+	}
+	for _, links := range []map[int64]int64{conv.answers, conv.prompts} {
+		for id, turn := range links {
+			if turn < first {
+				delete(links, id)
+			}
+		}
+	}
+	for turn := range conv.answerIDs {
+		if turn < first {
+			delete(conv.answerIDs, turn)
+		}
+	}
+}
+
+// ReplaceAnswer заменяет ответ модели на обмен turn новым вариантом
+func (m *ConversationManager) ReplaceAnswer(chatID, turn int64, answer string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	i := findTurn(conv, turn)
+	if i < 0 {
+		return false
+	}
+	conv.Messages[i+1].Content = answer
+	return true
+}
+
+// AppendAnswer дописывает продолжение к ответу модели на обмен turn
+func (m *ConversationManager) AppendAnswer(chatID, turn int64, continuation string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	i := findTurn(conv, turn)
+	if i < 0 {
+		return false
+	}
+	conv.Messages[i+1].Content += continuation
+	return true
+}
+
+// AddTurn сохраняет реплику пользователя и ответ модели и возвращает номер
+// обмена. Если история превысила бюджет, старейшие реплики вытесняются
+// и сворачиваются в фоне.
+func (m *ConversationManager) AddTurn(ctx context.Context, chatID, userID int64, userText, answer string) int64 {
+	budget := m.budget(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := m.conversation(chatID)
+	conv.lastTurn++
+	turn := conv.lastTurn
+	conv.Messages = append(conv.Messages,
+		ChatMessage{Role: "user", Content: userText, turn: turn},
+		ChatMessage{Role: "assistant", Content: answer, turn: turn},
+	)
+
+	if messagesTokens(m.systemMessages(conv))+messagesTokens(conv.Messages) <= budget {
+		return turn
+	}
+
+	// Вытесняем реплики с начала, пока история не займёт половину бюджета,
+	// но всегда оставляем последние keepMessages сообщений
+	cut := 0
+	for cut < len(conv.Messages)-m.keepMessages &&
+		messagesTokens(conv.Messages[cut:]) > budget/2 {
+		cut++
+	}
+	// Обмен не разрываем: вытесняем реплику пользователя вместе с ответом
+	if cut%2 == 1 {
+		cut++
+	}
+	if cut == 0 || cut > len(conv.Messages) {
+		return turn
+	}
+
+	evicted := append([]ChatMessage(nil), conv.Messages[:cut]...)
+	conv.Messages = append([]ChatMessage(nil), conv.Messages[cut:]...)
+	forgetLinks(conv)
+	slog.InfoContext(ctx, "Старые реплики вытеснены из истории", "chat_id", chatID, "evicted", len(evicted))
+
+	if !m.summarize {
+		return turn
+	}
+	conv.pending = append(conv.pending, evicted...)
+	conv.summaryUser = userID
+	if !conv.summarizing {
+		conv.summarizing = true
+		go m.summarizeLoop(context.WithoutCancel(ctx), chatID, conv)
+	}
+	return turn
+}
+
+// Reset удаляет историю чата; следующий запрос начнёт новый разговор
+func (m *ConversationManager) Reset(chatID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.chats, chatID)
+}
+
+// snapshot возвращает копию краткого содержания и реплик чата
+func (m *ConversationManager) snapshot(chatID int64) (string, []ChatMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conv, ok := m.chats[chatID]
+	if !ok {
+		return "", nil
+	}
+	return conv.Summary, append([]ChatMessage(nil), conv.Messages...)
+}
+
+// roleTitle возвращает подпись роли для показа пользователю на языке lang
+func roleTitle(lang, role string) string {
+	switch role {
+	case "user":
+		return T(lang, "role_user")
+	case "assistant":
+		return T(lang, "role_assistant")
+	default:
+		return role
+	}
+}
+
+// truncate обрезает строку до maxRunes символов, добавляя многоточие
+func truncate(s string, maxRunes int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= maxRunes {
+		return s
+	}
+	return string([]rune(s)[:maxRunes]) + "…"
+}
+
+// Overview формирует компактный обзор истории для /history на языке lang
+func (m *ConversationManager) Overview(lang string, chatID int64) string {
+	summary, messages := m.snapshot(chatID)
+	if summary == "" && len(messages) == 0 {
+		return T(lang, "history_empty")
+	}
+
+	var b strings.Builder
+	b.WriteString(T(lang, "history_stats", len(messages), messagesTokens(messages)))
+	if summary != "" {
+		b.WriteString(T(lang, "history_earlier", truncate(summary, 300)))
+	}
+	if len(messages) > 0 {
+		b.WriteString("\n")
+	}
+	for i, msg := range messages {
+		fmt.Fprintf(&b, "%d. %s: %s\n", i+1, roleTitle(lang, msg.Role), truncate(msg.Content, 80))
+	}
+	return b.String()
+}
+
+// ExportMarkdown выгружает историю чата в Markdown с заголовками на языке lang
+func (m *ConversationManager) ExportMarkdown(lang string, chatID int64) []byte {
+	summary, messages := m.snapshot(chatID)
+
+	var b strings.Builder
+	b.WriteString(T(lang, "export_title"))
+	if summary != "" {
+		b.WriteString(T(lang, "export_summary", summary))
+	}
+	for _, msg := range messages {
+		fmt.Fprintf(&b, "## %s\n\n%s\n\n", roleTitle(lang, msg.Role), msg.Content)
+	}
+	return []byte(b.String())
+}
+
+// conversationExport формат выгрузки истории в JSON
+type conversationExport struct {
+	ChatID       int64         `json:"chat_id"`
+	Model        string        `json:"model"`
+	SystemPrompt string        `json:"system_prompt,omitempty"`
+	Summary      string        `json:"summary,omitempty"`
+	Messages     []ChatMessage `json:"messages"`
+}
+
+// ExportJSON выгружает историю чата в JSON
+func (m *ConversationManager) ExportJSON(chatID int64) ([]byte, error) {
+	summary, messages := m.snapshot(chatID)
+	if messages == nil {
+		messages = []ChatMessage{}
+	}
+	return json.MarshalIndent(conversationExport{
+		ChatID:       chatID,
+		Model:        m.ollama.Model,
+		SystemPrompt: m.systemPrompt,
+		Summary:      summary,
+		Messages:     messages,
+	}, "", "  ")
+}
+
+// summarizeLoop сворачивает вытесненные реплики в краткое содержание,
+// пока есть необработанные
+func (m *ConversationManager) summarizeLoop(ctx context.Context, chatID int64, conv *Conversation) {
+	for {
+		m.mu.Lock()
+		pending := conv.pending
+		summary := conv.Summary
+		userID := conv.summaryUser
+		conv.pending = nil
+		if len(pending) == 0 {
+			conv.summarizing = false
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+
+		resp, err := m.ollama.Generate(ctx, summarizationPrompt(summary, pending))
+		if err != nil {
+			metricSummaries.Inc("error")
+			slog.WarnContext(ctx, "Ошибка суммаризации истории, реплики отброшены", "chat_id", chatID, "error", err)
+			continue
+		}
+		metricSummaries.Inc("ok")
+		if m.usage != nil {
+			m.usage.Record(userID, chatID, resp)
+		}
+
+		m.mu.Lock()
+		// История могла быть сброшена, пока шла суммаризация
+		if m.chats[chatID] == conv {
+			conv.Summary = strings.TrimSpace(resp.Response)
+		}
+		m.mu.Unlock()
+		slog.DebugContext(ctx, "Краткое содержание истории обновлено", "chat_id", chatID)
+	}
+}
+
+// summarizationPrompt формирует запрос на краткий пересказ вытесненных реплик
+func summarizationPrompt(summary string, messages []ChatMessage) string {
+	var b strings.Builder
+	b.WriteString("Кратко перескажи содержание разговора ниже в нескольких предложениях. " +
+		"Сохрани важные факты, имена, договорённости и открытые вопросы. " +
+		"Ответь только пересказом, без вступления.\n\n")
+	if summary != "" {
+		fmt.Fprintf(&b, "Ранее:\n%s\n\n", summary)
+	}
+	b.WriteString("Разговор:\n")
+	for _, msg := range messages {
+		fmt.Fprintf(&b, "%s: %s\n", msg.Role, msg.Content)
+	}
+	return b.String()
+}
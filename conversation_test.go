@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestConversations создаёт менеджер диалогов с маленьким контекстом,
+// чтобы вытеснение наступало после нескольких обменов
+func newTestConversations(t *testing.T, keep string) (*ConversationManager, *UsageTracker) {
+	t.Helper()
+	t.Setenv("OLLAMA_NUM_CTX", "400")
+	t.Setenv("HISTORY_KEEP_MESSAGES", keep)
+	t.Setenv("USAGE_FILE", filepath.Join(t.TempDir(), "usage.json"))
+	_, _, client := newTestOllama(t)
+	usage := NewUsageTracker()
+	t.Cleanup(usage.Flush)
+	return NewConversationManager(client, usage), usage
+}
+
+func TestAddTurnKeepsWholeTurns(t *testing.T) {
+	for _, keep := range []string{"1", "3", "5"} {
+		t.Run(keep, func(t *testing.T) {
+			t.Setenv("HISTORY_SUMMARIZE", "false")
+			m, _ := newTestConversations(t, keep)
+			ctx := context.Background()
+
+			long := strings.Repeat("слово ", 100)
+			for i := 0; i < 6; i++ {
+				m.AddTurn(ctx, 1, 1, long, long)
+			}
+			_, messages := m.snapshot(1)
+			want := m.keepMessages
+			if want%2 == 1 || len(messages) < want || len(messages)%2 == 1 || messages[0].Role != "user" {
+				t.Fatalf("keep=%s: осталось %d сообщений (keepMessages %d), первое %q",
+					keep, len(messages), want, messages[0].Role)
+			}
+		})
+	}
+}
+
+func TestSummaryRecordsUsage(t *testing.T) {
+	m, usage := newTestConversations(t, "2")
+	ctx := context.Background()
+
+	long := strings.Repeat("слово ", 100)
+	for i := 0; i < 3; i++ {
+		m.AddTurn(ctx, 10, 7, long, long)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		summary, _ := m.snapshot(10)
+		if summary != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("краткое содержание не появилось")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	if u, c := usage.users[7], usage.chats[10]; u == nil || c == nil || u.Total.Requests == 0 || c.Total.Requests == 0 {
+		t.Fatalf("суммаризация не учтена: пользователь %+v, чат %+v", u, c)
+	}
+}
+
+func TestBudgetBacksOffAfterShowFailure(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	t.Setenv("OLLAMA_URL", server.URL)
+	t.Setenv("OLLAMA_NUM_CTX", "")
+	client, err := NewOllamaClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewConversationManager(client, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if got := m.budget(ctx); got != defaultNumCtx*3/4 {
+			t.Fatalf("budget = %d", got)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("/api/show запрошен %d раз, ожидался 1", n)
+	}
+
+	// По истечении паузы запрос повторяется, а пауза удваивается
+	m.mu.Lock()
+	m.retryAt = time.Time{}
+	m.mu.Unlock()
+	m.budget(ctx)
+	if n := requests.Load(); n != 2 || m.retryDelay != 2*contextLengthRetryMin {
+		t.Fatalf("запросов %d, пауза %v", n, m.retryDelay)
+	}
+}
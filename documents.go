@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// documentChunkSize примерный размер фрагмента документа в символах при поиске
+	documentChunkSize = 1000
+	// documentSearchResults сколько фрагментов возвращает поиск
+	documentSearchResults = 3
+)
+
+// Document файл, отправленный боту как документ
+type Document struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileName     string `json:"file_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// ChatDocument текстовый документ, загруженный в чат
+type ChatDocument struct {
+	Name string
+	Text string
+}
+
+// DocumentStore хранит текстовые документы чатов в памяти для поиска
+// инструментом search_documents. При превышении лимита вытесняются самые старые.
+type DocumentStore struct {
+	maxPerChat int
+
+	mu    sync.Mutex
+	chats map[int64][]ChatDocument
+}
+
+// NewDocumentStore создаёт хранилище документов с лимитом из DOCUMENTS_MAX_PER_CHAT
+func NewDocumentStore() *DocumentStore {
+	maxPerChat := 5
+	if v := os.Getenv("DOCUMENTS_MAX_PER_CHAT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxPerChat = n
+		}
+	}
+	return &DocumentStore{
+		maxPerChat: maxPerChat,
+		chats:      make(map[int64][]ChatDocument),
+	}
+}
+
+// Add сохраняет документ чата; документ с тем же именем заменяется
+func (s *DocumentStore) Add(chatID int64, doc ChatDocument) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var docs []ChatDocument
+	for _, d := range s.chats[chatID] {
+		if d.Name != doc.Name {
+			docs = append(docs, d)
+		}
+	}
+	docs = append(docs, doc)
+	if len(docs) > s.maxPerChat {
+		docs = docs[len(docs)-s.maxPerChat:]
+	}
+	s.chats[chatID] = docs
+}
+
+// Count возвращает число документов чата
+func (s *DocumentStore) Count(chatID int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.chats[chatID])
+}
+
+// documentMatch найденный фрагмент документа
+type documentMatch struct {
+	Name  string
+	Text  string
+	score int
+}
+
+// Search ищет в документах чата фрагменты, в которых чаще всего встречаются
+// слова запроса. Возвращает не больше limit фрагментов по убыванию совпадений.
+func (s *DocumentStore) Search(chatID int64, query string, limit int) []documentMatch {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	docs := s.chats[chatID]
+	s.mu.Unlock()
+
+	var matches []documentMatch
+	for _, doc := range docs {
+		for _, chunk := range splitChunks(doc.Text, documentChunkSize) {
+			lower := strings.ToLower(chunk)
+			score := 0
+			for _, term := range terms {
+				score += strings.Count(lower, term)
+			}
+			if score > 0 {
+				matches = append(matches, documentMatch{Name: doc.Name, Text: chunk, score: score})
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// searchTerms разбивает запрос на слова не короче трёх символов в нижнем регистре
+func searchTerms(query string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(word) >= 3 {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// splitChunks делит текст на фрагменты не длиннее size символов по границам
+// абзацев; слишком длинные абзацы режутся на части
+func splitChunks(text string, size int) []string {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		for runes := []rune(paragraph); len(runes) > size; runes = runes[size:] {
+			paragraphs = append(paragraphs, string(runes[:size]))
+			paragraph = string(runes[size:])
+		}
+		paragraphs = append(paragraphs, paragraph)
+	}
+
+	var chunks []string
+	var current strings.Builder
+	for _, paragraph := range paragraphs {
+		if current.Len() > 0 && utf8.RuneCountInString(current.String())+utf8.RuneCountInString(paragraph) > size {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(paragraph)
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+// isTextDocument проверяет по MIME-типу и расширению, что документ текстовый
+func isTextDocument(doc *Document) bool {
+	if strings.HasPrefix(doc.MimeType, "text/") {
+		return true
+	}
+	switch doc.MimeType {
+	case "application/json", "application/xml", "application/x-yaml":
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(doc.FileName)) {
+	case ".txt", ".md", ".csv", ".json", ".log", ".xml", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// handleDocument сохраняет присланный текстовый документ для поиска инструментом
+// search_documents. Подпись к документу обрабатывается как обычное сообщение
+// в рамках того же лимита запросов.
+func (bot *TelegramBot) handleDocument(ctx context.Context, message *Message) {
+	chatID := message.Chat.ID
+	doc := message.Document
+
+	if !isTextDocument(doc) {
+		bot.reply(ctx, chatID, tr(ctx, "document_unsupported"))
+		return
+	}
+
+	// Как и для голосовых, лимиты проверяются до скачивания: подпись к документу
+	// отправляется модели без повторной проверки
+	if !bot.checkRateLimit(chatID) {
+		metricRateLimited.Inc()
+		bot.reply(ctx, chatID, tr(ctx, "rate_limited"))
+		return
+	}
+	if !bot.checkQuota(ctx, chatID, senderID(message)) {
+		return
+	}
+
+	data, err := bot.downloadDocument(ctx, doc)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка загрузки документа", "chat_id", chatID, "file_name", doc.FileName, "error", err)
+		bot.reply(ctx, chatID, tr(ctx, "document_failed"))
+		return
+	}
+	if !utf8.Valid(data) {
+		bot.reply(ctx, chatID, tr(ctx, "document_unsupported"))
+		return
+	}
+
+	name := doc.FileName
+	if name == "" {
+		name = doc.FileUniqueID
+	}
+	bot.Documents.Add(chatID, ChatDocument{Name: name, Text: string(data)})
+	slog.InfoContext(ctx, "Документ сохранён", "chat_id", chatID, "file_name", name, "size", len(data))
+
+	bot.reply(ctx, chatID, tr(ctx, "document_saved", name))
+	if message.Caption != "" {
+		bot.answerText(ctx, message, message.Caption)
+	}
+}
+
+// downloadDocument получает путь к документу через getFile и скачивает его
+func (bot *TelegramBot) downloadDocument(ctx context.Context, doc *Document) ([]byte, error) {
+	if doc.FileSize > bot.maxFileSize {
+		return nil, fmt.Errorf("файл больше %d байт", bot.maxFileSize)
+	}
+	file, err := bot.GetFile(ctx, doc.FileID)
+	if err != nil {
+		return nil, err
+	}
+	return bot.DownloadFile(ctx, file)
+}
@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// scenarioTimeout время ожидания реакции бота в одном сценарии
+const scenarioTimeout = 10 * time.Second
+
+// testUser пользователь, от имени которого сценарии пишут боту
+var testUser = &User{ID: 42, FirstName: "Tester", LanguageCode: "ru"}
+
+// scenarioEnv окружение сценария: поддельные Bot API и Ollama и бот,
+// который работает с ними по HTTP так же, как с настоящими серверами
+type scenarioEnv struct {
+	t      *testing.T
+	api    *FakeBotAPI
+	ollama *FakeOllama
+	bot    *TelegramBot
+	health *Health
+	// dir временный каталог сценария
+	dir string
+}
+
+// scenario сквозной сценарий: обновления → обработчики → вызовы Bot API
+type scenario struct {
+	name string
+	run  func(ctx context.Context, env *scenarioEnv) error
+}
+
+var scenarios = []scenario{
+	{"start", func(ctx context.Context, env *scenarioEnv) error {
+		env.api.SendText(testUser, "/start")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 1)
+		if err != nil {
+			return err
+		}
+		return expectContains(calls[0].String("text"), "Привет")
+	}},
+	{"answer", func(ctx context.Context, env *scenarioEnv) error {
+		env.api.SendText(testUser, "как дела?")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 2)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[0].String("text"), "Обрабатываю"); err != nil {
+			return err
+		}
+		if err := expectContains(calls[1].String("text"), "Эхо: как дела?"); err != nil {
+			return err
+		}
+		return expectContains(calls[1].String("reply_markup"), callbackRegenerate+":")
+	}},
+	{"language", func(ctx context.Context, env *scenarioEnv) error {
+		env.api.SendText(&User{ID: 43, FirstName: "Tester", LanguageCode: "en-US"}, "/help")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 1)
+		if err != nil {
+			return err
+		}
+		return expectContains(calls[0].String("text"), "Available commands")
+	}},
+	{"edit", func(ctx context.Context, env *scenarioEnv) error {
+		message := env.api.SendText(testUser, "первый вопрос")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 2); err != nil {
+			return err
+		}
+		env.api.EditText(message, "второй вопрос")
+		calls, err := env.api.WaitCalls(ctx, "editMessageText", 1)
+		if err != nil {
+			return err
+		}
+		return expectContains(calls[0].String("text"), "Эхо: второй вопрос")
+	}},
+	{"edit branch", func(ctx context.Context, env *scenarioEnv) error {
+		chatID := testUser.ID
+		first := env.api.SendText(testUser, "первый вопрос")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 2); err != nil {
+			return err
+		}
+		env.api.SendText(testUser, "второй вопрос")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 4); err != nil {
+			return err
+		}
+		_, answerIDs, ok := env.bot.History.TurnForPrompt(chatID, first.MessageID)
+		if !ok || len(answerIDs) == 0 {
+			return fmt.Errorf("ответ на первый вопрос не найден")
+		}
+
+		// Ответ на первый ответ бота продолжает ветку, а не цитирует его;
+		// правка такого сообщения собирается по тем же правилам
+		answer := &Message{MessageID: answerIDs[0], From: &User{ID: 1, FirstName: "Bot", IsBot: true}, Chat: first.Chat, Text: "Эхо: первый вопрос"}
+		reply := env.api.ReplyText(testUser, answer, "уточнение")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 6); err != nil {
+			return err
+		}
+		env.api.EditText(reply, "исправленное уточнение")
+		if _, err := env.api.WaitCalls(ctx, "editMessageText", 1); err != nil {
+			return err
+		}
+
+		_, messages := env.bot.History.snapshot(chatID)
+		if last := messages[len(messages)-2]; last.Content != "исправленное уточнение" {
+			return fmt.Errorf("в истории сохранён промпт %q", last.Content)
+		}
+		return nil
+	}},
+	{"edit continued", func(ctx context.Context, env *scenarioEnv) error {
+		chatID := testUser.ID
+		prompt := env.api.SendText(testUser, "первый вопрос")
+		if err := env.api.WaitIdle(ctx); err != nil {
+			return err
+		}
+		turn, answerIDs, ok := env.bot.History.TurnForPrompt(chatID, prompt.MessageID)
+		if !ok || len(answerIDs) != 1 {
+			return fmt.Errorf("ответ на вопрос не найден: %v", answerIDs)
+		}
+		env.api.PressButton(testUser, answerIDs[0], callbackContinue+":"+strconv.FormatInt(turn, 10))
+		if err := env.api.WaitIdle(ctx); err != nil {
+			return err
+		}
+		_, answerIDs, _ = env.bot.History.TurnForPrompt(chatID, prompt.MessageID)
+		if len(answerIDs) != 2 {
+			return fmt.Errorf("продолжение не связано с ответом: %v", answerIDs)
+		}
+
+		// Новый ответ занимает первое сообщение, продолжение удаляется
+		env.api.EditText(prompt, "второй вопрос")
+		edits, err := env.api.WaitCalls(ctx, "editMessageText", 1)
+		if err != nil {
+			return err
+		}
+		deletes, err := env.api.WaitCalls(ctx, "deleteMessage", 1)
+		if err != nil {
+			return err
+		}
+		if edits[0].Int("message_id") != answerIDs[0] || deletes[0].Int("message_id") != answerIDs[1] {
+			return fmt.Errorf("отредактировано сообщение %d и удалено %d, ожидались %v",
+				edits[0].Int("message_id"), deletes[0].Int("message_id"), answerIDs)
+		}
+		return expectContains(edits[0].String("text"), "Эхо: второй вопрос")
+	}},
+	{"commands", func(ctx context.Context, env *scenarioEnv) error {
+		env.bot.RegisterCommands(ctx)
+		calls := env.api.Calls("setMyCommands")
+		if len(calls) != len(commandLanguages()) {
+			return fmt.Errorf("setMyCommands вызван %d раз(а), ожидалось %d", len(calls), len(commandLanguages()))
+		}
+		return expectContains(calls[0].String("commands"), `"command":"help"`)
+	}},
+	{"stats", func(ctx context.Context, env *scenarioEnv) error {
+		env.api.SendText(testUser, "/stats")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 1)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[0].String("text"), "только администраторам"); err != nil {
+			return err
+		}
+
+		env.bot.Admins[testUser.ID] = true
+		env.api.SendText(testUser, "/stats")
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 2); err != nil {
+			return err
+		}
+		return expectContains(calls[1].String("text"), "Статистика бота")
+	}},
+	{"download file", func(ctx context.Context, env *scenarioEnv) error {
+		return expectDownload(ctx, env, "voice/file_1.oga")
+	}},
+	{"download local file", func(ctx context.Context, env *scenarioEnv) error {
+		env.api.LocalDir = env.dir
+		env.bot.LocalMode = true
+		return expectDownload(ctx, env, "file_2.oga")
+	}},
+	{"close", func(ctx context.Context, env *scenarioEnv) error {
+		if err := env.bot.Close(ctx); err != nil {
+			return err
+		}
+		if err := env.bot.LogOut(ctx); err != nil {
+			return err
+		}
+		if len(env.api.Calls("close")) != 1 || len(env.api.Calls("logOut")) != 1 {
+			return fmt.Errorf("ожидались вызовы close и logOut")
+		}
+		return nil
+	}},
+	{"proxy", func(ctx context.Context, env *scenarioEnv) error {
+		// Прокси записывает запросы и передаёт их поддельному Bot API
+		var mu sync.Mutex
+		var seen []string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen = append(seen, r.Host+" "+r.Header.Get("Proxy-Authorization"))
+			mu.Unlock()
+			env.api.ServeHTTP(w, r)
+		}))
+		defer proxy.Close()
+
+		env.t.Setenv("TELEGRAM_PROXY", "http://user:secret@"+proxy.Listener.Addr().String())
+		env.t.Setenv("TELEGRAM_API_URL", "http://telegram.test")
+
+		bot, err := NewTelegramBot(env.api.Token)
+		if err != nil {
+			return err
+		}
+		if _, err := bot.GetMe(ctx); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) != 1 {
+			return fmt.Errorf("через прокси прошло %d запрос(ов), ожидался 1", len(seen))
+		}
+		return expectContains(seen[0], "telegram.test Basic ")
+	}},
+	{"connection reuse", func(ctx context.Context, env *scenarioEnv) error {
+		// Последовательные запросы к одному серверу идут через одно соединение из пула
+		before := metricHTTPConnections.Value("ollama", "true")
+		for i := 0; i < 3; i++ {
+			if _, err := env.bot.Ollama.HasModel(ctx); err != nil {
+				return err
+			}
+		}
+		if reused := metricHTTPConnections.Value("ollama", "true") - before; reused < 2 {
+			return fmt.Errorf("переиспользовано %v соединений, ожидалось не меньше 2", reused)
+		}
+		return nil
+	}},
+	{"tools", func(ctx context.Context, env *scenarioEnv) error {
+		// Модель один раз ищет в документах, затем отвечает по результату
+		env.ollama.ToolCall = func(messages []ChatMessage) *ToolCall {
+			if messages[len(messages)-1].Role == "user" {
+				return NewFakeToolCall("search_documents", `{"query":"пароль от wifi"}`)
+			}
+			return nil
+		}
+		env.api.SendText(testUser, "/tools on")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 1); err != nil {
+			return err
+		}
+		if _, err := env.api.UploadDocument(testUser, "notes.txt", []byte("Список покупок: хлеб.\n\nПароль от WiFi: qwerty123")); err != nil {
+			return err
+		}
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 2); err != nil {
+			return err
+		}
+		env.api.SendText(testUser, "какой пароль?")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 4)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[1].String("text"), "notes.txt"); err != nil {
+			return err
+		}
+		if err := expectContains(calls[3].String("text"), "Результат: [notes.txt]\n"); err != nil {
+			return err
+		}
+		return expectContains(calls[3].String("text"), "Пароль от WiFi: qwerty123")
+	}},
+	{"document limits", func(ctx context.Context, env *scenarioEnv) error {
+		// Rate limit и квота проверяются до скачивания документа
+		env.bot.maxRequests = 0
+		if _, err := env.api.UploadDocument(testUser, "notes.txt", []byte("заметки")); err != nil {
+			return err
+		}
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 1)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[0].String("text"), "Слишком много запросов"); err != nil {
+			return err
+		}
+
+		env.bot.maxRequests = 100
+		env.t.Setenv("QUOTA_DAILY_TOKENS", "10")
+		env.bot.Usage = NewUsageTracker()
+		env.bot.Usage.Record(testUser.ID, testUser.ID, &OllamaResponse{PromptEvalCount: 10, EvalCount: 10})
+		if _, err := env.api.UploadDocument(testUser, "notes.txt", []byte("заметки")); err != nil {
+			return err
+		}
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 2); err != nil {
+			return err
+		}
+		if err := expectContains(calls[1].String("text"), "квота"); err != nil {
+			return err
+		}
+		if n := len(env.api.Calls("getFile")); n != 0 {
+			return fmt.Errorf("документ скачан в обход лимитов: %d вызовов getFile", n)
+		}
+		return nil
+	}},
+	{"tools limit", func(ctx context.Context, env *scenarioEnv) error {
+		// Модель, которая вызывает инструменты бесконечно, отвечает без них после лимита
+		env.t.Setenv("TOOLS_MAX_ITERATIONS", "2")
+		env.ollama.ToolCall = func([]ChatMessage) *ToolCall {
+			return NewFakeToolCall("calculator", `{"expression":"(2+3)*4^2"}`)
+		}
+		resp, err := env.bot.chatWithTools(ctx, testUser.ID, testUser.ID, []ChatMessage{{Role: "user", Content: "сколько?"}}, nil)
+		if err != nil {
+			return err
+		}
+		chats := 0
+		for _, path := range env.ollama.Requests() {
+			if path == "/api/chat" {
+				chats++
+			}
+		}
+		if chats != 3 {
+			return fmt.Errorf("запросов к /api/chat: %d, ожидалось 3", chats)
+		}
+		return expectContains(resp.Response, "Результат: 80")
+	}},
+	{"json", func(ctx context.Context, env *scenarioEnv) error {
+		// Первый ответ без обязательного поля, исправленный — после сообщения об ошибке
+		env.ollama.Reply = func(prompt string) string {
+			if strings.Contains(prompt, "не прошёл проверку") {
+				return `{"name": "Иван", "age": 30}`
+			}
+			return `{"name": "Иван"}`
+		}
+		env.api.SendText(testUser, `/json
+{"type":"object","properties":{"name":{"type":"string"},"age":{"type":"integer"}},"required":["name","age"]}
+Иван, 30 лет`)
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 2)
+		if err != nil {
+			return err
+		}
+		if calls[1].String("parse_mode") != "HTML" {
+			return fmt.Errorf("parse_mode %q, ожидался HTML", calls[1].String("parse_mode"))
+		}
+		return expectContains(calls[1].String("text"), "<pre><code class=\"language-json\">{\n  \"name\": \"Иван\",\n  \"age\": 30\n}")
+	}},
+	{"json file", func(ctx context.Context, env *scenarioEnv) error {
+		env.ollama.Reply = func(string) string {
+			data, _ := json.Marshal(map[string]string{"text": strings.Repeat("а", maxInlineJSONLen)})
+			return string(data)
+		}
+		env.api.SendText(testUser, "/json длинный ответ")
+		calls, err := env.api.WaitCalls(ctx, "sendDocument", 1)
+		if err != nil {
+			return err
+		}
+		return expectContains(string(calls[0].Files["document"]), `"text": "ааа`)
+	}},
+	{"json failed", func(ctx context.Context, env *scenarioEnv) error {
+		env.t.Setenv("JSON_MAX_RETRIES", "1")
+		env.ollama.Reply = func(string) string { return "не JSON" }
+		_, resp, err := env.bot.Ollama.ChatJSON(ctx, []ChatMessage{{Role: "user", Content: "?"}}, nil, jsonMaxRetries())
+		if err == nil {
+			return fmt.Errorf("ожидалась ошибка проверки")
+		}
+		if resp == nil || resp.EvalCount != 2*estimateTokens("не JSON") {
+			return fmt.Errorf("токены двух попыток не учтены: %+v", resp)
+		}
+		return expectContains(err.Error(), "после 2 попыток: некорректный JSON")
+	}},
+	{"generation error", func(ctx context.Context, env *scenarioEnv) error {
+		env.ollama.SetFailure(FailStatus)
+		env.api.SendText(testUser, "вопрос")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 2)
+		if err != nil {
+			return err
+		}
+		return expectContains(calls[1].String("text"), "Произошла ошибка")
+	}},
+	{"liveness during generation", func(ctx context.Context, env *scenarioEnv) error {
+		// Генерация длится дольше допустимого возраста heartbeat, но бот остаётся живым
+		env.health.maxAge = 50 * time.Millisecond
+		env.ollama.SetLatency(300 * time.Millisecond)
+		env.api.SendText(testUser, "долгий вопрос")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 1); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		rec := httptest.NewRecorder()
+		env.health.LivenessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("/healthz во время генерации: %d %s", rec.Code, rec.Body)
+		}
+		if err := expectContains(rec.Body.String(), "обработка обновления идёт"); err != nil {
+			return err
+		}
+		_, err := env.api.WaitCalls(ctx, "sendMessage", 2)
+		return err
+	}},
+	{"ollama auth", func(ctx context.Context, env *scenarioEnv) error {
+		// Другой хост, на который Ollama перенаправляет запрос, не должен получить секреты
+		var leaked http.Header
+		other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			leaked = r.Header.Clone()
+			env.ollama.ServeHTTP(w, r)
+		}))
+		defer other.Close()
+
+		var got http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/show" {
+				http.Redirect(w, r, other.URL+r.URL.Path, http.StatusTemporaryRedirect)
+				return
+			}
+			got = r.Header.Clone()
+			env.ollama.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		env.t.Setenv("OLLAMA_URL", server.URL)
+		env.t.Setenv("OLLAMA_AUTH_TOKEN", "ollama-token-42")
+		env.t.Setenv("OLLAMA_HEADERS", "X-Tenant: bot, X-Api-Key: header-key-42")
+
+		client, err := NewOllamaClient()
+		if err != nil {
+			return err
+		}
+		if _, err := client.HasModel(ctx); err != nil {
+			return err
+		}
+		for name, want := range map[string]string{
+			"Authorization": "Bearer ollama-token-42",
+			"X-Tenant":      "bot",
+			"X-Api-Key":     "header-key-42",
+		} {
+			if got.Get(name) != want {
+				return fmt.Errorf("заголовок %s: %q, ожидалось %q", name, got.Get(name), want)
+			}
+		}
+		if _, err := client.ContextLength(ctx); err != nil {
+			return err
+		}
+		if leaked == nil {
+			return fmt.Errorf("перенаправление не выполнено")
+		}
+		for _, name := range []string{"Authorization", "X-Tenant", "X-Api-Key"} {
+			if leaked.Get(name) != "" {
+				return fmt.Errorf("заголовок %s передан другому хосту после перенаправления", name)
+			}
+		}
+		return expectContains(logRedactor.Redact("Bearer ollama-token-42 header-key-42 bot"), "[REDACTED] [REDACTED] bot")
+	}},
+	{"ollama mtls", func(ctx context.Context, env *scenarioEnv) error {
+		server := httptest.NewUnstartedServer(env.ollama)
+		clientCert, err := writeClientCert(env.dir)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCert)
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+		server.StartTLS()
+		defer server.Close()
+
+		caFile := filepath.Join(env.dir, "ca.pem")
+		caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+			return err
+		}
+
+		env.t.Setenv("OLLAMA_URL", server.URL)
+
+		// Неверный путь к сертификатам — ошибка конфигурации, а не системный TLS
+		env.t.Setenv("OLLAMA_CA_FILE", filepath.Join(env.dir, "missing.pem"))
+		if _, err := NewOllamaClient(); err == nil {
+			return fmt.Errorf("ожидалась ошибка для несуществующего OLLAMA_CA_FILE")
+		}
+		env.t.Setenv("OLLAMA_CA_FILE", caFile)
+
+		// Без клиентского сертификата сервер обрывает рукопожатие
+		client, err := NewOllamaClient()
+		if err != nil {
+			return err
+		}
+		if _, err := client.HasModel(ctx); err == nil {
+			return fmt.Errorf("ожидалась ошибка без клиентского сертификата")
+		}
+
+		env.t.Setenv("OLLAMA_CLIENT_CERT", filepath.Join(env.dir, "client.pem"))
+		env.t.Setenv("OLLAMA_CLIENT_KEY", filepath.Join(env.dir, "client-key.pem"))
+
+		if client, err = NewOllamaClient(); err != nil {
+			return err
+		}
+		answer, err := client.SendPrompt(ctx, "привет")
+		if err != nil {
+			return err
+		}
+		return expectContains(answer, "Эхо: привет")
+	}},
+	{"templates", func(ctx context.Context, env *scenarioEnv) error {
+		env.bot.Admins[testUser.ID] = true
+		steps := []struct{ text, want string }{
+			{"/sharedtemplate add translate Переведи на {{default \"английский\" .Vars.to}}:\n{{.Input}}", "translate сохранён"},
+			{"/template add review Проверь код:\n{{.Input}}", "review сохранён"},
+			{"/t translate to=немецкий Привет, мир", "Эхо: Переведи на немецкий:\nПривет, мир"},
+			{"/templates", "Общие шаблоны:\n• translate"},
+		}
+		sent := 0
+		for _, step := range steps {
+			env.api.SendText(testUser, step.text)
+			calls, err := env.api.WaitCalls(ctx, "sendMessage", sent+1)
+			if err != nil {
+				return err
+			}
+			// Запрос к модели отправляет ещё и «Обрабатываю»
+			if strings.HasPrefix(step.text, "/t ") {
+				if calls, err = env.api.WaitCalls(ctx, "sendMessage", sent+2); err != nil {
+					return err
+				}
+			}
+			sent = len(calls)
+			if err := expectContains(calls[sent-1].String("text"), step.want); err != nil {
+				return err
+			}
+		}
+
+		// Выбор шаблона кнопкой: следующее сообщение становится вводом
+		env.api.SendText(testUser, "/t")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", sent+1)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[sent].String("reply_markup"), callbackTemplate+":review"); err != nil {
+			return err
+		}
+		env.api.PressButton(testUser, 1, callbackTemplate+":review")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", sent+2); err != nil {
+			return err
+		}
+		env.api.SendText(testUser, "func f() {}")
+		calls, err = env.api.WaitCalls(ctx, "sendMessage", sent+4)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[sent+3].String("text"), "Эхо: Проверь код:\nfunc f() {}"); err != nil {
+			return err
+		}
+
+		// Общие шаблоны меняют только администраторы
+		env.api.SendText(&User{ID: 44, FirstName: "Other"}, "/sharedtemplate add x текст")
+		calls, err = env.api.WaitCalls(ctx, "sendMessage", sent+5)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[sent+4].String("text"), "только администраторам"); err != nil {
+			return err
+		}
+		if n := len(NewTemplateStore().List(testUser.ID)); n != 2 {
+			return fmt.Errorf("после перезагрузки доступно %d шаблонов, ожидалось 2", n)
+		}
+		return nil
+	}},
+	{"compare", func(ctx context.Context, env *scenarioEnv) error {
+		model := env.bot.Ollama.Model
+		env.ollama.Models = []string{"qwen-test"}
+		env.t.Setenv("COMPARE_MODELS", "qwen-test,missing")
+		env.api.SendText(testUser, "/compare "+model+",qwen-test,missing Сколько будет 2+2?")
+		// «Сравниваю», три ответа и сводка с кнопками
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 5)
+		if err != nil {
+			return err
+		}
+		for i, want := range []string{"A · " + model + " · ", "B · qwen-test · ", "C · missing: не удалось"} {
+			if err := expectContains(calls[i+1].String("text"), want); err != nil {
+				return err
+			}
+		}
+		if err := expectContains(calls[2].String("text"), "Эхо: Сколько будет 2+2?"); err != nil {
+			return err
+		}
+		summary := calls[4]
+		if err := expectContains(summary.String("text"), "Какой ответ лучше?"); err != nil {
+			return err
+		}
+		markup := summary.String("reply_markup")
+		_, rest, _ := strings.Cut(markup, callbackVote+":")
+		id, _, _ := strings.Cut(rest, ":")
+		if strings.Contains(markup, "👍 C") || id == "" {
+			return fmt.Errorf("неожиданные кнопки голосования: %s", markup)
+		}
+
+		// Голос сохраняется в файл, повторный голос не учитывается
+		data := callbackVote + ":" + id + ":1"
+		env.api.PressButton(testUser, 5, data)
+		answers, err := env.api.WaitCalls(ctx, "answerCallbackQuery", 1)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(answers[0].String("text"), "qwen-test"); err != nil {
+			return err
+		}
+		env.api.PressButton(testUser, 5, data)
+		if answers, err = env.api.WaitCalls(ctx, "answerCallbackQuery", 2); err != nil {
+			return err
+		}
+		if err := expectContains(answers[1].String("text"), "уже проголосовали"); err != nil {
+			return err
+		}
+		tally := NewCompareStore().Tally()
+		if len(tally) != 2 || tally[0].Model != "qwen-test" || tally[0].Wins != 1 || tally[1].Votes != 1 {
+			return fmt.Errorf("итоги после перезагрузки: %+v", tally)
+		}
+
+		env.api.SendText(testUser, "/compare stats")
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 6); err != nil {
+			return err
+		}
+		return expectContains(calls[5].String("text"), "qwen-test — 1 / 1")
+	}},
+	{"compare limits", func(ctx context.Context, env *scenarioEnv) error {
+		model := env.bot.Ollama.Model
+		env.ollama.Models = []string{"qwen-test", "other"}
+
+		// Без COMPARE_MODELS установленные в Ollama модели недоступны
+		env.api.SendText(testUser, "/compare "+model+",qwen-test вопрос")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 1)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[0].String("text"), "qwen-test недоступна для сравнения. Разрешены: "+model); err != nil {
+			return err
+		}
+
+		// Слишком длинный промпт не занимает места в окне rate limit
+		env.t.Setenv("COMPARE_MODELS", "qwen-test,other")
+		maxPromptLen := env.bot.maxPromptLen
+		env.bot.maxPromptLen = 5
+		env.api.SendText(testUser, "/compare "+model+",qwen-test длинный вопрос")
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 2); err != nil {
+			return err
+		}
+		if err := expectContains(calls[1].String("text"), "слишком длинное"); err != nil {
+			return err
+		}
+		env.bot.mu.Lock()
+		charged := len(env.bot.rateLimiter[testUser.ID])
+		env.bot.mu.Unlock()
+		if charged != 0 {
+			return fmt.Errorf("отклонённое сравнение заняло %d мест в окне rate limit", charged)
+		}
+		env.bot.maxPromptLen = maxPromptLen
+
+		// Три модели — три запроса в окне rate limit
+		env.bot.maxRequests = 2
+		env.api.SendText(testUser, "/compare "+model+",qwen-test,other вопрос")
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 3); err != nil {
+			return err
+		}
+		if err := expectContains(calls[2].String("text"), "Слишком много запросов"); err != nil {
+			return err
+		}
+
+		// Квота должна вместить оценку промпта для каждой модели
+		env.bot.maxRequests = 100
+		env.t.Setenv("QUOTA_DAILY_TOKENS", "40")
+		env.bot.Usage = NewUsageTracker()
+		env.api.SendText(testUser, "/compare "+model+",qwen-test "+strings.Repeat("слово ", 10))
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 4); err != nil {
+			return err
+		}
+		if err := expectContains(calls[3].String("text"), "нужно около"); err != nil {
+			return err
+		}
+		if n := len(env.ollama.Requests()); n != 0 {
+			return fmt.Errorf("отправлено %d запросов к моделям в обход лимитов", n)
+		}
+		return nil
+	}},
+	{"schedule workers", func(ctx context.Context, env *scenarioEnv) error {
+		// Один обработчик выполняет три наступивших запроса по очереди:
+		// runDueSchedules ждёт его, а не запускает горутину на каждый запрос
+		latency := 100 * time.Millisecond
+		env.ollama.SetLatency(latency)
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			_, err := env.bot.Schedules.Add(Schedule{ChatID: testUser.ID, UserID: testUser.ID, Kind: scheduleOnce, Timezone: "UTC", Prompt: fmt.Sprintf("запрос %d", i), NextRun: now})
+			if err != nil {
+				return err
+			}
+		}
+
+		start := time.Now()
+		env.bot.runDueSchedules(ctx, now, env.bot.scheduleWorkers(ctx, 1))
+		if elapsed := time.Since(start); elapsed < 2*latency {
+			return fmt.Errorf("расписания переданы за %v, обработчик не ограничивает параллельность", elapsed)
+		}
+		_, err := env.api.WaitCalls(ctx, "sendMessage", 3)
+		return err
+	}},
+	{"ollama concurrency", func(ctx context.Context, env *scenarioEnv) error {
+		// Пока все места заняты, генерация ждёт и завершается по таймауту контекста
+		env.t.Setenv("OLLAMA_MAX_CONCURRENCY", "1")
+		client, err := NewOllamaClient()
+		if err != nil {
+			return err
+		}
+		client.URL = env.bot.Ollama.URL
+		client.slots <- struct{}{}
+
+		waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if _, err := client.SendPrompt(waitCtx, "привет"); err == nil {
+			return fmt.Errorf("ожидалась ошибка при занятых местах")
+		} else if err := expectContains(err.Error(), "ожидание свободного места"); err != nil {
+			return err
+		}
+
+		<-client.slots
+		answer, err := client.SendPrompt(ctx, "привет")
+		if err != nil {
+			return err
+		}
+		return expectContains(answer, "Эхо: привет")
+	}},
+	{"ollama model", func(ctx context.Context, env *scenarioEnv) error {
+		ok, err := env.bot.Ollama.HasModel(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("модель %s не найдена", env.bot.Ollama.Model)
+		}
+		n, err := env.bot.Ollama.ContextLength(ctx)
+		if err != nil {
+			return err
+		}
+		if n != 2048 {
+			return fmt.Errorf("num_ctx %d, ожидалось 2048", n)
+		}
+		return nil
+	}},
+	{"voice", func(ctx context.Context, env *scenarioEnv) error {
+		env.bot.Transcriber = TranscriberFunc(func(_ context.Context, filename string, audio []byte) (string, error) {
+			if filename != "voice.ogg" || string(audio) != "OggS-запись" {
+				return "", fmt.Errorf("неожиданный файл %s (%d байт)", filename, len(audio))
+			}
+			return "какая погода завтра", nil
+		})
+		if _, err := env.api.SendVoice(testUser, []byte("OggS-запись"), 3); err != nil {
+			return err
+		}
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 3)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[0].String("text"), "какая погода завтра"); err != nil {
+			return err
+		}
+		if err := expectContains(calls[2].String("text"), "Эхо: какая погода завтра"); err != nil {
+			return err
+		}
+
+		// Слишком длинная запись не скачивается
+		if _, err := env.api.SendVoice(testUser, []byte("OggS"), transcribeMaxDuration()+1); err != nil {
+			return err
+		}
+		calls, err = env.api.WaitCalls(ctx, "sendMessage", 4)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[3].String("text"), "слишком длинная"); err != nil {
+			return err
+		}
+
+		// Эхо длинной расшифровки укладывается в одно сообщение Telegram
+		env.bot.Transcriber = TranscriberFunc(func(context.Context, string, []byte) (string, error) {
+			return strings.Repeat("слово ", 1000), nil
+		})
+		if _, err := env.api.SendVoice(testUser, []byte("OggS"), 3); err != nil {
+			return err
+		}
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 5); err != nil {
+			return err
+		}
+		if echo := calls[4].String("text"); !strings.HasPrefix(echo, "🎤") || utf8.RuneCountInString(echo) > 4096 {
+			return fmt.Errorf("эхо расшифровки: %d символов", utf8.RuneCountInString(echo))
+		}
+		return nil
+	}},
+	{"voice limits", func(ctx context.Context, env *scenarioEnv) error {
+		var transcribed int
+		env.bot.Transcriber = TranscriberFunc(func(context.Context, string, []byte) (string, error) {
+			transcribed++
+			return "вопрос", nil
+		})
+
+		// Rate limit срабатывает до скачивания и распознавания
+		env.bot.maxRequests = 0
+		if _, err := env.api.SendVoice(testUser, []byte("OggS"), 3); err != nil {
+			return err
+		}
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 1)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[0].String("text"), "Слишком много запросов"); err != nil {
+			return err
+		}
+
+		// Исчерпанная квота тоже
+		env.bot.maxRequests = 100
+		env.t.Setenv("QUOTA_DAILY_TOKENS", "10")
+		env.bot.Usage = NewUsageTracker()
+		env.bot.Usage.Record(testUser.ID, testUser.ID, &OllamaResponse{PromptEvalCount: 10, EvalCount: 10})
+		if _, err := env.api.SendVoice(testUser, []byte("OggS"), 3); err != nil {
+			return err
+		}
+		if calls, err = env.api.WaitCalls(ctx, "sendMessage", 2); err != nil {
+			return err
+		}
+		if err := expectContains(calls[1].String("text"), "квота"); err != nil {
+			return err
+		}
+		if transcribed != 0 || len(env.api.Calls("getFile")) != 0 {
+			return fmt.Errorf("запись скачана или распознана в обход лимитов: %d распознаваний", transcribed)
+		}
+		return nil
+	}},
+	{"whisper", func(ctx context.Context, env *scenarioEnv) error {
+		// Сервис распознавания проверяет поля multipart-запроса
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			data, _ := io.ReadAll(file)
+			if header.Filename != "note.mp3" || string(data) != "ID3" || r.FormValue("language") != "ru" || r.FormValue("response_format") != "json" {
+				http.Error(w, "неожиданный запрос", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"text": " привет из whisper \n"})
+		}))
+		defer server.Close()
+
+		env.t.Setenv("TRANSCRIBE_URL", server.URL+"/inference")
+		env.t.Setenv("TRANSCRIBE_LANGUAGE", "ru")
+
+		transcriber := NewTranscriber()
+		if transcriber == nil {
+			return fmt.Errorf("распознавание не настроено")
+		}
+		text, err := transcriber.Transcribe(ctx, "note.mp3", []byte("ID3"))
+		if err != nil {
+			return err
+		}
+		if text != "привет из whisper" {
+			return fmt.Errorf("распознано %q", text)
+		}
+		return nil
+	}},
+	{"schedule", func(ctx context.Context, env *scenarioEnv) error {
+		env.api.SendText(testUser, "/timezone Europe/Moscow")
+		env.api.SendText(testUser, "/schedule daily 09:00 утренняя сводка")
+		env.api.SendText(testUser, "/schedules")
+		calls, err := env.api.WaitCalls(ctx, "sendMessage", 3)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[1].String("text"), "#1 каждый день в 09:00"); err != nil {
+			return err
+		}
+		if err := expectContains(calls[2].String("text"), "(Europe/Moscow): утренняя сводка"); err != nil {
+			return err
+		}
+
+		list := env.bot.Schedules.List(testUser.ID)
+		if len(list) != 1 {
+			return fmt.Errorf("расписаний %d, ожидалось 1", len(list))
+		}
+		due := list[0].NextRun
+		if local := due.In(list[0].location()); local.Hour() != 9 || local.Minute() != 0 {
+			return fmt.Errorf("следующий запуск %v, ожидалось 09:00 по Москве", local)
+		}
+
+		// Наступившее расписание выполняется и переносится на сутки вперёд
+		env.bot.runDueSchedules(ctx, due, env.bot.scheduleWorkers(ctx, 1))
+		calls, err = env.api.WaitCalls(ctx, "sendMessage", 4)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[3].String("text"), "⏰ Запланированный запрос #1: утренняя сводка\n\nЭхо: утренняя сводка"); err != nil {
+			return err
+		}
+		// Расписание сохранено в файле и переживает перезапуск
+		reloaded := NewScheduleStore().List(testUser.ID)
+		if len(reloaded) != 1 || !reloaded[0].NextRun.Equal(due.Add(24*time.Hour)) {
+			return fmt.Errorf("после запуска расписания %+v, ожидался перенос на %v", reloaded, due.Add(24*time.Hour))
+		}
+
+		env.api.SendText(testUser, "/schedules delete 1")
+		calls, err = env.api.WaitCalls(ctx, "sendMessage", 5)
+		if err != nil {
+			return err
+		}
+		if err := expectContains(calls[4].String("text"), "#1 удалено"); err != nil {
+			return err
+		}
+		if n := len(env.bot.Schedules.List(testUser.ID)); n != 0 {
+			return fmt.Errorf("после удаления осталось %d расписаний", n)
+		}
+
+		// Сброс пояса не зависит от регистра, как и у /lang auto
+		env.api.SendText(testUser, "/timezone Auto")
+		if _, err := env.api.WaitCalls(ctx, "sendMessage", 6); err != nil {
+			return err
+		}
+		if tz := env.bot.Prefs.Get(testUser.ID).Timezone; tz != "" {
+			return fmt.Errorf("после /timezone Auto сохранён пояс %q", tz)
+		}
+		return nil
+	}},
+}
+
+// expectDownload добавляет файл на поддельный сервер и проверяет, что бот
+// получает его через getFile и скачивает без изменений
+func expectDownload(ctx context.Context, env *scenarioEnv, fileID string) error {
+	want := []byte("OggS fake voice")
+	if err := os.MkdirAll(filepath.Join(env.dir, filepath.Dir(fileID)), 0o755); err != nil {
+		return err
+	}
+	if err := env.api.AddFile(fileID, want); err != nil {
+		return err
+	}
+	file, err := env.bot.GetFile(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	data, err := env.bot.DownloadFile(ctx, file)
+	if err != nil {
+		return err
+	}
+	if string(data) != string(want) {
+		return fmt.Errorf("скачано %q, ожидалось %q", data, want)
+	}
+	return nil
+}
+
+// writeClientCert создаёт самоподписанный клиентский сертификат
+// и записывает его и ключ в dir как client.pem и client-key.pem
+func writeClientCert(dir string) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "local-llm test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, "client.pem"), certPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client-key.pem"), keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// expectContains проверяет, что текст содержит подстроку
+func expectContains(text, substr string) error {
+	if !strings.Contains(text, substr) {
+		return fmt.Errorf("ожидалось %q в %q", substr, text)
+	}
+	return nil
+}
+
+// TestScenarios прогоняет сквозные сценарии против поддельного Bot API без сети
+func TestScenarios(t *testing.T) {
+	for _, sc := range scenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			runScenario(t, sc)
+		})
+	}
+}
+
+// runScenario запускает сценарий в отдельном окружении: свой поддельный сервер,
+// свои файлы статистики и настроек и свой цикл опроса
+func runScenario(t *testing.T, sc scenario) {
+	api := NewFakeBotAPI("selftest:token")
+	defer api.Close()
+	dir := t.TempDir()
+
+	// Бот читает настройки из окружения, поэтому сценарий задаёт их перед созданием
+	t.Setenv("TELEGRAM_API_URL", api.URL())
+	t.Setenv("USAGE_FILE", filepath.Join(dir, "usage.json"))
+	t.Setenv("PREFS_FILE", filepath.Join(dir, "prefs.json"))
+	t.Setenv("SCHEDULES_FILE", filepath.Join(dir, "schedules.json"))
+	t.Setenv("TEMPLATES_FILE", filepath.Join(dir, "templates.json"))
+	t.Setenv("COMPARE_VOTES_FILE", filepath.Join(dir, "votes.json"))
+	t.Setenv("ALLOWED_USER_IDS", "")
+
+	bot, err := NewTelegramBot(api.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Статистика записывается с задержкой: сохраняем её до удаления каталога
+	defer func() { bot.Usage.Flush() }()
+
+	ollama := NewFakeOllama(bot.Ollama.Model)
+	ollamaServer := httptest.NewServer(ollama)
+	defer ollamaServer.Close()
+	bot.Ollama.URL = ollamaServer.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), scenarioTimeout)
+	defer cancel()
+
+	health := NewHealth()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runPolling(ctx, bot, health)
+	}()
+
+	err = sc.run(ctx, &scenarioEnv{t: t, api: api, ollama: ollama, bot: bot, health: health, dir: dir})
+	if err == nil {
+		err = api.WaitIdle(ctx)
+	}
+	cancel()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// editMessageTextRequest параметры метода editMessageText
+type editMessageTextRequest struct {
+	ChatID          int64                 `json:"chat_id,omitempty"`
+	MessageID       int64                 `json:"message_id,omitempty"`
+	InlineMessageID string                `json:"inline_message_id,omitempty"`
+	Text            string                `json:"text"`
+	ReplyMarkup     *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// EditMessageText заменяет текст ранее отправленного сообщения
+func (bot *TelegramBot) EditMessageText(ctx context.Context, chatID, messageID int64, text string, markup *InlineKeyboardMarkup) error {
+	err := bot.callAPI(ctx, "editMessageText", editMessageTextRequest{
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Text:        text,
+		ReplyMarkup: markup,
+	}, nil)
+	// Telegram считает ошибкой правку без изменений — для нас это не ошибка
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+// DeleteMessage удаляет сообщение из чата
+func (bot *TelegramBot) DeleteMessage(ctx context.Context, chatID, messageID int64) error {
+	return bot.callAPI(ctx, "deleteMessage", map[string]int64{
+		"chat_id":    chatID,
+		"message_id": messageID,
+	}, nil)
+}
+
+// SendChatAction показывает в чате статус вроде «печатает...»
+func (bot *TelegramBot) SendChatAction(ctx context.Context, chatID int64, action string) error {
+	return bot.callAPI(ctx, "sendChatAction", map[string]any{
+		"chat_id": chatID,
+		"action":  action,
+	}, nil)
+}
+
+// HandleEditedMessage обрабатывает исправление промпта, на который бот уже ответил:
+// ответ генерируется заново и заменяет прежний на месте
+func (bot *TelegramBot) HandleEditedMessage(ctx context.Context, message *Message) {
+	if message == nil || message.Chat == nil {
+		return
+	}
+	ctx = withLanguage(ctx, bot.languageFor(message.From))
+
+	if !bot.isUserAllowed(message) {
+		metricUnauthorized.Inc()
+		slog.WarnContext(ctx, "Отклонена правка от неавторизованного пользователя", "chat_id", message.Chat.ID)
+		return
+	}
+
+	chatID := message.Chat.ID
+	userID := senderID(message)
+	text := message.Text
+
+	// Правки команд и сообщений без текста не обрабатываем
+	if text == "" || text[0] == '/' {
+		return
+	}
+
+	turn, answerIDs, ok := bot.History.TurnForPrompt(chatID, message.MessageID)
+	if !ok {
+		slog.DebugContext(ctx, "Правка сообщения без ответа бота в истории", "chat_id", chatID, "message_id", message.MessageID)
+		return
+	}
+
+	metricMessagesHandled.Inc("edit")
+	slog.InfoContext(ctx, "Получена правка промпта", "chat_id", chatID, "user_id", userID, "message_id", message.MessageID, "turn", turn)
+
+	if !bot.checkRateLimit(chatID) {
+		metricRateLimited.Inc()
+		bot.SendMessage(ctx, chatID, tr(ctx, "rate_limited"))
+		return
+	}
+
+	if len(text) > bot.maxPromptLen {
+		bot.SendMessage(ctx, chatID, tr(ctx, "prompt_too_long", bot.maxPromptLen))
+		return
+	}
+
+	prompt, messages, ok := bot.buildEditPrompt(ctx, chatID, turn, text, message.ReplyToMessage)
+	if !ok {
+		return
+	}
+
+	if !bot.checkQuota(ctx, chatID, userID) {
+		return
+	}
+
+	// Вместо нового сообщения «Обрабатываю запрос...» показываем статус «печатает»
+	if err := bot.SendChatAction(ctx, chatID, "typing"); err != nil {
+		slog.DebugContext(ctx, "Ошибка отправки статуса", "chat_id", chatID, "error", err)
+	}
+
+	result := bot.complete(ctx, chatID, userID, messages, nil)
+	if result == nil {
+		return
+	}
+
+	bot.History.ReplaceTurn(chatID, turn, prompt, result.Response)
+	sent := bot.editAnswer(ctx, chatID, answerIDs, result.Response, answerKeyboard(languageFrom(ctx), turn, result.DoneReason == "length"))
+	bot.History.LinkAnswer(chatID, turn, sent)
+}
+
+// editAnswer заменяет ранее отправленный ответ новым текстом: существующие
+// сообщения редактируются, недостающие части отправляются, лишние удаляются.
+// Возвращает ID сообщений с новым ответом.
+func (bot *TelegramBot) editAnswer(ctx context.Context, chatID int64, messageIDs []int64, text string, markup *InlineKeyboardMarkup) []int64 {
+	parts := SplitMessage(text, 4000)
+
+	var sent []int64
+	for i, part := range parts {
+		if i == 0 && len(parts) > 1 {
+			part = part + "\n\n" + tr(ctx, "to_be_continued")
+		}
+		var partMarkup *InlineKeyboardMarkup
+		if i == len(parts)-1 {
+			partMarkup = markup
+		}
+
+		if i < len(messageIDs) {
+			if err := bot.EditMessageText(ctx, chatID, messageIDs[i], part, partMarkup); err != nil {
+				slog.ErrorContext(ctx, "Ошибка редактирования части ответа", "chat_id", chatID, "part", i, "error", err)
+			}
+			sent = append(sent, messageIDs[i])
+			continue
+		}
+
+		msg, err := bot.sendMessage(ctx, SendMessageRequest{ChatID: chatID, Text: part, ReplyMarkup: partMarkup})
+		if err != nil {
+			slog.ErrorContext(ctx, "Ошибка отправки части сообщения", "chat_id", chatID, "part", i, "error", err)
+			continue
+		}
+		sent = append(sent, msg.MessageID)
+	}
+
+	for _, id := range messageIDs[min(len(parts), len(messageIDs)):] {
+		if err := bot.DeleteMessage(ctx, chatID, id); err != nil {
+			slog.ErrorContext(ctx, "Ошибка удаления лишней части ответа", "chat_id", chatID, "message_id", id, "error", err)
+		}
+	}
+
+	return sent
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeBotAPI поддельный сервер Telegram Bot API для сквозных проверок без сети.
+// Отдаёт заранее заданные обновления через getUpdates, записывает все
+// исходящие вызовы бота и раздаёт добавленные файлы для getFile.
+type FakeBotAPI struct {
+	Token string
+	// LocalDir включает локальный режим собственного сервера: файлы сохраняются
+	// в этот каталог, а getFile возвращает абсолютный путь к ним
+	LocalDir string
+
+	server        *httptest.Server
+	mu            sync.Mutex
+	updates       []Update
+	nextUpdateID  int64
+	nextMessageID int64
+	calls         []FakeCall
+	files         map[string][]byte
+	// polling число запросов getUpdates, ожидающих новых обновлений
+	polling int
+	// changed закрывается и заменяется при каждом новом обновлении или вызове
+	changed chan struct{}
+}
+
+// FakeCall исходящий вызов метода Bot API
+type FakeCall struct {
+	Method string
+	Params map[string]any
+	// Files содержимое файлов multipart-запроса по имени поля
+	Files map[string][]byte
+}
+
+// String возвращает параметр вызова как строку
+func (c FakeCall) String(key string) string {
+	switch v := c.Params[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// Int возвращает числовой параметр вызова
+func (c FakeCall) Int(key string) int64 {
+	switch v := c.Params[key].(type) {
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// NewFakeBotAPI запускает поддельный сервер Bot API на локальном порту
+func NewFakeBotAPI(token string) *FakeBotAPI {
+	f := &FakeBotAPI{
+		Token:   token,
+		files:   make(map[string][]byte),
+		changed: make(chan struct{}),
+	}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+// URL возвращает базовый адрес сервера для TELEGRAM_API_URL
+func (f *FakeBotAPI) URL() string {
+	return f.server.URL
+}
+
+// Close останавливает сервер
+func (f *FakeBotAPI) Close() {
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+// notify будит ожидающих getUpdates и WaitCalls. Вызывается под f.mu.
+func (f *FakeBotAPI) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Push добавляет обновление в очередь getUpdates, назначая ему update_id
+func (f *FakeBotAPI) Push(update Update) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextUpdateID++
+	update.UpdateID = f.nextUpdateID
+	f.updates = append(f.updates, update)
+	f.notify()
+	return update.UpdateID
+}
+
+// newMessageID выдаёт следующий message_id. Вызывается под f.mu.
+func (f *FakeBotAPI) newMessageID() int64 {
+	f.nextMessageID++
+	return f.nextMessageID
+}
+
+// SendText добавляет обновление с текстовым сообщением пользователя в личном чате
+func (f *FakeBotAPI) SendText(from *User, text string) *Message {
+	f.mu.Lock()
+	message := &Message{
+		MessageID: f.newMessageID(),
+		From:      from,
+		Chat:      &Chat{ID: from.ID, Type: "private", FirstName: from.FirstName},
+		Text:      text,
+		Date:      time.Now().Unix(),
+	}
+	f.mu.Unlock()
+	f.Push(Update{Message: message})
+	return message
+}
+
+// ReplyText добавляет обновление с текстовым сообщением от пользователя from
+// в ответ на сообщение reply
+func (f *FakeBotAPI) ReplyText(from *User, reply *Message, text string) *Message {
+	f.mu.Lock()
+	message := &Message{
+		MessageID:      f.newMessageID(),
+		From:           from,
+		Chat:           &Chat{ID: from.ID, Type: "private", FirstName: from.FirstName},
+		Text:           text,
+		Date:           time.Now().Unix(),
+		ReplyToMessage: reply,
+	}
+	f.mu.Unlock()
+	f.Push(Update{Message: message})
+	return message
+}
+
+// UploadDocument делает данные доступными через getFile и добавляет обновление
+// с сообщением-документом name от пользователя from
+func (f *FakeBotAPI) UploadDocument(from *User, name string, data []byte) (*Message, error) {
+	f.mu.Lock()
+	message := &Message{
+		MessageID: f.newMessageID(),
+		From:      from,
+		Chat:      &Chat{ID: from.ID, Type: "private", FirstName: from.FirstName},
+		Date:      time.Now().Unix(),
+	}
+	fileID := fmt.Sprintf("document_%d", message.MessageID)
+	f.mu.Unlock()
+
+	if err := f.AddFile(fileID, data); err != nil {
+		return nil, err
+	}
+	message.Document = &Document{
+		FileID:       fileID,
+		FileUniqueID: fileID,
+		FileName:     name,
+		MimeType:     "text/plain",
+		FileSize:     int64(len(data)),
+	}
+	f.Push(Update{Message: message})
+	return message, nil
+}
+
+// SendVoice делает запись доступной через getFile и добавляет обновление
+// с голосовым сообщением длительностью duration секунд от пользователя from
+func (f *FakeBotAPI) SendVoice(from *User, data []byte, duration int) (*Message, error) {
+	f.mu.Lock()
+	message := &Message{
+		MessageID: f.newMessageID(),
+		From:      from,
+		Chat:      &Chat{ID: from.ID, Type: "private", FirstName: from.FirstName},
+		Date:      time.Now().Unix(),
+	}
+	fileID := fmt.Sprintf("voice_%d", message.MessageID)
+	f.mu.Unlock()
+
+	if err := f.AddFile(fileID, data); err != nil {
+		return nil, err
+	}
+	message.Voice = &Voice{
+		FileID:       fileID,
+		FileUniqueID: fileID,
+		Duration:     duration,
+		MimeType:     "audio/ogg",
+		FileSize:     int64(len(data)),
+	}
+	f.Push(Update{Message: message})
+	return message, nil
+}
+
+// PressButton добавляет обновление с нажатием пользователем from inline-кнопки
+// с callback_data data под сообщением бота messageID
+func (f *FakeBotAPI) PressButton(from *User, messageID int64, data string) {
+	f.mu.Lock()
+	id := f.newMessageID()
+	f.mu.Unlock()
+	f.Push(Update{CallbackQuery: &CallbackQuery{
+		ID:      strconv.FormatInt(id, 10),
+		From:    from,
+		Message: &Message{MessageID: messageID, Chat: &Chat{ID: from.ID, Type: "private"}},
+		Data:    data,
+	}})
+}
+
+// EditText добавляет обновление с исправленным текстом ранее отправленного сообщения
+func (f *FakeBotAPI) EditText(message *Message, text string) {
+	edited := *message
+	edited.Text = text
+	f.Push(Update{EditedMessage: &edited})
+}
+
+// AddFile делает файл доступным через getFile и ссылку на скачивание
+// (в локальном режиме — через файл в LocalDir)
+func (f *FakeBotAPI) AddFile(fileID string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[fileID] = data
+	if f.LocalDir != "" {
+		return os.WriteFile(filepath.Join(f.LocalDir, fileID), data, 0o644)
+	}
+	return nil
+}
+
+// Calls возвращает записанные вызовы метода; пустой method — все вызовы
+func (f *FakeBotAPI) Calls(method string) []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.callsLocked(method)
+}
+
+func (f *FakeBotAPI) callsLocked(method string) []FakeCall {
+	var calls []FakeCall
+	for _, c := range f.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// WaitCalls ждёт, пока бот вызовет метод не менее n раз, и возвращает эти вызовы
+func (f *FakeBotAPI) WaitCalls(ctx context.Context, method string, n int) ([]FakeCall, error) {
+	for {
+		f.mu.Lock()
+		calls := f.callsLocked(method)
+		changed := f.changed
+		f.mu.Unlock()
+
+		if len(calls) >= n {
+			return calls, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return calls, fmt.Errorf("ожидалось %d вызов(ов) %s, получено %d", n, method, len(calls))
+		}
+	}
+}
+
+func (f *FakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Скачивание файла: /file/bot<token>/<file_path>
+	if filePath, ok := strings.CutPrefix(r.URL.Path, "/file/bot"+f.Token+"/"); ok {
+		f.mu.Lock()
+		data, found := f.files[filePath]
+		f.mu.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	method, ok := strings.CutPrefix(r.URL.Path, "/bot"+f.Token+"/")
+	if !ok {
+		writeFakeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	call, err := parseFakeCall(method, r)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+
+	if method == "getUpdates" {
+		f.getUpdates(w, r, call)
+		return
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.notify()
+
+	var result any = true
+	switch method {
+	case "getMe":
+		result = User{ID: 1, IsBot: true, FirstName: "Fake", Username: "fake_bot"}
+	case "sendMessage", "sendDocument":
+		result = Message{
+			MessageID: f.newMessageID(),
+			Chat:      &Chat{ID: call.Int("chat_id"), Type: "private"},
+			Text:      call.String("text"),
+			Date:      time.Now().Unix(),
+		}
+	case "getFile":
+		fileID := call.String("file_id")
+		data, found := f.files[fileID]
+		if !found {
+			f.mu.Unlock()
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: invalid file_id")
+			return
+		}
+		file := File{FileID: fileID, FileUniqueID: fileID, FileSize: int64(len(data)), FilePath: fileID}
+		if f.LocalDir != "" {
+			file.FilePath = filepath.Join(f.LocalDir, fileID)
+		}
+		result = file
+	}
+	f.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+// getUpdates отдаёт обновления начиная с offset; если их нет, ждёт до timeout секунд
+func (f *FakeBotAPI) getUpdates(w http.ResponseWriter, r *http.Request, call FakeCall) {
+	offset := call.Int("offset")
+	timeout := time.Duration(call.Int("timeout")) * time.Second
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		f.mu.Lock()
+		// Обновления до offset считаются подтверждёнными и удаляются
+		var pending []Update
+		for _, u := range f.updates {
+			if u.UpdateID >= offset {
+				pending = append(pending, u)
+			}
+		}
+		f.updates = pending
+		if len(pending) > 0 {
+			f.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": pending})
+			return
+		}
+		f.polling++
+		f.notify()
+		changed := f.changed
+		f.mu.Unlock()
+
+		var expired bool
+		select {
+		case <-changed:
+		case <-deadline.C:
+			expired = true
+		case <-r.Context().Done():
+			expired = true
+		}
+
+		f.mu.Lock()
+		f.polling--
+		f.mu.Unlock()
+
+		if expired {
+			if r.Context().Err() == nil {
+				json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": []Update{}})
+			}
+			return
+		}
+	}
+}
+
+// WaitIdle ждёт, пока бот обработает все обновления и снова начнёт ждать новых
+// в getUpdates. Обновления обрабатываются до следующего запроса getUpdates,
+// поэтому после WaitIdle все ответы бота уже записаны.
+func (f *FakeBotAPI) WaitIdle(ctx context.Context) error {
+	for {
+		f.mu.Lock()
+		idle := f.polling > 0 && len(f.updates) == 0
+		changed := f.changed
+		f.mu.Unlock()
+
+		if idle {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("бот не вернулся к опросу обновлений: %w", ctx.Err())
+		}
+	}
+}
+
+// parseFakeCall собирает параметры вызова из строки запроса, JSON или multipart-тела
+func parseFakeCall(method string, r *http.Request) (FakeCall, error) {
+	call := FakeCall{Method: method, Params: map[string]any{}}
+	for key, values := range r.URL.Query() {
+		call.Params[key] = values[0]
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&call.Params); err != nil {
+			return call, err
+		}
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxResponseSize); err != nil {
+			return call, err
+		}
+		for key, values := range r.MultipartForm.Value {
+			call.Params[key] = values[0]
+		}
+		call.Files = map[string][]byte{}
+		for key, headers := range r.MultipartForm.File {
+			file, err := headers[0].Open()
+			if err != nil {
+				return call, err
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return call, err
+			}
+			call.Params[key] = headers[0].Filename
+			call.Files[key] = data
+		}
+	}
+	return call, nil
+}
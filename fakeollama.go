@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeFailure ошибка, которую FakeOllama возвращает вместо ответа модели
+type FakeFailure int
+
+const (
+	// FailNone — обычный ответ
+	FailNone FakeFailure = iota
+	// FailStatus — статус 500 с текстом ошибки
+	FailStatus
+	// FailErrorField — статус 200 с заполненным полем error
+	FailErrorField
+	// FailNotDone — ответ с done=false
+	FailNotDone
+	// FailOversized — тело ответа больше maxResponseSize
+	FailOversized
+)
+
+// FakeOllama поддельный сервер Ollama API для детерминированных проверок
+// и работы без модели. По умолчанию отвечает эхом последнего сообщения
+// пользователя; задержку и ошибки можно включить на время проверки.
+type FakeOllama struct {
+	Model string
+	// Models дополнительные установленные модели; запрос к любой другой
+	// модели завершается ошибкой 404, как в Ollama
+	Models []string
+	// Reply формирует ответ модели по промпту; nil — эхо
+	Reply func(prompt string) string
+	// ToolCall возвращает вызов инструмента, который модель запросит в ответ
+	// на сообщения запроса с инструментами; nil — ответ без вызова
+	ToolCall func(messages []ChatMessage) *ToolCall
+
+	mu      sync.Mutex
+	latency time.Duration
+	failure FakeFailure
+	paths   []string
+}
+
+// NewFakeOllama создаёт поддельный сервер с моделью model
+func NewFakeOllama(model string) *FakeOllama {
+	return &FakeOllama{Model: model}
+}
+
+// SetLatency задаёт задержку перед каждым ответом генерации
+func (f *FakeOllama) SetLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+// SetFailure включает ошибку для последующих запросов генерации
+func (f *FakeOllama) SetFailure(failure FakeFailure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failure = failure
+}
+
+// Requests возвращает пути всех полученных запросов
+func (f *FakeOllama) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.paths...)
+}
+
+func (f *FakeOllama) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.paths = append(f.paths, r.URL.Path)
+	latency, failure := f.latency, f.failure
+	f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/api/tags":
+		models := []map[string]string{{"name": f.Model, "model": f.Model}}
+		for _, name := range f.Models {
+			models = append(models, map[string]string{"name": name, "model": name})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"models": models})
+		return
+	case "/api/show":
+		json.NewEncoder(w).Encode(OllamaShowResponse{Parameters: "num_ctx 2048"})
+		return
+	case "/api/chat", "/api/generate":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		Model    string          `json:"model"`
+		Prompt   string          `json:"prompt"`
+		Messages []ChatMessage   `json:"messages"`
+		Stream   *bool           `json:"stream"`
+		Tools    []ToolSpec      `json:"tools"`
+		Format   json.RawMessage `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	model := f.Model
+	if req.Model != "" && req.Model != f.Model {
+		if !slices.Contains(f.Models, req.Model) {
+			data, _ := json.Marshal(map[string]string{"error": fmt.Sprintf("model %q not found, try pulling it first", req.Model)})
+			http.Error(w, string(data), http.StatusNotFound)
+			return
+		}
+		model = req.Model
+	}
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch failure {
+	case FailStatus:
+		http.Error(w, `{"error":"model runner has unexpectedly stopped"}`, http.StatusInternalServerError)
+		return
+	case FailErrorField:
+		json.NewEncoder(w).Encode(OllamaResponse{Model: model, Error: "model not loaded", Done: true})
+		return
+	case FailNotDone:
+		json.NewEncoder(w).Encode(OllamaResponse{Model: model, Response: "…", Done: false})
+		return
+	case FailOversized:
+		w.Write([]byte(`{"model":"` + model + `","response":"`))
+		w.Write([]byte(strings.Repeat("a", maxResponseSize)))
+		w.Write([]byte(`","done":true}`))
+		return
+	}
+
+	prompt, tokens := req.Prompt, estimateTokens(req.Prompt)
+	if r.URL.Path == "/api/chat" {
+		for _, msg := range req.Messages {
+			if msg.Role == "user" {
+				prompt = msg.Content
+			}
+		}
+		tokens = messagesTokens(req.Messages)
+
+		if len(req.Tools) > 0 && f.ToolCall != nil {
+			if call := f.ToolCall(req.Messages); call != nil {
+				json.NewEncoder(w).Encode(OllamaResponse{
+					Model:           model,
+					Message:         &ChatMessage{Role: "assistant", ToolCalls: []ToolCall{*call}},
+					Done:            true,
+					DoneReason:      "stop",
+					PromptEvalCount: tokens,
+					EvalCount:       1,
+				})
+				return
+			}
+		}
+	}
+	answer := "Эхо: " + prompt
+	if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == "tool" {
+		// Ответ по результату последнего вызова инструмента
+		answer = "Результат: " + req.Messages[n-1].Content
+	}
+	if len(req.Format) > 0 {
+		// В режиме JSON эхо тоже возвращается в формате JSON
+		data, _ := json.Marshal(map[string]string{"echo": prompt})
+		answer = string(data)
+	}
+	if f.Reply != nil {
+		answer = f.Reply(prompt)
+	}
+
+	final := OllamaResponse{
+		Model:           model,
+		CreatedAt:       time.Now().UTC().Format(time.RFC3339Nano),
+		Done:            true,
+		DoneReason:      "stop",
+		PromptEvalCount: tokens,
+		EvalCount:       estimateTokens(answer),
+		TotalDuration:   int64(latency),
+		EvalDuration:    int64(latency),
+	}
+
+	// Ollama по умолчанию отвечает потоком NDJSON; бот всегда передаёт stream=false
+	if req.Stream == nil || *req.Stream {
+		f.stream(w, r.URL.Path, answer, final)
+		return
+	}
+	f.setAnswer(&final, r.URL.Path, answer)
+	json.NewEncoder(w).Encode(final)
+}
+
+// NewFakeToolCall создаёт вызов инструмента name с аргументами args в формате JSON
+func NewFakeToolCall(name, args string) *ToolCall {
+	call := &ToolCall{}
+	call.Function.Name = name
+	call.Function.Arguments = json.RawMessage(args)
+	return call
+}
+
+// setAnswer записывает текст ответа в поле, соответствующее эндпоинту
+func (f *FakeOllama) setAnswer(resp *OllamaResponse, path, text string) {
+	if path == "/api/chat" {
+		resp.Message = &ChatMessage{Role: "assistant", Content: text}
+	} else {
+		resp.Response = text
+	}
+}
+
+// stream отдаёт ответ построчно в формате NDJSON: по слову в строке,
+// последняя строка с done=true и статистикой
+func (f *FakeOllama) stream(w http.ResponseWriter, path, answer string, final OllamaResponse) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	for i, word := range strings.Fields(answer) {
+		if i > 0 {
+			word = " " + word
+		}
+		chunk := OllamaResponse{Model: final.Model, CreatedAt: final.CreatedAt}
+		f.setAnswer(&chunk, path, word)
+		enc.Encode(chunk)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	f.setAnswer(&final, path, "")
+	enc.Encode(final)
+}
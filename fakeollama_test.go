@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestOllama запускает поддельную Ollama и возвращает её и клиент к ней
+func newTestOllama(t *testing.T) (*FakeOllama, *httptest.Server, *OllamaClient) {
+	t.Helper()
+	fake := NewFakeOllama("test-model")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("OLLAMA_URL", server.URL)
+	t.Setenv("OLLAMA_MODEL", fake.Model)
+	client, err := NewOllamaClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, server, client
+}
+
+// postJSON отправляет тело body на path поддельной Ollama
+func postJSON(t *testing.T, server *httptest.Server, path, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestFakeOllamaAnswers(t *testing.T) {
+	_, _, client := newTestOllama(t)
+	ctx := context.Background()
+
+	answer, err := client.SendPrompt(ctx, "привет")
+	if err != nil || answer != "Эхо: привет" {
+		t.Fatalf("generate: %q, %v", answer, err)
+	}
+	resp, err := client.Chat(ctx, []ChatMessage{{Role: "user", Content: "как дела?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response != "Эхо: как дела?" || resp.Model != "test-model" || resp.EvalCount == 0 {
+		t.Fatalf("chat: %+v", resp)
+	}
+}
+
+func TestFakeOllamaStream(t *testing.T) {
+	_, server, _ := newTestOllama(t)
+
+	for path, body := range map[string]string{
+		// Без поля stream Ollama отвечает потоком, как настоящий сервер
+		"/api/generate": `{"model":"test-model","prompt":"раз два три"}`,
+		"/api/chat":     `{"model":"test-model","messages":[{"role":"user","content":"раз два три"}],"stream":true}`,
+	} {
+		t.Run(path, func(t *testing.T) {
+			resp := postJSON(t, server, path, body)
+			if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+				t.Fatalf("Content-Type %q", ct)
+			}
+
+			var text strings.Builder
+			var chunks []OllamaResponse
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				var chunk OllamaResponse
+				if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+					t.Fatalf("строка %q: %v", scanner.Text(), err)
+				}
+				chunks = append(chunks, chunk)
+				text.WriteString(chunk.Response)
+				if chunk.Message != nil {
+					text.WriteString(chunk.Message.Content)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(chunks) < 2 {
+				t.Fatalf("получено %d строк, ожидался поток", len(chunks))
+			}
+			for _, chunk := range chunks[:len(chunks)-1] {
+				if chunk.Done {
+					t.Fatalf("done=true до последней строки: %+v", chunk)
+				}
+			}
+			final := chunks[len(chunks)-1]
+			if !final.Done || final.DoneReason != "stop" || final.EvalCount == 0 {
+				t.Fatalf("последняя строка: %+v", final)
+			}
+			if text.String() != "Эхо: раз два три" {
+				t.Fatalf("собранный ответ %q", text.String())
+			}
+		})
+	}
+}
+
+func TestFakeOllamaFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		failure FakeFailure
+		want    string
+	}{
+		{"status", FailStatus, "статус 500"},
+		{"error field", FailErrorField, "model not loaded"},
+		{"not done", FailNotDone, "не завершен"},
+		{"oversized", FailOversized, "ошибка парсинга JSON"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, _, client := newTestOllama(t)
+			fake.SetFailure(tc.failure)
+			ctx := context.Background()
+
+			if _, err := client.SendPrompt(ctx, "привет"); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("generate: %v, ожидалось %q", err, tc.want)
+			}
+			if _, err := client.Chat(ctx, []ChatMessage{{Role: "user", Content: "привет"}}); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("chat: %v, ожидалось %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestFakeOllamaLatency(t *testing.T) {
+	fake, _, client := newTestOllama(t)
+	fake.SetLatency(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := client.SendPrompt(ctx, "привет")
+	if err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Fatalf("ожидалась ошибка по таймауту, получено %v", err)
+	}
+}
+
+func TestFakeOllamaUnknownModel(t *testing.T) {
+	fake, server, client := newTestOllama(t)
+	fake.Models = []string{"other-model"}
+	ctx := context.Background()
+
+	resp := postJSON(t, server, "/api/chat", `{"model":"missing","messages":[{"role":"user","content":"привет"}],"stream":false}`)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNotFound || !bytes.Contains(body, []byte(`model \"missing\" not found`)) {
+		t.Fatalf("неизвестная модель: %d %s", resp.StatusCode, body)
+	}
+	if _, err := client.ChatModel(ctx, "missing", []ChatMessage{{Role: "user", Content: "привет"}}, nil); err == nil || !strings.Contains(err.Error(), "статус 404") {
+		t.Fatalf("ChatModel: %v", err)
+	}
+
+	// Дополнительная модель отвечает от своего имени и есть в /api/tags
+	answer, err := client.ChatModel(ctx, "other-model", []ChatMessage{{Role: "user", Content: "привет"}}, nil)
+	if err != nil || answer.Model != "other-model" {
+		t.Fatalf("ChatModel: %+v, %v", answer, err)
+	}
+	tags, err := http.Get(server.URL + "/api/tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tags.Body.Close()
+	list, _ := io.ReadAll(tags.Body)
+	if !bytes.Contains(list, []byte(`"other-model"`)) {
+		t.Fatalf("/api/tags: %s", list)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// GetFile получает сведения о файле по file_id для последующего скачивания
+func (bot *TelegramBot) GetFile(ctx context.Context, fileID string) (*File, error) {
+	var file File
+	if err := bot.callAPI(ctx, "getFile", map[string]string{"file_id": fileID}, &file); err != nil {
+		return nil, err
+	}
+	if file.FilePath == "" {
+		return nil, fmt.Errorf("Telegram API не вернул путь к файлу %s", fileID)
+	}
+	return &file, nil
+}
+
+// DownloadFile возвращает содержимое файла, полученного через GetFile.
+// В локальном режиме собственного сервера Bot API файл читается с диска
+// по абсолютному пути, иначе скачивается по адресу FileURL.
+func (bot *TelegramBot) DownloadFile(ctx context.Context, file *File) ([]byte, error) {
+	if file.FileSize > bot.maxFileSize {
+		return nil, fmt.Errorf("файл больше %d байт", bot.maxFileSize)
+	}
+
+	if bot.LocalMode && filepath.IsAbs(file.FilePath) {
+		f, err := os.Open(file.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка открытия файла: %w", err)
+		}
+		defer f.Close()
+		return readLimited(f, bot.maxFileSize)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bot.FileURL+"/"+file.FilePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания HTTP запроса: %w", bot.sanitizeError(err))
+	}
+
+	resp, err := bot.Client.Do(req)
+	if err != nil {
+		metricTelegramErrors.Inc("file", "network")
+		return nil, fmt.Errorf("ошибка скачивания файла: %w", bot.sanitizeError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		metricTelegramErrors.Inc("file", strconv.Itoa(resp.StatusCode))
+		return nil, fmt.Errorf("Telegram API вернул статус %d при скачивании файла", resp.StatusCode)
+	}
+	return readLimited(resp.Body, bot.maxFileSize)
+}
+
+// readLimited читает не больше limit байт и возвращает ошибку, если данных больше
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("файл больше %d байт", limit)
+	}
+	return data, nil
+}
+
+// LogOut выходит из сервера Bot API. Вызывается на облачном сервере перед
+// переходом на собственный: после этого облачный сервер 10 минут не принимает бота.
+func (bot *TelegramBot) LogOut(ctx context.Context) error {
+	return bot.callAPI(ctx, "logOut", struct{}{}, nil)
+}
+
+// Close закрывает экземпляр бота на собственном сервере Bot API перед переносом
+// на другой сервер. Сервер отклоняет вызов в первые 10 минут после запуска бота.
+func (bot *TelegramBot) Close(ctx context.Context) error {
+	return bot.callAPI(ctx, "close", struct{}{}, nil)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Health отслеживает heartbeat цикла опроса и отдаёт /healthz и /readyz
+type Health struct {
+	lastHeartbeat atomic.Int64
+	// handlingSince момент начала обработки текущего обновления; 0 — цикл не занят
+	handlingSince atomic.Int64
+	maxAge        time.Duration
+	maxHandling   time.Duration
+}
+
+// NewHealth создаёт монитор здоровья. Допустимый возраст heartbeat задаётся
+// переменной окружения HEALTH_MAX_HEARTBEAT_AGE (по умолчанию 2m), допустимая
+// длительность обработки одного обновления — HEALTH_MAX_HANDLER_DURATION (по умолчанию 30m).
+func NewHealth() *Health {
+	h := &Health{
+		maxAge:      envDuration("HEALTH_MAX_HEARTBEAT_AGE", 2*time.Minute),
+		maxHandling: envDuration("HEALTH_MAX_HANDLER_DURATION", 30*time.Minute),
+	}
+	// Считаем момент запуска первым heartbeat, чтобы бот был живым до первого опроса
+	h.Heartbeat()
+	return h
+}
+
+// envDuration читает положительную длительность из переменной окружения name
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
+// Heartbeat отмечает, что цикл опроса Telegram работает
+func (h *Health) Heartbeat() {
+	h.lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+// Handling отмечает начало обработки обновления. Пока обработка идёт, heartbeat
+// не обновляется, и /healthz проверяет её длительность вместо возраста heartbeat:
+// долгая генерация не должна приводить к перезапуску бота посреди ответа.
+// Возвращённая функция завершает обработку и отмечает heartbeat.
+func (h *Health) Handling() (done func()) {
+	h.handlingSince.Store(time.Now().UnixNano())
+	return func() {
+		h.handlingSince.Store(0)
+		h.Heartbeat()
+	}
+}
+
+// healthStatus тело ответа эндпоинтов здоровья
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// writeHealth отдаёт статус в JSON с кодом 200 или 503
+func writeHealth(w http.ResponseWriter, ok bool, checks map[string]string) {
+	status := healthStatus{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	if !ok {
+		status.Status = "fail"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// LivenessHandler /healthz: процесс жив и цикл опроса недавно отметился
+// или обрабатывает обновление не дольше допустимого
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if since := h.handlingSince.Load(); since != 0 {
+			busy := time.Since(time.Unix(0, since))
+			writeHealth(w, busy <= h.maxHandling, map[string]string{
+				"polling": "обработка обновления идёт " + busy.Round(time.Second).String(),
+			})
+			return
+		}
+		age := time.Since(time.Unix(0, h.lastHeartbeat.Load()))
+		ok := age <= h.maxAge
+		writeHealth(w, ok, map[string]string{
+			"polling": "последний heartbeat " + age.Round(time.Second).String() + " назад",
+		})
+	})
+}
+
+// ReadinessHandler /readyz: Telegram getMe выполняется успешно,
+// Ollama доступна и настроенная модель установлена
+func (h *Health) ReadinessHandler(bot *TelegramBot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks := make(map[string]string)
+		ok := true
+
+		if me, err := bot.GetMe(r.Context()); err != nil {
+			ok = false
+			checks["telegram"] = err.Error()
+		} else {
+			checks["telegram"] = "ok (@" + me.Username + ")"
+		}
+
+		if found, err := bot.Ollama.HasModel(r.Context()); err != nil {
+			ok = false
+			checks["ollama"] = err.Error()
+		} else if !found {
+			ok = false
+			checks["ollama"] = "модель " + bot.Ollama.Model + " не найдена"
+		} else {
+			checks["ollama"] = "ok (" + bot.Ollama.Model + ")"
+		}
+
+		writeHealth(w, ok, checks)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// livenessCode возвращает код ответа /healthz
+func livenessCode(h *Health) int {
+	rec := httptest.NewRecorder()
+	h.LivenessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return rec.Code
+}
+
+func TestLivenessHeartbeatAge(t *testing.T) {
+	h := NewHealth()
+	if code := livenessCode(h); code != http.StatusOK {
+		t.Fatalf("сразу после запуска: %d", code)
+	}
+	h.lastHeartbeat.Store(time.Now().Add(-h.maxAge - time.Second).UnixNano())
+	if code := livenessCode(h); code != http.StatusServiceUnavailable {
+		t.Fatalf("устаревший heartbeat: %d", code)
+	}
+}
+
+func TestLivenessDuringLongHandler(t *testing.T) {
+	t.Setenv("HEALTH_MAX_HANDLER_DURATION", "10m")
+	h := NewHealth()
+	h.lastHeartbeat.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	// Обработчик работает дольше HEALTH_MAX_HEARTBEAT_AGE, но меньше допустимой длительности
+	done := h.Handling()
+	h.handlingSince.Store(time.Now().Add(-5 * time.Minute).UnixNano())
+	if code := livenessCode(h); code != http.StatusOK {
+		t.Fatalf("во время долгой обработки: %d", code)
+	}
+
+	// Зависший обработчик всё же считается отказом
+	h.handlingSince.Store(time.Now().Add(-11 * time.Minute).UnixNano())
+	if code := livenessCode(h); code != http.StatusServiceUnavailable {
+		t.Fatalf("обработка дольше допустимого: %d", code)
+	}
+
+	done()
+	if code := livenessCode(h); code != http.StatusOK {
+		t.Fatalf("после обработки: %d", code)
+	}
+}
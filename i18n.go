@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// catalog тексты, которые бот показывает пользователям, по языкам.
+// Сообщения логов сюда не входят. Новые ключи нужно добавлять во все языки:
+// checkCatalog проверяет это при запуске.
+var catalog = map[string]map[string]string{
+	"ru": {
+		"start": "Привет! Я бот для работы с Ollama LLM.\n\n" +
+			"Просто отправь мне сообщение, и я передам его модели для генерации ответа. " +
+			"Я помню контекст нашего разговора.\n\n" +
+			"Используй /help для получения справки.",
+		"help_header":           "Доступные команды:\n\n",
+		"help_footer":           "\nЛюбое другое сообщение будет отправлено в Ollama для генерации ответа.",
+		"admin_only":            "Эта команда доступна только администраторам.",
+		"rate_limited":          "Слишком много запросов. Пожалуйста, подождите немного.",
+		"prompt_too_long":       "Сообщение слишком длинное. Максимальная длина: %d символов.",
+		"processing":            "Обрабатываю запрос...",
+		"generation_error":      "Произошла ошибка при обработке запроса. Попробуйте позже.",
+		"to_be_continued":       "[Продолжение следует...]",
+		"quota_exceeded":        "Квота токенов исчерпана: %s. Подробнее: /usage",
+		"quota_daily":           "дневная квота (%d из %d токенов)",
+		"quota_monthly":         "месячная квота (%d из %d токенов)",
+		"quota_needed":          ", а запросу нужно около %d",
+		"usage_report":          "Использование (тариф %s):\n\nСегодня: %s\nЗа месяц: %s\nВсего: %d токенов, %d запрос(ов), %s генерации",
+		"usage_unlimited":       "%d токенов, %d запрос(ов) (без ограничений)",
+		"usage_limited":         "%d из %d токенов, %d запрос(ов)",
+		"stats_report":          "Статистика бота:\n\nПользователей: %d, активных сегодня: %d\nСегодня: %d токенов, %d запрос(ов)\nЗа месяц: %d токенов, %d запрос(ов)\nВсего: %d токенов, %d запрос(ов)",
+		"history_cleared":       "История разговора очищена. Начинаем заново.",
+		"history_empty":         "История разговора пуста.",
+		"history_stats":         "В истории %d сообщени(й), примерно %d токенов.\n",
+		"history_earlier":       "\nРанее: %s\n",
+		"role_user":             "Вы",
+		"role_assistant":        "Бот",
+		"export_title":          "# История разговора\n\n",
+		"export_summary":        "## Краткое содержание ранних сообщений\n\n%s\n\n",
+		"export_caption":        "История разговора",
+		"export_unknown_format": "Неизвестный формат. Используйте /export md или /export json.",
+		"export_failed":         "Не удалось выгрузить историю. Попробуйте позже.",
+		"btn_regenerate":        "🔄 Перегенерировать",
+		"btn_continue":          "➡️ Продолжить",
+		"answer_unavailable":    "Этот ответ уже недоступен в истории.",
+		"inline_title":          "Сгенерировать ответ",
+		"inline_generating":     "⏳ Генерирую ответ...",
+		"inline_button":         "⏳ Генерация...",
+		"lang_current":          "Текущий язык: %s. Доступные языки: %s.\nИспользуйте /lang <код> или /lang auto, чтобы брать язык из настроек Telegram.",
+		"lang_set":              "Язык интерфейса: русский.",
+		"lang_auto":             "Язык интерфейса будет определяться по настройкам Telegram.",
+		"lang_unknown":          "Неизвестный язык. Доступные языки: %s.",
+		"tools_status":          "Инструменты модели в этом чате: %s.\n\n%s\nДокументов в чате: %d. Отправьте текстовый файл, чтобы модель могла искать в нём.\nИспользуйте /tools on или /tools off.",
+		"tools_set":             "Инструменты модели в этом чате %s.",
+		"tools_on":              "включены",
+		"tools_off":             "выключены",
+		"tools_usage":           "Используйте /tools on или /tools off.",
+		"document_saved":        "Документ %s сохранён. Модель сможет искать в нём, если в чате включены инструменты (/tools).",
+		"document_unsupported":  "Поддерживаются только текстовые документы: .txt, .md, .csv, .json, .log, .xml, .yaml.",
+		"document_failed":       "Не удалось загрузить документ. Попробуйте позже.",
+		"json_usage":            "Использование: /json [схема] запрос.\nСхема JSON Schema указывается перед запросом, например:\n/json {\"type\":\"object\",\"properties\":{\"city\":{\"type\":\"string\"}},\"required\":[\"city\"]} Столица Франции",
+		"json_bad_schema":       "Некорректная схема: %v",
+		"json_failed":           "Модель не смогла дать ответ, соответствующий схеме. Попробуйте уточнить запрос.",
+		"json_caption":          "Ответ в формате JSON",
+		"voice_unsupported":     "Распознавание голосовых сообщений не настроено. Напишите запрос текстом.",
+		"voice_too_long":        "Запись слишком длинная. Максимальная длительность — %d с.",
+		"voice_failed":          "Не удалось распознать запись. Попробуйте позже или напишите текстом.",
+		"voice_empty":           "В записи не удалось различить речь.",
+		"voice_recognized":      "🎤 %s",
+		"schedule_usage":        "Использование:\n/schedule daily 09:00 запрос — каждый день\n/schedule weekdays 09:00 запрос — по будням\n/schedule weekly mon 09:00 запрос — раз в неделю\n/schedule at 2026-01-31 18:30 запрос — один раз (дату можно не указывать)\n/schedule in 30m запрос — один раз через интервал\nВремя указывается в вашем часовом поясе (/timezone).",
+		"schedule_invalid":      "Не удалось разобрать расписание: %v",
+		"schedule_limit":        "Достигнут лимит расписаний: %d. Удалите ненужные через /schedules delete <id>.",
+		"schedule_created":      "Запрос запланирован:\n%s",
+		"schedule_daily":        "каждый день в %s",
+		"schedule_weekdays":     "по будням в %s",
+		"schedule_weekly":       "каждую неделю, %s в %s",
+		"schedule_once":         "один раз",
+		"schedule_item":         "#%d %s, следующий запуск %s (%s): %s",
+		"schedule_result":       "⏰ Запланированный запрос #%d: %s",
+		"schedule_not_found":    "Расписание #%d не найдено или принадлежит другому пользователю.",
+		"schedule_deleted":      "Расписание #%d удалено.",
+		"schedules_empty":       "В этом чате нет запланированных запросов. Создать: /schedule",
+		"schedules_header":      "Запланированные запросы:\n\n",
+		"schedules_footer":      "\nУдалить: /schedules delete <id>",
+		"schedules_usage":       "Используйте /schedules или /schedules delete <id>.",
+		"weekdays_short":        "вс,пн,вт,ср,чт,пт,сб",
+		"timezone_current":      "Ваш часовой пояс: %s. Изменить: /timezone Europe/Moscow или /timezone UTC+3.",
+		"timezone_set":          "Часовой пояс: %s. Он используется для новых расписаний.",
+		"timezone_invalid":      "Неизвестный часовой пояс %q. Укажите имя из базы IANA (Europe/Moscow) или смещение (UTC+3).",
+		"template_usage":        "Использование:\n/template add имя текст — личный шаблон\n/template delete имя — удалить\n/sharedtemplate add|delete имя [текст] — общий шаблон (администраторы)\n/template show имя — показать текст\nИмя: латинские буквы в нижнем регистре, цифры, - и _. В тексте доступны {{.Input}} — текст после имени, {{.Vars.имя}} — переменные имя=значение, {{.User}}, {{.Date}}, {{.Time}}, {{.Lang}} и функции upper, lower, trim, default.\nПример: /template add review Проверь код и укажи ошибки:\n{{.Input}}",
+		"template_invalid":      "Ошибка в шаблоне: %v",
+		"template_limit":        "Достигнут лимит личных шаблонов: %d.",
+		"template_saved":        "Шаблон %s сохранён. Применить: /t %[1]s текст",
+		"template_deleted":      "Шаблон %s удалён.",
+		"template_not_found":    "Шаблон %s не найден. Список: /templates",
+		"template_needs_input":  "Шаблону %s нужен текст: /t %[1]s текст",
+		"template_failed":       "Не удалось применить шаблон %s: %v",
+		"template_empty":        "Шаблон %s дал пустой запрос.",
+		"template_pick":         "Выберите шаблон:",
+		"template_send_input":   "Пришлите текст для шаблона %s следующим сообщением.",
+		"templates_empty":       "Шаблонов пока нет. Создать: /template add имя текст",
+		"templates_personal":    "Личные шаблоны:\n",
+		"templates_shared":      "Общие шаблоны:\n",
+		"templates_footer":      "Применить: /t имя текст или /t для выбора кнопкой.",
+		"compare_usage":         "Использование: /compare модель1,модель2 запрос — один вопрос нескольким моделям с голосованием за лучший ответ.\n/compare stats — итоги голосования.",
+		"compare_too_many":      "Можно сравнить не больше %d моделей за раз.",
+		"compare_not_allowed":   "Модель %s недоступна для сравнения. Разрешены: %s",
+		"compare_processing":    "Сравниваю ответы моделей (%d)...",
+		"compare_answer":        "%s · %s · %s",
+		"compare_failed":        "%s · %s: не удалось получить ответ.",
+		"compare_stats":         "%.1f с, токены %d→%d, %.1f ток/с",
+		"compare_vote":          "Какой ответ лучше?",
+		"compare_voted":         "Голос за %s учтён.",
+		"compare_voted_twice":   "Вы уже проголосовали.",
+		"compare_expired":       "Голосование по этому сравнению закрыто.",
+		"compare_stats_empty":   "Голосов пока нет. Сравнить модели: /compare модель1,модель2 запрос",
+		"compare_stats_header":  "Итоги голосования (победы / сравнения):\n",
+		"compare_stats_line":    "%s — %d / %d",
+	},
+	"en": {
+		"start": "Hi! I am a bot for Ollama LLM.\n\n" +
+			"Just send me a message and I will pass it to the model to generate an answer. " +
+			"I remember the context of our conversation.\n\n" +
+			"Use /help to see the available commands.",
+		"help_header":           "Available commands:\n\n",
+		"help_footer":           "\nAny other message will be sent to Ollama to generate an answer.",
+		"admin_only":            "This command is available to administrators only.",
+		"rate_limited":          "Too many requests. Please wait a little.",
+		"prompt_too_long":       "The message is too long. Maximum length: %d characters.",
+		"processing":            "Processing your request...",
+		"generation_error":      "Something went wrong while processing the request. Please try again later.",
+		"to_be_continued":       "[To be continued...]",
+		"quota_exceeded":        "Token quota exceeded: %s. Details: /usage",
+		"quota_daily":           "daily quota (%d of %d tokens)",
+		"quota_monthly":         "monthly quota (%d of %d tokens)",
+		"quota_needed":          ", and the request needs about %d",
+		"usage_report":          "Usage (tier %s):\n\nToday: %s\nThis month: %s\nTotal: %d tokens, %d request(s), %s of generation",
+		"usage_unlimited":       "%d tokens, %d request(s) (unlimited)",
+		"usage_limited":         "%d of %d tokens, %d request(s)",
+		"stats_report":          "Bot statistics:\n\nUsers: %d, active today: %d\nToday: %d tokens, %d request(s)\nThis month: %d tokens, %d request(s)\nTotal: %d tokens, %d request(s)",
+		"history_cleared":       "Conversation history cleared. Starting over.",
+		"history_empty":         "The conversation history is empty.",
+		"history_stats":         "The history holds %d message(s), about %d tokens.\n",
+		"history_earlier":       "\nEarlier: %s\n",
+		"role_user":             "You",
+		"role_assistant":        "Bot",
+		"export_title":          "# Conversation history\n\n",
+		"export_summary":        "## Summary of earlier messages\n\n%s\n\n",
+		"export_caption":        "Conversation history",
+		"export_unknown_format": "Unknown format. Use /export md or /export json.",
+		"export_failed":         "Could not export the history. Please try again later.",
+		"btn_regenerate":        "🔄 Regenerate",
+		"btn_continue":          "➡️ Continue",
+		"answer_unavailable":    "This answer is no longer in the history.",
+		"inline_title":          "Generate an answer",
+		"inline_generating":     "⏳ Generating an answer...",
+		"inline_button":         "⏳ Generating...",
+		"lang_current":          "Current language: %s. Available languages: %s.\nUse /lang <code>, or /lang auto to follow your Telegram settings.",
+		"lang_set":              "Interface language: English.",
+		"lang_auto":             "The interface language will follow your Telegram settings.",
+		"lang_unknown":          "Unknown language. Available languages: %s.",
+		"tools_status":          "Model tools in this chat: %s.\n\n%s\nDocuments in this chat: %d. Send a text file so the model can search it.\nUse /tools on or /tools off.",
+		"tools_set":             "Model tools in this chat are %s.",
+		"tools_on":              "on",
+		"tools_off":             "off",
+		"tools_usage":           "Use /tools on or /tools off.",
+		"document_saved":        "Document %s saved. The model can search it when tools are on in this chat (/tools).",
+		"document_unsupported":  "Only text documents are supported: .txt, .md, .csv, .json, .log, .xml, .yaml.",
+		"document_failed":       "Could not load the document. Please try again later.",
+		"json_usage":            "Usage: /json [schema] prompt.\nPut a JSON Schema before the prompt, for example:\n/json {\"type\":\"object\",\"properties\":{\"city\":{\"type\":\"string\"}},\"required\":[\"city\"]} Capital of France",
+		"json_bad_schema":       "Invalid schema: %v",
+		"json_failed":           "The model could not produce an answer matching the schema. Try rephrasing the prompt.",
+		"json_caption":          "Answer in JSON",
+		"voice_unsupported":     "Voice recognition is not configured. Please type your request.",
+		"voice_too_long":        "The recording is too long. Maximum duration is %d s.",
+		"voice_failed":          "Could not recognize the recording. Please try again later or type your request.",
+		"voice_empty":           "No speech was recognized in the recording.",
+		"voice_recognized":      "🎤 %s",
+		"schedule_usage":        "Usage:\n/schedule daily 09:00 prompt — every day\n/schedule weekdays 09:00 prompt — Monday to Friday\n/schedule weekly mon 09:00 prompt — once a week\n/schedule at 2026-01-31 18:30 prompt — once (the date is optional)\n/schedule in 30m prompt — once after an interval\nTimes are in your time zone (/timezone).",
+		"schedule_invalid":      "Could not parse the schedule: %v",
+		"schedule_limit":        "Schedule limit reached: %d. Delete unused ones with /schedules delete <id>.",
+		"schedule_created":      "Prompt scheduled:\n%s",
+		"schedule_daily":        "every day at %s",
+		"schedule_weekdays":     "on weekdays at %s",
+		"schedule_weekly":       "every week, %s at %s",
+		"schedule_once":         "once",
+		"schedule_item":         "#%d %s, next run %s (%s): %s",
+		"schedule_result":       "⏰ Scheduled prompt #%d: %s",
+		"schedule_not_found":    "Schedule #%d not found or belongs to another user.",
+		"schedule_deleted":      "Schedule #%d deleted.",
+		"schedules_empty":       "No scheduled prompts in this chat. Create one: /schedule",
+		"schedules_header":      "Scheduled prompts:\n\n",
+		"schedules_footer":      "\nDelete: /schedules delete <id>",
+		"schedules_usage":       "Use /schedules or /schedules delete <id>.",
+		"weekdays_short":        "Sun,Mon,Tue,Wed,Thu,Fri,Sat",
+		"timezone_current":      "Your time zone: %s. Change it: /timezone Europe/London or /timezone UTC+3.",
+		"timezone_set":          "Time zone: %s. It applies to new schedules.",
+		"timezone_invalid":      "Unknown time zone %q. Use an IANA name (Europe/London) or an offset (UTC+3).",
+		"template_usage":        "Usage:\n/template add name text — personal template\n/template delete name — delete\n/sharedtemplate add|delete name [text] — shared template (admins)\n/template show name — show the text\nName: lowercase Latin letters, digits, - and _. The text may use {{.Input}} — the text after the name, {{.Vars.name}} — name=value variables, {{.User}}, {{.Date}}, {{.Time}}, {{.Lang}} and the functions upper, lower, trim, default.\nExample: /template add review Review this code and point out bugs:\n{{.Input}}",
+		"template_invalid":      "Template error: %v",
+		"template_limit":        "Personal template limit reached: %d.",
+		"template_saved":        "Template %s saved. Use it: /t %[1]s text",
+		"template_deleted":      "Template %s deleted.",
+		"template_not_found":    "Template %s not found. List: /templates",
+		"template_needs_input":  "Template %s needs text: /t %[1]s text",
+		"template_failed":       "Could not apply template %s: %v",
+		"template_empty":        "Template %s produced an empty prompt.",
+		"template_pick":         "Choose a template:",
+		"template_send_input":   "Send the text for template %s in your next message.",
+		"templates_empty":       "No templates yet. Create one: /template add name text",
+		"templates_personal":    "Personal templates:\n",
+		"templates_shared":      "Shared templates:\n",
+		"templates_footer":      "Use: /t name text, or /t to pick with a button.",
+		"compare_usage":         "Usage: /compare model1,model2 prompt — ask several models the same question and vote for the best answer.\n/compare stats — voting results.",
+		"compare_too_many":      "You can compare at most %d models at once.",
+		"compare_not_allowed":   "Model %s is not available for comparison. Allowed: %s",
+		"compare_processing":    "Comparing answers from %d models...",
+		"compare_answer":        "%s · %s · %s",
+		"compare_failed":        "%s · %s: no answer.",
+		"compare_stats":         "%.1f s, tokens %d→%d, %.1f tok/s",
+		"compare_vote":          "Which answer is better?",
+		"compare_voted":         "Vote for %s recorded.",
+		"compare_voted_twice":   "You have already voted.",
+		"compare_expired":       "Voting on this comparison is closed.",
+		"compare_stats_empty":   "No votes yet. Compare models: /compare model1,model2 prompt",
+		"compare_stats_header":  "Voting results (wins / comparisons):\n",
+		"compare_stats_line":    "%s — %d / %d",
+	},
+}
+
+// T возвращает текст по ключу на языке lang, подставляя аргументы.
+// Если перевода нет, используется язык по умолчанию, а затем сам ключ.
+func T(lang, key string, args ...any) string {
+	text, ok := catalog[lang][key]
+	if !ok {
+		text, ok = catalog[defaultLanguage][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// supportedLanguages возвращает коды языков каталога в алфавитном порядке
+func supportedLanguages() []string {
+	langs := make([]string, 0, len(catalog))
+	for lang := range catalog {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// normalizeLanguage приводит код языка Telegram (например, "en-US") к языку каталога.
+// Возвращает пустую строку, если язык не поддерживается.
+func normalizeLanguage(code string) string {
+	lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(code)), "-")
+	if _, ok := catalog[lang]; ok {
+		return lang
+	}
+	return ""
+}
+
+// checkCatalog проверяет, что каждый ключ каталога переведён на все языки
+func checkCatalog() error {
+	var missing []string
+	for lang, messages := range catalog {
+		for other, otherMessages := range catalog {
+			for key := range otherMessages {
+				if _, ok := messages[key]; !ok {
+					missing = append(missing, fmt.Sprintf("%s.%s (есть в %s)", lang, key, other))
+				}
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("в каталоге сообщений нет переводов: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// languageKey ключ контекста для языка пользователя
+type languageKey struct{}
+
+// withLanguage возвращает контекст с языком пользователя, от которого пришло обновление
+func withLanguage(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, languageKey{}, lang)
+}
+
+// languageFrom возвращает язык пользователя из контекста
+func languageFrom(ctx context.Context) string {
+	if lang, ok := ctx.Value(languageKey{}).(string); ok && lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// tr возвращает текст по ключу на языке пользователя из контекста
+func tr(ctx context.Context, key string, args ...any) string {
+	return T(languageFrom(ctx), key, args...)
+}
+
+// languageFor определяет язык пользователя: сначала выбранный через /lang,
+// затем язык из настроек Telegram, иначе язык по умолчанию
+func (bot *TelegramBot) languageFor(user *User) string {
+	if user == nil {
+		return defaultLanguage
+	}
+	if lang := bot.Prefs.Get(user.ID).Lang; lang != "" {
+		return lang
+	}
+	if lang := normalizeLanguage(user.LanguageCode); lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestCatalogKeys(t *testing.T) {
+	base := catalog[defaultLanguage]
+	for _, lang := range supportedLanguages() {
+		if lang == defaultLanguage {
+			continue
+		}
+		var missing, extra []string
+		for key := range base {
+			if _, ok := catalog[lang][key]; !ok {
+				missing = append(missing, key)
+			}
+		}
+		for key := range catalog[lang] {
+			if _, ok := base[key]; !ok {
+				extra = append(extra, key)
+			}
+		}
+		sort.Strings(missing)
+		sort.Strings(extra)
+		if len(missing) > 0 {
+			t.Errorf("%s: нет переводов для %v", lang, missing)
+		}
+		if len(extra) > 0 {
+			t.Errorf("%s: ключи отсутствуют в %s: %v", lang, defaultLanguage, extra)
+		}
+	}
+	if err := checkCatalog(); err != nil {
+		t.Error(err)
+	}
+}
+
+// verbPattern глагол форматирования fmt с необязательным индексом аргумента
+var verbPattern = regexp.MustCompile(`%(\[\d+\])?[-+# 0]*\d*(?:\.\d+)?([a-zA-Z%])`)
+
+// formatArgs сопоставляет номер аргумента (с 1) глаголу, которым он форматируется
+func formatArgs(text string) map[int]string {
+	args := make(map[int]string)
+	next := 1
+	for _, m := range verbPattern.FindAllStringSubmatch(text, -1) {
+		if m[2] == "%" {
+			continue
+		}
+		if m[1] != "" {
+			next, _ = strconv.Atoi(m[1][1 : len(m[1])-1])
+		}
+		if verb, ok := args[next]; ok && verb != m[2] {
+			args[next] = verb + "," + m[2]
+		} else {
+			args[next] = m[2]
+		}
+		next++
+	}
+	return args
+}
+
+func TestCatalogFormatVerbs(t *testing.T) {
+	for _, lang := range supportedLanguages() {
+		if lang == defaultLanguage {
+			continue
+		}
+		for key, text := range catalog[defaultLanguage] {
+			other, ok := catalog[lang][key]
+			if !ok {
+				continue
+			}
+			want, got := formatArgs(text), formatArgs(other)
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("%s: аргументы %s %v, %s %v", key, defaultLanguage, want, lang, got)
+			}
+		}
+	}
+}
+
+func TestFormatArgs(t *testing.T) {
+	for text, want := range map[string]map[int]string{
+		"%s и %d%%":           {1: "s", 2: "d"},
+		"%.1f с, %d→%d":       {1: "f", 2: "d", 3: "d"},
+		"Шаблон %s: /t %[1]s": {1: "s"},
+		"%[2]s перед %[1]d":   {1: "d", 2: "s"},
+		"без аргументов":      {},
+		"%q (ширина %-10s)":   {1: "q", 2: "s"},
+	} {
+		if got := formatArgs(text); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("formatArgs(%q) = %v, ожидалось %v", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxInlineMessageLen ограничение длины текста inline-сообщения.
+// Inline-ответ нельзя разбить на несколько сообщений, поэтому он обрезается.
+const maxInlineMessageLen = 4000
+
+type InlineQuery struct {
+	ID     string `json:"id"`
+	From   *User  `json:"from"`
+	Query  string `json:"query"`
+	Offset string `json:"offset"`
+}
+
+type ChosenInlineResult struct {
+	ResultID        string `json:"result_id"`
+	From            *User  `json:"from"`
+	Query           string `json:"query"`
+	InlineMessageID string `json:"inline_message_id,omitempty"`
+}
+
+type InputTextMessageContent struct {
+	MessageText string `json:"message_text"`
+}
+
+type InlineQueryResultArticle struct {
+	Type                string                  `json:"type"`
+	ID                  string                  `json:"id"`
+	Title               string                  `json:"title"`
+	Description         string                  `json:"description,omitempty"`
+	InputMessageContent InputTextMessageContent `json:"input_message_content"`
+	ReplyMarkup         *InlineKeyboardMarkup   `json:"reply_markup,omitempty"`
+}
+
+type answerInlineQueryRequest struct {
+	InlineQueryID string                     `json:"inline_query_id"`
+	Results       []InlineQueryResultArticle `json:"results"`
+	CacheTime     int                        `json:"cache_time"`
+	IsPersonal    bool                       `json:"is_personal"`
+}
+
+// HandleInlineQuery отвечает на запрос @bot вопрос одним результатом «Сгенерировать...».
+// Сама генерация запускается, когда пользователь выберет результат
+// (chosen_inline_result), так как ответ модели не укладывается в таймаут inline-запроса.
+func (bot *TelegramBot) HandleInlineQuery(ctx context.Context, query *InlineQuery) {
+	if query == nil || query.From == nil {
+		return
+	}
+	ctx = withLanguage(ctx, bot.languageFor(query.From))
+
+	results := []InlineQueryResultArticle{}
+	text := strings.TrimSpace(query.Query)
+
+	switch {
+	case !bot.isUserIDAllowed(query.From.ID):
+		metricUnauthorized.Inc()
+		slog.WarnContext(ctx, "Отклонён inline-запрос от неавторизованного пользователя", "user_id", query.From.ID)
+	case text == "" || len(text) > bot.maxPromptLen:
+		// Пустой или слишком длинный запрос — без результатов
+	default:
+		metricMessagesHandled.Inc("inline_query")
+		sum := sha256.Sum256([]byte(text))
+		results = append(results, InlineQueryResultArticle{
+			Type:        "article",
+			ID:          hex.EncodeToString(sum[:16]),
+			Title:       tr(ctx, "inline_title"),
+			Description: truncate(text, 100),
+			InputMessageContent: InputTextMessageContent{
+				MessageText: "❓ " + text + "\n\n" + tr(ctx, "inline_generating"),
+			},
+			// Клавиатура нужна, чтобы Telegram передал inline_message_id для последующей правки
+			ReplyMarkup: &InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{{
+				{Text: tr(ctx, "inline_button"), CallbackData: "noop"},
+			}}},
+		})
+	}
+
+	err := bot.callAPI(ctx, "answerInlineQuery", answerInlineQueryRequest{
+		InlineQueryID: query.ID,
+		Results:       results,
+		CacheTime:     0,
+		IsPersonal:    true,
+	}, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка ответа на inline-запрос", "user_id", query.From.ID, "error", err)
+	}
+}
+
+// HandleChosenInlineResult генерирует ответ на выбранный inline-результат
+// и подставляет его в отправленное сообщение
+func (bot *TelegramBot) HandleChosenInlineResult(ctx context.Context, chosen *ChosenInlineResult) {
+	if chosen == nil || chosen.From == nil || chosen.InlineMessageID == "" {
+		return
+	}
+	ctx = withLanguage(ctx, bot.languageFor(chosen.From))
+
+	userID := chosen.From.ID
+	text := strings.TrimSpace(chosen.Query)
+	if !bot.isUserIDAllowed(userID) {
+		metricUnauthorized.Inc()
+		slog.WarnContext(ctx, "Отклонён inline-результат от неавторизованного пользователя", "user_id", userID)
+		return
+	}
+	if text == "" || len(text) > bot.maxPromptLen {
+		return
+	}
+
+	metricMessagesHandled.Inc("inline_result")
+	slog.InfoContext(ctx, "Выбран inline-результат", "user_id", userID)
+
+	header := "❓ " + text + "\n\n"
+
+	if !bot.checkRateLimit(userID) {
+		metricRateLimited.Inc()
+		bot.editInlineMessage(ctx, chosen.InlineMessageID, header+tr(ctx, "rate_limited"))
+		return
+	}
+
+	if err := bot.Usage.CheckQuota(userID); err != nil {
+		slog.InfoContext(ctx, "Квота пользователя исчерпана", "user_id", userID, "reason", err)
+		bot.editInlineMessage(ctx, chosen.InlineMessageID, header+bot.quotaMessage(ctx, err))
+		return
+	}
+
+	result, err := bot.Ollama.Chat(ctx, bot.History.Standalone(text))
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка от Ollama", "user_id", userID, "error", err)
+		bot.editInlineMessage(ctx, chosen.InlineMessageID, header+tr(ctx, "generation_error"))
+		return
+	}
+
+	// У inline-сообщений нет чата, поэтому расход учитывается на личный чат пользователя
+	bot.Usage.Record(userID, userID, result)
+
+	answer := header + result.Response
+	if utf8.RuneCountInString(answer) > maxInlineMessageLen {
+		answer = string([]rune(answer)[:maxInlineMessageLen]) + "…"
+	}
+	bot.editInlineMessage(ctx, chosen.InlineMessageID, answer)
+}
+
+// editInlineMessage заменяет текст inline-сообщения и убирает клавиатуру
+func (bot *TelegramBot) editInlineMessage(ctx context.Context, inlineMessageID, text string) {
+	err := bot.callAPI(ctx, "editMessageText", editMessageTextRequest{
+		InlineMessageID: inlineMessageID,
+		Text:            text,
+	}, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка редактирования inline-сообщения", "error", err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema поддерживаемое подмножество JSON Schema: type, properties,
+// required, additionalProperties, items, enum, minimum/maximum,
+// minLength/maxLength и minItems/maxItems. Остальные ключевые слова
+// передаются модели, но при проверке ответа не учитываются.
+type jsonSchema struct {
+	Types      []string
+	Properties map[string]*jsonSchema
+	Required   []string
+	// Additional схема дополнительных свойств; nil — любые, noAdditional — запрещены
+	Additional   *jsonSchema
+	noAdditional bool
+	Items        *jsonSchema
+	Enum         []any
+
+	Minimum, Maximum     *float64
+	MinLength, MaxLength *int
+	MinItems, MaxItems   *int
+}
+
+// rawSchema схема в том виде, в каком она записана в JSON
+type rawSchema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	Enum                 []any                      `json:"enum"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+}
+
+// schemaTypes допустимые значения type
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// parseSchema разбирает и проверяет JSON Schema
+func parseSchema(data json.RawMessage) (*jsonSchema, error) {
+	return parseSchemaAt(data, "$")
+}
+
+func parseSchemaAt(data json.RawMessage, path string) (*jsonSchema, error) {
+	var raw rawSchema
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: схема должна быть объектом: %w", path, err)
+	}
+
+	s := &jsonSchema{
+		Required:  raw.Required,
+		Enum:      raw.Enum,
+		Minimum:   raw.Minimum,
+		Maximum:   raw.Maximum,
+		MinLength: raw.MinLength,
+		MaxLength: raw.MaxLength,
+		MinItems:  raw.MinItems,
+		MaxItems:  raw.MaxItems,
+	}
+
+	if len(raw.Type) > 0 {
+		var single string
+		if err := json.Unmarshal(raw.Type, &single); err == nil {
+			s.Types = []string{single}
+		} else if err := json.Unmarshal(raw.Type, &s.Types); err != nil {
+			return nil, fmt.Errorf("%s: type должен быть строкой или списком строк", path)
+		}
+		for _, t := range s.Types {
+			if !schemaTypes[t] {
+				return nil, fmt.Errorf("%s: неизвестный тип %q", path, t)
+			}
+		}
+	}
+
+	if len(raw.Properties) > 0 {
+		s.Properties = make(map[string]*jsonSchema, len(raw.Properties))
+		for name, prop := range raw.Properties {
+			child, err := parseSchemaAt(prop, path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+			s.Properties[name] = child
+		}
+	}
+
+	switch strings.TrimSpace(string(raw.AdditionalProperties)) {
+	case "", "true":
+	case "false":
+		s.noAdditional = true
+	default:
+		child, err := parseSchemaAt(raw.AdditionalProperties, path+".*")
+		if err != nil {
+			return nil, err
+		}
+		s.Additional = child
+	}
+
+	if len(raw.Items) > 0 {
+		child, err := parseSchemaAt(raw.Items, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		s.Items = child
+	}
+	return s, nil
+}
+
+// Validate проверяет значение, полученное из json.Unmarshal в any,
+// и возвращает первую найденную ошибку с путём к полю
+func (s *jsonSchema) Validate(v any) error {
+	return s.validateAt(v, "$")
+}
+
+func (s *jsonSchema) validateAt(v any, path string) error {
+	if len(s.Types) > 0 {
+		ok := false
+		for _, t := range s.Types {
+			if matchesType(v, t) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: ожидался тип %s, получено %s", path, strings.Join(s.Types, " или "), typeName(v))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: значение не из списка enum", path)
+		}
+	}
+
+	switch val := v.(type) {
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			return fmt.Errorf("%s: значение меньше %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			return fmt.Errorf("%s: значение больше %v", path, *s.Maximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: строка короче %d символов", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: строка длиннее %d символов", path, *s.MaxLength)
+		}
+	case []any:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			return fmt.Errorf("%s: меньше %d элементов", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			return fmt.Errorf("%s: больше %d элементов", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range val {
+				if err := s.Items.validateAt(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				return fmt.Errorf("%s: нет обязательного поля %q", path, name)
+			}
+		}
+		// Поля проверяются в порядке имён, чтобы ошибка была воспроизводимой
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child, ok := s.Properties[name]
+			switch {
+			case ok:
+			case s.noAdditional:
+				return fmt.Errorf("%s: лишнее поле %q", path, name)
+			case s.Additional != nil:
+				child = s.Additional
+			default:
+				continue
+			}
+			if err := child.validateAt(val[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matchesType проверяет соответствие значения типу JSON Schema
+func matchesType(v any, t string) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+// typeName возвращает тип значения в терминах JSON
+func typeName(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := parseSchema(json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"tags": {"type": "array", "items": {"type": "string", "enum": ["a", "b"]}, "maxItems": 2},
+			"score": {"type": ["number", "null"], "minimum": 0, "maximum": 1},
+			"meta": {"type": "object", "additionalProperties": {"type": "integer"}}
+		},
+		"required": ["tags"],
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		doc, want string
+	}{
+		{`{"tags": ["a"], "score": null, "meta": {"x": 1}}`, ""},
+		{`{"tags": ["c"]}`, "$.tags[0]: значение не из списка enum"},
+		{`{"tags": ["a", "b", "a"]}`, "$.tags: больше 2 элементов"},
+		{`{"tags": [], "score": 2}`, "$.score: значение больше 1"},
+		{`{"tags": [], "meta": {"x": 1.5}}`, "$.meta.x: ожидался тип integer"},
+		{`{"tags": [], "extra": true}`, "$: лишнее поле \"extra\""},
+		{`{"score": 0.5}`, "$: нет обязательного поля \"tags\""},
+		{`[]`, "$: ожидался тип object, получено array"},
+	}
+	for _, tt := range tests {
+		_, err := checkJSON(tt.doc, schema)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.doc, err)
+		case tt.want != "" && err == nil:
+			t.Errorf("%s: ожидалась ошибка %q", tt.doc, tt.want)
+		case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+			t.Errorf("%s: ошибка %q, ожидалась %q", tt.doc, err, tt.want)
+		}
+	}
+}
+
+func TestParseSchemaUnknownType(t *testing.T) {
+	if _, err := parseSchema(json.RawMessage(`{"type": "date"}`)); err == nil {
+		t.Error("ожидалась ошибка для неизвестного типа")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Redactor заменяет секреты (токен бота и т.п.) на [REDACTED] в строках
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// logRedactor общий список секретов, скрываемых во всех записях лога
+var logRedactor = &Redactor{}
+
+// Add регистрирует секрет; пустые строки игнорируются
+func (r *Redactor) Add(secret string) {
+	if secret == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = append(r.secrets, secret)
+}
+
+// Redact скрывает все зарегистрированные секреты в строке
+func (r *Redactor) Redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	return s
+}
+
+// redactAttr скрывает секреты в значении атрибута. Значения LogValuer
+// сначала разрешаются; ошибки и прочие значения произвольного типа
+// (структуры, *url.URL, карты) выводятся строкой, чтобы обработчик не мог
+// показать секрет, минуя Redact.
+func (r *Redactor) redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.Redact(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]any, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = r.redactAttr(ga)
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, r.Redact(err.Error()))
+		}
+		return slog.String(a.Key, r.Redact(fmt.Sprintf("%+v", v.Any())))
+	default:
+		return slog.Attr{Key: a.Key, Value: v}
+	}
+}
+
+// logHandler обёртка над slog.Handler: скрывает секреты в каждой записи
+// и добавляет идентификатор корреляции из контекста
+type logHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, h.redactor.Redact(rec.Message), rec.PC)
+	if id := correlationID(ctx); id != "" {
+		out.AddAttrs(slog.String("request_id", id))
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redactor.redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redactor.redactAttr(a)
+	}
+	return &logHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+// parseLogLevel разбирает LOG_LEVEL (debug, info, warn, error); по умолчанию info
+func parseLogLevel(v string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(v))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// newLogger создаёт логгер с форматом из LOG_FORMAT (text или json)
+// и уровнем из LOG_LEVEL
+func newLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLogLevel(os.Getenv("LOG_LEVEL"))}
+
+	var handler slog.Handler
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("LOG_FORMAT")), "json") {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	return slog.New(&logHandler{next: handler, redactor: logRedactor})
+}
+
+func init() {
+	slog.SetDefault(newLogger(os.Stderr))
+}
+
+// correlationKey ключ контекста для идентификатора корреляции
+type correlationKey struct{}
+
+// withCorrelationID возвращает контекст с новым случайным идентификатором корреляции
+func withCorrelationID(ctx context.Context) context.Context {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationKey{}, hex.EncodeToString(b))
+}
+
+// correlationID возвращает идентификатор корреляции из контекста
+func correlationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
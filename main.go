@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,16 +11,73 @@ import (
 )
 
 func main() {
-	// Получаем токен из переменной окружения
+	console := flag.Bool("console", false, "консольный режим: сообщения читаются из stdin, ответы печатаются в stdout без Telegram")
+	stub := flag.Bool("stub", false, "поддельная Ollama вместо настоящей: бот отвечает эхом сообщения")
+	logout := flag.Bool("logout", false, "выйти из сервера Bot API (logOut) перед переходом на собственный сервер и завершиться")
+	closeBot := flag.Bool("close", false, "закрыть бота на собственном сервере Bot API (close) перед переносом и завершиться")
+	flag.Parse()
+
+	// Получаем токен из переменной окружения; в консольном режиме он не нужен
 	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if token == "" && *console {
+		token = "console"
+	}
 	if token == "" {
-		log.Fatal("Ошибка: переменная окружения TELEGRAM_BOT_TOKEN не установлена")
+		slog.Error("Переменная окружения TELEGRAM_BOT_TOKEN не установлена")
+		os.Exit(1)
+	}
+
+	// Каталог сообщений должен содержать переводы всех ключей на все языки
+	if err := checkCatalog(); err != nil {
+		slog.Error("Некорректный каталог сообщений", "error", err)
+		os.Exit(1)
 	}
 
 	// Создаем экземпляр бота
-	bot := NewTelegramBot(token)
+	bot, err := NewTelegramBot(token)
+	if err != nil {
+		slog.Error("Некорректная конфигурация", "error", err)
+		os.Exit(1)
+	}
 
-	log.Println("Бот запущен. Ожидание сообщений...")
+	// Переход между серверами Bot API: вызов выполняется на сервере, который бот покидает
+	if *logout || *closeBot {
+		method, call := "logOut", bot.LogOut
+		if *closeBot {
+			method, call = "close", bot.Close
+		}
+		if err := call(context.Background()); err != nil {
+			slog.Error("Ошибка отключения от сервера Bot API", "method", method, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Бот отключён от сервера Bot API", "method", method)
+		return
+	}
+	if *stub {
+		bot.Ollama.Client.Transport = handlerTransport{handler: NewFakeOllama(bot.Ollama.Model)}
+		slog.Info("Используется заглушка Ollama")
+	}
+
+	if *console {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		runConsole(ctx, bot, os.Stdin, os.Stdout)
+		bot.Usage.Flush()
+		return
+	}
+
+	// Heartbeat цикла опроса для /healthz
+	health := NewHealth()
+
+	// Служебный HTTP-сервер с метриками и проверками здоровья (если задан ADMIN_ADDR)
+	admin := NewAdminServer()
+	if admin != nil {
+		admin.Handle("/healthz", health.LivenessHandler())
+		admin.Handle("/readyz", health.ReadinessHandler(bot))
+		admin.Start()
+	}
+
+	slog.Info("Бот запущен. Ожидание сообщений...")
 
 	// Настройка graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -29,40 +87,64 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Запускаем основной цикл в горутине
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				updates, err := bot.GetUpdates()
-				if err != nil {
-					log.Printf("Ошибка получения обновлений: %v", err)
-					// Задержка перед повтором, чтобы не спамить запросами
-					time.Sleep(5 * time.Second)
-					continue
-				}
-
-				// Обрабатываем каждое обновление
-				for _, update := range updates {
-					if update.UpdateID > bot.LastUpdate {
-						bot.LastUpdate = update.UpdateID
-					}
+	// Регистрируем меню команд в Telegram
+	bot.RegisterCommands(ctx)
 
-					if update.Message != nil {
-						bot.HandleMessage(update.Message)
-					}
-				}
-			}
-		}
-	}()
+	// Запускаем основной цикл в горутине
+	go runPolling(ctx, bot, health)
+	// Планировщик запускает запросы из /schedule
+	go runScheduler(ctx, bot)
 
 	// Ожидаем сигнал завершения
 	<-sigChan
-	log.Println("Получен сигнал завершения. Останавливаю бота...")
+	slog.Info("Получен сигнал завершения. Останавливаю бота...")
 	cancel()
+	if admin != nil {
+		admin.Shutdown()
+	}
 	// Даем время горутине завершиться
 	time.Sleep(1 * time.Second)
-	log.Println("Бот остановлен.")
+	bot.Usage.Flush()
+	slog.Info("Бот остановлен.")
+}
+
+// runPolling получает обновления через long polling и обрабатывает их до отмены ctx
+func runPolling(ctx context.Context, bot *TelegramBot, health *Health) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			updates, err := bot.GetUpdates(ctx)
+			// Цикл жив, даже если Telegram вернул ошибку: /readyz покажет её отдельно
+			health.Heartbeat()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("Ошибка получения обновлений", "error", err)
+				// Задержка перед повтором, чтобы не спамить запросами
+				time.Sleep(5 * time.Second)
+				continue
+			}
+
+			metricUpdatesReceived.Add(float64(len(updates)))
+			metricQueueDepth.Set(float64(len(updates)))
+
+			// Обрабатываем каждое обновление
+			for _, update := range updates {
+				metricQueueDepth.Add(-1)
+				if update.UpdateID > bot.LastUpdate {
+					bot.LastUpdate = update.UpdateID
+				}
+
+				// Идентификатор корреляции связывает все записи лога по этому обновлению
+				updateCtx := withCorrelationID(ctx)
+				slog.DebugContext(updateCtx, "Получено обновление", "update_id", update.UpdateID)
+				done := health.Handling()
+				bot.HandleUpdate(updateCtx, update)
+				done()
+			}
+		}
+	}
 }
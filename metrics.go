@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Минимальная реализация метрик в текстовом формате Prometheus
+// без внешних зависимостей.
+
+// metric общий интерфейс для вывода метрики
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricRegistry хранит зарегистрированные метрики в порядке добавления
+type metricRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *metricRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP отдаёт все метрики в текстовом формате Prometheus
+func (r *metricRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// helpEscaper и labelEscaper экранируют текст HELP и значения меток.
+// Формат Prometheus допускает только эти escape-последовательности и требует
+// UTF-8, поэтому strconv.Quote (\t, \x..) здесь не подходит.
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// writeHeader выводит строки HELP и TYPE
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, typ)
+}
+
+// formatLabels форматирует метки в виде {a="1",b="2"}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(strings.ToValidUTF8(values[i], "\uFFFD")) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat форматирует значение так, как его ожидает Prometheus
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec счётчик с метками; без меток ведёт себя как обычный счётчик
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+	metrics.register(c)
+	return c
+}
+
+// Inc увеличивает счётчик для заданных значений меток на единицу
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add увеличивает счётчик для заданных значений меток
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+	c.keys[key] = labelValues
+}
+
+// Value возвращает текущее значение счётчика для заданных значений меток
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\x00")]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.keys[k]), formatFloat(c.values[k]))
+	}
+}
+
+// Gauge значение, которое может расти и уменьшаться
+type Gauge struct {
+	name  string
+	help  string
+	mu    sync.Mutex
+	value float64
+}
+
+func newGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	metrics.register(g)
+	return g
+}
+
+// Set устанавливает значение
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = v
+}
+
+// Add изменяет значение на v (может быть отрицательным)
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value += v
+}
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+}
+
+// Histogram гистограмма с фиксированными границами корзин
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	metrics.register(h)
+	return h
+}
+
+// Observe добавляет наблюдение
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// metrics реестр метрик бота, отдаётся по /metrics
+var metrics = &metricRegistry{}
+
+// Метрики бота
+var (
+	metricUpdatesReceived = newCounter("bot_updates_received_total",
+		"Количество полученных обновлений Telegram")
+	metricMessagesHandled = newCounter("bot_messages_handled_total",
+		"Количество обработанных сообщений по типу", "type")
+	metricRateLimited = newCounter("bot_rate_limit_rejections_total",
+		"Количество запросов, отклонённых rate limiting")
+	metricUnauthorized = newCounter("bot_unauthorized_attempts_total",
+		"Количество запросов от неавторизованных пользователей")
+	metricTelegramErrors = newCounter("bot_telegram_api_errors_total",
+		"Ошибки Telegram API по методу и статусу", "method", "status")
+	metricOllamaErrors = newCounter("bot_ollama_errors_total",
+		"Количество ошибок запросов к Ollama")
+	metricOllamaLatency = newHistogram("bot_ollama_request_duration_seconds",
+		"Длительность запросов к Ollama в секундах",
+		[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 480})
+	metricTokensPerSecond = newHistogram("bot_ollama_tokens_per_second",
+		"Скорость генерации токенов Ollama",
+		[]float64{1, 2, 5, 10, 20, 50, 100, 200})
+	metricQueueDepth = newGauge("bot_queue_depth",
+		"Количество полученных обновлений, ожидающих обработки")
+	metricInFlight = newGauge("bot_ollama_inflight_generations",
+		"Количество выполняющихся генераций Ollama")
+	metricToolCalls = newCounter("bot_tool_calls_total",
+		"Вызовы инструментов моделью по имени и результату (ok, error, unknown)", "tool", "status")
+	metricTranscriptions = newCounter("bot_transcriptions_total",
+		"Распознавания голосовых сообщений по результату (ok, empty, error)", "status")
+	metricScheduledRuns = newCounter("bot_scheduled_runs_total",
+		"Запуски запланированных запросов по результату (ok, error, quota, denied)", "status")
+	metricTemplatesUsed = newCounter("bot_templates_used_total",
+		"Применения шаблонов промптов по признаку общего шаблона", "shared")
+	metricCompareAnswers = newCounter("bot_compare_answers_total",
+		"Ответы моделей в /compare по модели и результату (ok, error)", "model", "status")
+	metricCompareVotes = newCounter("bot_compare_votes_total",
+		"Голоса за лучший ответ в /compare по модели", "model")
+	metricSummaries = newCounter("bot_history_summaries_total",
+		"Суммаризации вытесненной истории по результату (ok, error)", "status")
+	metricHTTPConnections = newCounter("bot_http_connections_total",
+		"HTTP-соединения, полученные запросами, по направлению и признаку переиспользования", "upstream", "reused")
+)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// metricsGolden ожидаемый вывод /metrics для метрик из TestMetricsExposition
+const metricsGolden = `# HELP test_events_total События без меток
+# TYPE test_events_total counter
+test_events_total 0
+# HELP test_requests_total Запросы по модели и статусу,\nс переносом и \\ в описании
+# TYPE test_requests_total counter
+test_requests_total{model="llama3.2",status="ok"} 3
+test_requests_total{model="qwen\"2\"\\7b\nnext",status="error"} 1
+test_requests_total{model="tab	и кириллица",status="ok"} 0.5
+test_requests_total{model="�bad",status="ok"} 1
+# HELP test_inflight Текущие запросы
+# TYPE test_inflight gauge
+test_inflight -1.5
+# HELP test_duration_seconds Длительность
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.5"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 3.75
+test_duration_seconds_count 3
+`
+
+func TestMetricsExposition(t *testing.T) {
+	// Метрики теста регистрируются в отдельном реестре, а не в реестре бота
+	saved := metrics
+	metrics = &metricRegistry{}
+	defer func() { metrics = saved }()
+
+	newCounter("test_events_total", "События без меток")
+	requests := newCounter("test_requests_total", "Запросы по модели и статусу,\nс переносом и \\ в описании", "model", "status")
+	requests.Add(3, "llama3.2", "ok")
+	requests.Inc("qwen\"2\"\\7b\nnext", "error")
+	requests.Add(0.5, "tab\tи кириллица", "ok")
+	requests.Inc("\xffbad", "ok")
+	inflight := newGauge("test_inflight", "Текущие запросы")
+	inflight.Set(1)
+	inflight.Add(-2.5)
+	duration := newHistogram("test_duration_seconds", "Длительность", []float64{0.5, 1})
+	for _, v := range []float64{0.25, 1, 2.5} {
+		duration.Observe(v)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if got := rec.Body.String(); got != metricsGolden {
+		t.Errorf("вывод /metrics отличается от эталона:\n%s\nожидалось:\n%s", got, metricsGolden)
+	}
+}
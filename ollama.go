@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,26 +19,91 @@ type OllamaRequest struct {
 	Model  string `json:"model"`
 	Prompt string `json:"prompt"`
 	Stream bool   `json:"stream"`
+	// Format "json" или JSON Schema, которой должен соответствовать ответ
+	Format json.RawMessage `json:"format,omitempty"`
 }
 
-// OllamaResponse структура для ответа от Ollama API
+// ChatMessage сообщение диалога для /api/chat
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// ToolCalls вызовы инструментов, которые запросила модель
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolName имя инструмента в сообщении с его результатом (role "tool")
+	ToolName string `json:"tool_name,omitempty"`
+
+	// turn номер обмена репликами в истории чата (не передаётся в Ollama)
+	turn int64
+}
+
+// ToolCall вызов инструмента, запрошенный моделью
+type ToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// ToolSpec описание инструмента для модели в формате Ollama
+type ToolSpec struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
+}
+
+// OllamaChatRequest структура для запроса к /api/chat
+type OllamaChatRequest struct {
+	Model    string         `json:"model"`
+	Messages []ChatMessage  `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Options  map[string]any `json:"options,omitempty"`
+	Tools    []ToolSpec     `json:"tools,omitempty"`
+	// Format "json" или JSON Schema, которой должен соответствовать ответ
+	Format json.RawMessage `json:"format,omitempty"`
+}
+
+// OllamaResponse структура для ответа от Ollama API (/api/generate и /api/chat)
 type OllamaResponse struct {
-	Model     string    `json:"model"`
-	CreatedAt string    `json:"created_at"`
-	Response  string    `json:"response"`
-	Done      bool      `json:"done"`
-	Error     string    `json:"error,omitempty"`
-	Context   []int     `json:"context,omitempty"`
+	Model      string       `json:"model"`
+	CreatedAt  string       `json:"created_at"`
+	Response   string       `json:"response"`
+	Message    *ChatMessage `json:"message,omitempty"`
+	Done       bool         `json:"done"`
+	DoneReason string       `json:"done_reason,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Context    []int        `json:"context,omitempty"`
+
+	// Статистика генерации (длительности в наносекундах)
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalCount    int   `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int   `json:"eval_count,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
 }
 
 // OllamaClient клиент для работы с Ollama API
 type OllamaClient struct {
 	URL   string
 	Model string
+
+	// Client общий HTTP-клиент запросов к Ollama с пулом соединений, прокси
+	// и IPv4-only. Таймауты задаются контекстом запроса. Флаг --stub подменяет
+	// его транспорт поддельным сервером.
+	Client *http.Client
+
+	// slots ограничивает число одновременных генераций (OLLAMA_MAX_CONCURRENCY):
+	// обработчики сообщений и планировщик ждут свободного места, а не перегружают Ollama
+	slots chan struct{}
 }
 
-// NewOllamaClient создает новый клиент Ollama с настройками из переменных окружения
-func NewOllamaClient() *OllamaClient {
+// NewOllamaClient создает новый клиент Ollama с настройками из переменных окружения.
+// Ошибка в настройках прокси, TLS или адресе сервера возвращается, а не заменяется
+// значениями по умолчанию: бот не должен молча подключаться иначе, чем настроено.
+func NewOllamaClient() (*OllamaClient, error) {
 	url := os.Getenv("OLLAMA_URL")
 	if url == "" {
 		// Значение по умолчанию - localhost, так как бот обычно запускается на той же машине
@@ -47,7 +114,7 @@ func NewOllamaClient() *OllamaClient {
 	if strings.HasPrefix(url, "http://") &&
 		!strings.Contains(url, "localhost") &&
 		!strings.Contains(url, "127.0.0.1") {
-		log.Printf("ВНИМАНИЕ: соединение с Ollama по незашифрованному HTTP к удалённому серверу (%s). Рекомендуется использовать HTTPS.", url)
+		slog.Warn("Соединение с Ollama по незашифрованному HTTP к удалённому серверу. Рекомендуется использовать HTTPS.", "url", url)
 	}
 
 	model := os.Getenv("OLLAMA_MODEL")
@@ -55,63 +122,266 @@ func NewOllamaClient() *OllamaClient {
 		model = "gemma3:1b"
 	}
 
-	return &OllamaClient{
-		URL:   url,
-		Model: model,
+	// TLS, авторизация и дополнительные заголовки для Ollama за обратным прокси
+	proxy, err := proxyFromEnv("ollama")
+	if err != nil {
+		return nil, err
+	}
+	transport := newTransport(proxy, 8)
+	tlsConfig, err := ollamaTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	client, err := newHeaderTransport(ollamaHeaders(), url, transport)
+	if err != nil {
+		return nil, err
 	}
+
+	concurrency := 2
+	if v := os.Getenv("OLLAMA_MAX_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			concurrency = n
+		}
+	}
+
+	return &OllamaClient{
+		URL:    url,
+		Model:  model,
+		Client: newHTTPClient("ollama", client),
+		slots:  make(chan struct{}, concurrency),
+	}, nil
 }
 
 // SendPrompt отправляет запрос к Ollama API и возвращает ответ
-func (c *OllamaClient) SendPrompt(prompt string) (string, error) {
-	reqBody := OllamaRequest{
+func (c *OllamaClient) SendPrompt(ctx context.Context, prompt string) (string, error) {
+	resp, err := c.Generate(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return resp.Response, nil
+}
+
+// Generate отправляет запрос к Ollama API и возвращает полный ответ
+// вместе со статистикой токенов и длительностей
+func (c *OllamaClient) Generate(ctx context.Context, prompt string) (*OllamaResponse, error) {
+	slog.DebugContext(ctx, "Запрос к Ollama", "model", c.Model, "prompt_length", len(prompt))
+	return c.do(ctx, "/api/generate", OllamaRequest{
 		Model:  c.Model,
 		Prompt: prompt,
 		Stream: false,
+	})
+}
+
+// Chat отправляет историю диалога в /api/chat и возвращает ответ модели.
+// Текст ответа дублируется в поле Response для единообразия с Generate.
+func (c *OllamaClient) Chat(ctx context.Context, messages []ChatMessage) (*OllamaResponse, error) {
+	return c.ChatWithOptions(ctx, messages, nil)
+}
+
+// ChatWithOptions как Chat, но с параметрами генерации Ollama (seed, temperature и т.п.)
+func (c *OllamaClient) ChatWithOptions(ctx context.Context, messages []ChatMessage, options map[string]any) (*OllamaResponse, error) {
+	return c.ChatWithTools(ctx, messages, options, nil)
+}
+
+// ChatWithTools как ChatWithOptions, но с описаниями инструментов, которые может
+// вызвать модель. Запрошенные вызовы возвращаются в resp.Message.ToolCalls.
+func (c *OllamaClient) ChatWithTools(ctx context.Context, messages []ChatMessage, options map[string]any, tools []ToolSpec) (*OllamaResponse, error) {
+	return c.chat(ctx, OllamaChatRequest{Messages: messages, Options: options, Tools: tools})
+}
+
+// ChatModel как ChatWithOptions, но запрос выполняет модель model, а не модель клиента
+func (c *OllamaClient) ChatModel(ctx context.Context, model string, messages []ChatMessage, options map[string]any) (*OllamaResponse, error) {
+	return c.chat(ctx, OllamaChatRequest{Model: model, Messages: messages, Options: options})
+}
+
+// chat отправляет запрос к /api/chat без потоковой передачи; если модель
+// в запросе не указана, используется модель клиента
+func (c *OllamaClient) chat(ctx context.Context, req OllamaChatRequest) (*OllamaResponse, error) {
+	if req.Model == "" {
+		req.Model = c.Model
+	}
+	req.Stream = false
+	slog.DebugContext(ctx, "Запрос к Ollama (chat)", "model", req.Model, "messages", len(req.Messages), "tools", len(req.Tools), "format", len(req.Format) > 0)
+	resp, err := c.do(ctx, "/api/chat", req)
+	if err != nil {
+		return nil, err
 	}
+	if resp.Message != nil {
+		resp.Response = resp.Message.Content
+	}
+	return resp, nil
+}
 
+// do выполняет запрос генерации и учитывает его в метриках
+func (c *OllamaClient) do(ctx context.Context, path string, reqBody any) (*OllamaResponse, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("ожидание свободного места для генерации: %w", ctx.Err())
+	}
+	defer func() { <-c.slots }()
+
+	metricInFlight.Add(1)
+	defer metricInFlight.Add(-1)
+
+	start := time.Now()
+	resp, err := c.post(ctx, path, reqBody)
+	metricOllamaLatency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricOllamaErrors.Inc()
+		return nil, err
+	}
+	if resp.EvalDuration > 0 {
+		metricTokensPerSecond.Observe(float64(resp.EvalCount) / time.Duration(resp.EvalDuration).Seconds())
+	}
+	return resp, nil
+}
+
+// post выполняет HTTP-запрос к эндпоинту генерации Ollama
+func (c *OllamaClient) post(ctx context.Context, path string, reqBody any) (*OllamaResponse, error) {
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("ошибка сериализации запроса: %w", err)
+		return nil, fmt.Errorf("ошибка сериализации запроса: %w", err)
 	}
 
-	url := c.URL + "/api/generate"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	// Таймаут 8 минут для генерации
+	ctx, cancel := context.WithTimeout(ctx, 480*time.Second)
+	defer cancel()
+
+	url := c.URL + path
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", fmt.Errorf("ошибка создания HTTP запроса: %w", err)
+		return nil, fmt.Errorf("ошибка создания HTTP запроса: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := newHTTPClient(480 * time.Second) // Таймаут 8 минут для генерации
-
-	resp, err := client.Do(req)
+	resp, err := c.Client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("ошибка выполнения HTTP запроса: %w", err)
+		return nil, fmt.Errorf("ошибка выполнения HTTP запроса: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
-		return "", fmt.Errorf("Ollama API вернул статус %d: %s", resp.StatusCode, string(bodyBytes))
+		return nil, fmt.Errorf("Ollama API вернул статус %d: %s", resp.StatusCode, string(bodyBytes))
 	}
 
 	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
 	if err != nil {
-		return "", fmt.Errorf("ошибка чтения ответа: %w", err)
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
 	}
 
 	var ollamaResp OllamaResponse
 	if err := json.Unmarshal(body, &ollamaResp); err != nil {
-		return "", fmt.Errorf("ошибка парсинга JSON ответа: %w", err)
+		return nil, fmt.Errorf("ошибка парсинга JSON ответа: %w", err)
 	}
 
 	if ollamaResp.Error != "" {
-		return "", fmt.Errorf("ошибка от Ollama: %s", ollamaResp.Error)
+		return nil, fmt.Errorf("ошибка от Ollama: %s", ollamaResp.Error)
 	}
 
 	if !ollamaResp.Done {
-		return "", fmt.Errorf("ответ от Ollama не завершен")
+		return nil, fmt.Errorf("ответ от Ollama не завершен")
+	}
+
+	return &ollamaResp, nil
+}
+
+// OllamaTagsResponse ответ /api/tags со списком установленных моделей
+type OllamaTagsResponse struct {
+	Models []struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	} `json:"models"`
+}
+
+// HasModel проверяет доступность Ollama и наличие настроенной модели
+func (c *OllamaClient) HasModel(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/api/tags", nil)
+	if err != nil {
+		return false, fmt.Errorf("ошибка создания HTTP запроса: %w", err)
 	}
 
-	return ollamaResp.Response, nil
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("ошибка выполнения HTTP запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Ollama API вернул статус %d", resp.StatusCode)
+	}
+
+	var tags OllamaTagsResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&tags); err != nil {
+		return false, fmt.Errorf("ошибка парсинга JSON ответа: %w", err)
+	}
+
+	// Модель без тега в Ollama соответствует тегу latest
+	want := c.Model
+	if !strings.Contains(want, ":") {
+		want += ":latest"
+	}
+	for _, m := range tags.Models {
+		if m.Name == want || m.Model == want {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// OllamaShowResponse ответ /api/show с параметрами модели
+type OllamaShowResponse struct {
+	Parameters string         `json:"parameters"`
+	ModelInfo  map[string]any `json:"model_info"`
+}
+
+// ContextLength возвращает размер контекстного окна модели из /api/show.
+// Приоритет у параметра num_ctx из Modelfile; если он не задан, возвращается 0,
+// так как Ollama по умолчанию не использует полную длину контекста архитектуры.
+func (c *OllamaClient) ContextLength(ctx context.Context) (int, error) {
+	jsonData, err := json.Marshal(map[string]string{"model": c.Model})
+	if err != nil {
+		return 0, fmt.Errorf("ошибка сериализации запроса: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.URL+"/api/show", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, fmt.Errorf("ошибка создания HTTP запроса: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка выполнения HTTP запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Ollama API вернул статус %d", resp.StatusCode)
+	}
+
+	var show OllamaShowResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&show); err != nil {
+		return 0, fmt.Errorf("ошибка парсинга JSON ответа: %w", err)
+	}
+
+	// parameters — строки вида "num_ctx 8192"
+	for _, line := range strings.Split(show.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "num_ctx" {
+			if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+				return n, nil
+			}
+		}
+	}
+	return 0, nil
 }
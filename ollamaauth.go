@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ollamaTLSConfig собирает настройки TLS для Ollama из окружения:
+// OLLAMA_CA_FILE — дополнительные корневые сертификаты (PEM) к системным,
+// OLLAMA_CLIENT_CERT и OLLAMA_CLIENT_KEY — клиентский сертификат для mTLS.
+// Возвращает nil, если ничего не задано.
+func ollamaTLSConfig() (*tls.Config, error) {
+	caFile := strings.TrimSpace(os.Getenv("OLLAMA_CA_FILE"))
+	certFile := strings.TrimSpace(os.Getenv("OLLAMA_CLIENT_CERT"))
+	keyFile := strings.TrimSpace(os.Getenv("OLLAMA_CLIENT_KEY"))
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения OLLAMA_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("в OLLAMA_CA_FILE нет сертификатов в формате PEM")
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("OLLAMA_CLIENT_CERT и OLLAMA_CLIENT_KEY задаются вместе")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка загрузки клиентского сертификата: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	slog.Info("Настроен TLS для Ollama", "ca_file", caFile, "client_cert", certFile)
+	return config, nil
+}
+
+// ollamaHeaders собирает заголовки, которые добавляются к каждому запросу к Ollama:
+// OLLAMA_AUTH_TOKEN — Authorization: Bearer, OLLAMA_AUTH_USER и OLLAMA_AUTH_PASSWORD —
+// Basic-авторизация, OLLAMA_HEADERS — произвольные заголовки "Имя: значение" через запятую
+// (см. splitHeaderList).
+// Секретные значения регистрируются в logRedactor.
+func ollamaHeaders() http.Header {
+	header := make(http.Header)
+
+	for _, item := range splitHeaderList(os.Getenv("OLLAMA_HEADERS")) {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			slog.Error("Некорректный заголовок в OLLAMA_HEADERS, ожидается \"Имя: значение\"", "header", name)
+			continue
+		}
+		if isSecretHeader(name) {
+			logRedactor.Add(value)
+		}
+		header.Add(name, value)
+	}
+
+	token := strings.TrimSpace(os.Getenv("OLLAMA_AUTH_TOKEN"))
+	user := os.Getenv("OLLAMA_AUTH_USER")
+	password := os.Getenv("OLLAMA_AUTH_PASSWORD")
+	switch {
+	case token != "":
+		if user != "" {
+			slog.Warn("Заданы OLLAMA_AUTH_TOKEN и OLLAMA_AUTH_USER, используется токен")
+		}
+		logRedactor.Add(token)
+		header.Set("Authorization", "Bearer "+token)
+	case user != "":
+		credentials := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		logRedactor.Add(password)
+		logRedactor.Add(credentials)
+		header.Set("Authorization", "Basic "+credentials)
+	}
+
+	return header
+}
+
+// isSecretHeader определяет по имени, содержит ли заголовок секрет,
+// который нужно скрывать в логах
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	if name == "authorization" || name == "proxy-authorization" || name == "cookie" {
+		return true
+	}
+	for _, word := range []string{"key", "token", "secret", "auth", "password"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTransport добавляет заданные заголовки к каждому запросу к host.
+// Запросы к другим хостам (например, после перенаправления) уходят без них,
+// чтобы не раскрыть учётные данные. Заголовки, уже выставленные в запросе,
+// не перезаписываются.
+type headerTransport struct {
+	header http.Header
+	host   string
+	base   http.RoundTripper
+}
+
+// newHeaderTransport оборачивает base для запросов к хосту из baseURL;
+// без заголовков возвращает base как есть
+func newHeaderTransport(header http.Header, baseURL string, base http.RoundTripper) (http.RoundTripper, error) {
+	if len(header) == 0 {
+		return base, nil
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("некорректный OLLAMA_URL %q", baseURL)
+	}
+	return &headerTransport{header: header, host: u.Host, base: base}, nil
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Host, t.host) {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTripper не должен изменять исходный запрос
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		if req.Header.Get(name) == "" {
+			req.Header[name] = values
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// splitHeaderList делит список заголовков "Имя: значение" по запятым, за которыми
+// следует имя очередного заголовка с двоеточием. Запятые внутри значений
+// (например, "Accept: text/plain, application/json") разделителями не считаются.
+func splitHeaderList(list string) []string {
+	var items []string
+	start := 0
+	for i := 0; i < len(list); i++ {
+		if list[i] == ',' && startsWithHeaderName(list[i+1:]) {
+			items = append(items, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, list[start:])
+}
+
+// startsWithHeaderName проверяет, что строка после пробелов начинается
+// с имени заголовка (token из RFC 9110), за которым идёт двоеточие
+func startsWithHeaderName(s string) bool {
+	s = strings.TrimLeft(s, " \t")
+	n := 0
+	for n < len(s) && isTokenChar(s[n]) {
+		n++
+	}
+	return n > 0 && strings.HasPrefix(strings.TrimLeft(s[n:], " \t"), ":")
+}
+
+// isTokenChar проверяет, что байт допустим в имени HTTP-заголовка
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestOllamaHeadersList(t *testing.T) {
+	tests := []struct {
+		env  string
+		want http.Header
+	}{
+		{"", http.Header{}},
+		{"X-Tenant: bot", http.Header{"X-Tenant": {"bot"}}},
+		{"X-Tenant: bot, X-Api-Key: abc123", http.Header{"X-Tenant": {"bot"}, "X-Api-Key": {"abc123"}}},
+		{"Accept: text/plain, application/json", http.Header{"Accept": {"text/plain, application/json"}}},
+		{
+			"Forwarded: for=1.2.3.4, for=5.6.7.8,X-Tenant:bot",
+			http.Header{"Forwarded": {"for=1.2.3.4, for=5.6.7.8"}, "X-Tenant": {"bot"}},
+		},
+		{"X-Date: Tue, 15 Nov 1994 08:12:31 GMT", http.Header{"X-Date": {"Tue, 15 Nov 1994 08:12:31 GMT"}}},
+		{"X-A: 1,, X-B: 2", http.Header{"X-A": {"1,"}, "X-B": {"2"}}},
+		{"без двоеточия, X-B: 2", http.Header{"X-B": {"2"}}},
+	}
+	for _, tt := range tests {
+		t.Setenv("OLLAMA_HEADERS", tt.env)
+		t.Setenv("OLLAMA_AUTH_TOKEN", "")
+		t.Setenv("OLLAMA_AUTH_USER", "")
+		if got := ollamaHeaders(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("OLLAMA_HEADERS=%q: %v, ожидалось %v", tt.env, got, tt.want)
+		}
+	}
+}
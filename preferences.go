@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// UserPrefs настройки, которые пользователь выбрал командами бота
+type UserPrefs struct {
+	// Lang язык интерфейса, выбранный через /lang; пустая строка — язык из настроек Telegram
+	Lang string `json:"lang,omitempty"`
+	// Timezone часовой пояс для /schedule, выбранный через /timezone; пустая строка — DEFAULT_TIMEZONE
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// ChatPrefs настройки чата, общие для всех его участников
+type ChatPrefs struct {
+	// Tools "on" или "off", выбранные через /tools; пустая строка — значение TOOLS_ENABLED
+	Tools string `json:"tools,omitempty"`
+}
+
+// prefsFile формат файла настроек
+type prefsFile struct {
+	Users map[int64]UserPrefs `json:"users"`
+	Chats map[int64]ChatPrefs `json:"chats"`
+}
+
+// PreferencesStore хранит настройки пользователей и чатов в JSON-файле,
+// чтобы они переживали перезапуск
+type PreferencesStore struct {
+	path  string
+	users map[int64]UserPrefs
+	chats map[int64]ChatPrefs
+	mu    sync.Mutex
+}
+
+// NewPreferencesStore создаёт хранилище настроек из PREFS_FILE
+// и загружает ранее сохранённые данные
+func NewPreferencesStore() *PreferencesStore {
+	path := os.Getenv("PREFS_FILE")
+	if path == "" {
+		path = "prefs.json"
+	}
+
+	s := &PreferencesStore{
+		path:  path,
+		users: make(map[int64]UserPrefs),
+		chats: make(map[int64]ChatPrefs),
+	}
+	if err := s.load(); err != nil {
+		slog.Error("Ошибка загрузки настроек пользователей", "path", path, "error", err)
+	}
+	return s
+}
+
+// Get возвращает настройки пользователя
+func (s *PreferencesStore) Get(userID int64) UserPrefs {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[userID]
+}
+
+// Update изменяет настройки пользователя функцией fn и сохраняет их
+func (s *PreferencesStore) Update(userID int64, fn func(p *UserPrefs)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.users[userID]
+	fn(&p)
+	if p == (UserPrefs{}) {
+		delete(s.users, userID)
+	} else {
+		s.users[userID] = p
+	}
+
+	if err := s.save(); err != nil {
+		slog.Error("Ошибка сохранения настроек пользователей", "path", s.path, "error", err)
+	}
+}
+
+// GetChat возвращает настройки чата
+func (s *PreferencesStore) GetChat(chatID int64) ChatPrefs {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chats[chatID]
+}
+
+// UpdateChat изменяет настройки чата функцией fn и сохраняет их
+func (s *PreferencesStore) UpdateChat(chatID int64, fn func(p *ChatPrefs)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.chats[chatID]
+	fn(&p)
+	if p == (ChatPrefs{}) {
+		delete(s.chats, chatID)
+	} else {
+		s.chats[chatID] = p
+	}
+
+	if err := s.save(); err != nil {
+		slog.Error("Ошибка сохранения настроек пользователей", "path", s.path, "error", err)
+	}
+}
+
+// load читает настройки из файла; отсутствие файла не является ошибкой
+func (s *PreferencesStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file prefsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	if file.Users != nil {
+		s.users = file.Users
+	}
+	if file.Chats != nil {
+		s.chats = file.Chats
+	}
+	return nil
+}
+
+// save записывает настройки в файл. Вызывается под s.mu.
+func (s *PreferencesStore) save() error {
+	data, err := json.MarshalIndent(prefsFile{Users: s.users, Chats: s.chats}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreferencesFileLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefs.json")
+	t.Setenv("PREFS_FILE", path)
+
+	store := NewPreferencesStore()
+	store.Update(42, func(p *UserPrefs) { p.Lang = "en" })
+	store.UpdateChat(-100, func(p *ChatPrefs) { p.Tools = "on" })
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "users": {
+    "42": {
+      "lang": "en"
+    }
+  },
+  "chats": {
+    "-100": {
+      "tools": "on"
+    }
+  }
+}`
+	if string(data) != want {
+		t.Errorf("файл настроек:\n%s\nожидалось:\n%s", data, want)
+	}
+
+	reloaded := NewPreferencesStore()
+	if reloaded.Get(42).Lang != "en" || reloaded.GetChat(-100).Tools != "on" {
+		t.Errorf("настройки не сохранились: %+v %+v", reloaded.Get(42), reloaded.GetChat(-100))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// proxyFromEnv возвращает функцию выбора прокси для направления upstream
+// ("telegram" или "ollama") по переменной <UPSTREAM>_PROXY.
+// Поддерживаются http://, https://, socks5:// и socks5h:// с логином и паролем в URL.
+// Хосты из PROXY_BYPASS и loopback-адреса подключаются напрямую.
+// Если переменная не задана, используются стандартные HTTPS_PROXY/HTTP_PROXY/NO_PROXY.
+// Некорректный адрес — ошибка конфигурации: в сетях, где прямые соединения
+// запрещены, бот не должен молча обходить прокси.
+func proxyFromEnv(upstream string) (func(*http.Request) (*url.URL, error), error) {
+	name := strings.ToUpper(upstream) + "_PROXY"
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := parseProxyURL(raw)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный адрес прокси в %s: %w", name, err)
+	}
+
+	// Пароль прокси скрывается во всех записях лога
+	if password, ok := proxyURL.User.Password(); ok {
+		logRedactor.Add(password)
+	}
+
+	bypass := parseProxyBypass(os.Getenv("PROXY_BYPASS"))
+	slog.Info("Настроен прокси", "upstream", upstream, "proxy", proxyURL.Redacted())
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass.match(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// parseProxyURL разбирает и проверяет адрес прокси
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("неподдерживаемая схема %q: используйте http, https, socks5 или socks5h", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("не указан адрес прокси-сервера")
+	}
+	return proxyURL, nil
+}
+
+// proxyBypass список хостов, которые подключаются в обход прокси
+type proxyBypass struct {
+	all     bool
+	domains []string
+	nets    []*net.IPNet
+}
+
+// parseProxyBypass разбирает PROXY_BYPASS: через запятую перечисляются домены
+// (вместе с поддоменами), IP-адреса, подсети в формате CIDR или "*" для всех хостов
+func parseProxyBypass(v string) proxyBypass {
+	var b proxyBypass
+	for _, item := range strings.Split(v, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if item == "*" {
+			b.all = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(item); err == nil {
+			b.nets = append(b.nets, ipNet)
+			continue
+		}
+		if host, _, err := net.SplitHostPort(item); err == nil {
+			item = host
+		}
+		if ip := net.ParseIP(item); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			b.nets = append(b.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		b.domains = append(b.domains, strings.TrimPrefix(item, "."))
+	}
+	return b
+}
+
+// match проверяет, нужно ли подключаться к хосту напрямую
+func (b proxyBypass) match(host string) bool {
+	host = strings.ToLower(host)
+	if b.all || host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, n := range b.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range b.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // часовые пояса доступны и без системной базы zoneinfo
+)
+
+// Виды расписаний
+const (
+	scheduleOnce     = "once"
+	scheduleDaily    = "daily"
+	scheduleWeekdays = "weekdays"
+	scheduleWeekly   = "weekly"
+)
+
+// scheduleTick период проверки расписаний планировщиком
+const scheduleTick = 15 * time.Second
+
+// Schedule запланированный запрос к модели
+type Schedule struct {
+	ID     int64 `json:"id"`
+	ChatID int64 `json:"chat_id"`
+	UserID int64 `json:"user_id"`
+	// Lang язык пользователя на момент создания; выбранный через /lang важнее
+	Lang string `json:"lang,omitempty"`
+	Kind string `json:"kind"`
+	// Clock время запуска "ЧЧ:ММ" для повторяющихся расписаний
+	Clock   string       `json:"clock,omitempty"`
+	Weekday time.Weekday `json:"weekday,omitempty"`
+	// Timezone часовой пояс, в котором задано время
+	Timezone string    `json:"timezone"`
+	Prompt   string    `json:"prompt"`
+	NextRun  time.Time `json:"next_run"`
+	Created  time.Time `json:"created"`
+}
+
+// location возвращает часовой пояс расписания
+func (s Schedule) location() *time.Location {
+	loc, err := loadTimezone(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// next возвращает время следующего запуска после after; для однократного
+// расписания — нулевое время. Время считается в часовом поясе расписания,
+// поэтому переход на летнее время не сдвигает запуск. Несуществующее
+// из-за перевода часов время переносится вперёд.
+func (s Schedule) next(after time.Time) time.Time {
+	if s.Kind == scheduleOnce {
+		return time.Time{}
+	}
+	hour, minute, err := parseClock(s.Clock)
+	if err != nil {
+		return time.Time{}
+	}
+	local := after.In(s.location())
+	for d := 0; d <= 7; d++ {
+		t := time.Date(local.Year(), local.Month(), local.Day()+d, hour, minute, 0, 0, local.Location())
+		if !t.After(after) {
+			continue
+		}
+		switch s.Kind {
+		case scheduleWeekdays:
+			if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+				continue
+			}
+		case scheduleWeekly:
+			if t.Weekday() != s.Weekday {
+				continue
+			}
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// describe описывает расписание на языке lang
+func (s Schedule) describe(lang string) string {
+	next := s.NextRun.In(s.location()).Format("2006-01-02 15:04")
+	var when string
+	switch s.Kind {
+	case scheduleDaily:
+		when = T(lang, "schedule_daily", s.Clock)
+	case scheduleWeekdays:
+		when = T(lang, "schedule_weekdays", s.Clock)
+	case scheduleWeekly:
+		when = T(lang, "schedule_weekly", weekdayName(lang, s.Weekday), s.Clock)
+	default:
+		when = T(lang, "schedule_once")
+	}
+	return T(lang, "schedule_item", s.ID, when, next, s.Timezone, truncate(s.Prompt, 60))
+}
+
+// weekdayName возвращает краткое название дня недели на языке lang
+func weekdayName(lang string, day time.Weekday) string {
+	names := strings.Split(T(lang, "weekdays_short"), ",")
+	if int(day) < len(names) {
+		return names[day]
+	}
+	return day.String()
+}
+
+// weekdayNames названия дней недели, принимаемые /schedule weekly
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday, "вс": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday, "пн": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday, "вт": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday, "ср": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday, "чт": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday, "пт": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday, "сб": time.Saturday,
+}
+
+// parseClock разбирает время "ЧЧ:ММ"
+func parseClock(s string) (hour, minute int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("время %q должно быть в формате ЧЧ:ММ", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// loadTimezone загружает часовой пояс по имени IANA (Europe/Moscow)
+// или по смещению от UTC (UTC+3, UTC-05:30, +03:00)
+func loadTimezone(name string) (*time.Location, error) {
+	offset := strings.TrimPrefix(strings.ToUpper(name), "UTC")
+	offset = strings.TrimPrefix(offset, "GMT")
+	if offset != "" && (offset[0] == '+' || offset[0] == '-') {
+		sign := 1
+		if offset[0] == '-' {
+			sign = -1
+		}
+		h, m, found := strings.Cut(offset[1:], ":")
+		hours, err := strconv.Atoi(h)
+		minutes := 0
+		if err == nil && found {
+			minutes, err = strconv.Atoi(m)
+		}
+		if err != nil || hours < 0 || hours > 14 || minutes < 0 || minutes >= 60 {
+			return nil, fmt.Errorf("некорректное смещение %q", name)
+		}
+		return time.FixedZone(name, sign*(hours*3600+minutes*60)), nil
+	}
+	if name == "" || strings.EqualFold(name, "local") {
+		return nil, fmt.Errorf("часовой пояс не указан")
+	}
+	return time.LoadLocation(name)
+}
+
+// defaultTimezone часовой пояс пользователей, не выбравших его через /timezone,
+// из DEFAULT_TIMEZONE (по умолчанию UTC)
+func defaultTimezone() string {
+	if v := os.Getenv("DEFAULT_TIMEZONE"); v != "" {
+		if _, err := loadTimezone(v); err == nil {
+			return v
+		}
+		slog.Warn("Некорректный DEFAULT_TIMEZONE, используется UTC", "value", v)
+	}
+	return "UTC"
+}
+
+// errScheduleUsage ошибка разбора /schedule, в ответ на которую показывается справка
+var errScheduleUsage = errors.New("неверный формат расписания")
+
+// parseSchedule разбирает аргументы /schedule: вид расписания, время и запрос.
+// Время задаётся в часовом поясе timezone, now — текущее время.
+//
+//	daily 09:00 <запрос>
+//	weekdays 09:00 <запрос>
+//	weekly mon 09:00 <запрос>
+//	at [2026-01-31] 18:30 <запрос>
+//	in 30m <запрос>
+func parseSchedule(args, timezone string, now time.Time) (Schedule, error) {
+	loc, err := loadTimezone(timezone)
+	if err != nil {
+		return Schedule{}, err
+	}
+	fields := strings.Fields(args)
+	// take отрезает от аргументов следующее слово
+	take := func() string {
+		if len(fields) == 0 {
+			return ""
+		}
+		word := fields[0]
+		fields = fields[1:]
+		args = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args), word))
+		return word
+	}
+
+	s := Schedule{Kind: strings.ToLower(take()), Timezone: timezone}
+	switch s.Kind {
+	case scheduleDaily, scheduleWeekdays:
+		s.Clock = take()
+	case scheduleWeekly:
+		day, ok := weekdayNames[strings.ToLower(take())]
+		if !ok {
+			return Schedule{}, fmt.Errorf("неизвестный день недели")
+		}
+		s.Weekday = day
+		s.Clock = take()
+	case "at":
+		s.Kind = scheduleOnce
+		word := take()
+		if date, err := time.ParseInLocation("2006-01-02", word, loc); err == nil {
+			hour, minute, err := parseClock(take())
+			if err != nil {
+				return Schedule{}, err
+			}
+			s.NextRun = time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, loc)
+		} else {
+			// Без даты — ближайшее наступление указанного времени
+			hour, minute, err := parseClock(word)
+			if err != nil {
+				return Schedule{}, err
+			}
+			local := now.In(loc)
+			s.NextRun = time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, loc)
+			if !s.NextRun.After(now) {
+				s.NextRun = time.Date(local.Year(), local.Month(), local.Day()+1, hour, minute, 0, 0, loc)
+			}
+		}
+	case "in":
+		d, err := time.ParseDuration(take())
+		if err != nil || d < time.Minute {
+			return Schedule{}, fmt.Errorf("интервал должен быть не меньше минуты, например 30m или 2h")
+		}
+		s.Kind = scheduleOnce
+		s.NextRun = now.Add(d).Truncate(time.Second)
+	default:
+		return Schedule{}, errScheduleUsage
+	}
+
+	if s.Kind != scheduleOnce {
+		if _, _, err := parseClock(s.Clock); err != nil {
+			return Schedule{}, err
+		}
+		s.NextRun = s.next(now)
+	}
+	if !s.NextRun.After(now) {
+		return Schedule{}, fmt.Errorf("время запуска уже прошло")
+	}
+	s.Prompt = args
+	if s.Prompt == "" {
+		return Schedule{}, errScheduleUsage
+	}
+	return s, nil
+}
+
+// scheduleFile формат файла расписаний
+type scheduleFile struct {
+	NextID    int64      `json:"next_id"`
+	Schedules []Schedule `json:"schedules"`
+}
+
+// ScheduleStore хранит запланированные запросы в JSON-файле, чтобы они
+// переживали перезапуск
+type ScheduleStore struct {
+	path       string
+	maxPerUser int
+
+	mu        sync.Mutex
+	nextID    int64
+	schedules []Schedule
+}
+
+// NewScheduleStore создаёт хранилище расписаний из SCHEDULES_FILE
+// и загружает ранее сохранённые данные
+func NewScheduleStore() *ScheduleStore {
+	path := os.Getenv("SCHEDULES_FILE")
+	if path == "" {
+		path = "schedules.json"
+	}
+	maxPerUser := 10
+	if v := os.Getenv("SCHEDULES_MAX_PER_USER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			maxPerUser = n
+		}
+	}
+
+	s := &ScheduleStore{path: path, maxPerUser: maxPerUser, nextID: 1}
+	if err := s.load(); err != nil {
+		slog.Error("Ошибка загрузки расписаний", "path", path, "error", err)
+	}
+	return s
+}
+
+// errScheduleLimit пользователь достиг SCHEDULES_MAX_PER_USER
+var errScheduleLimit = errors.New("достигнут лимит расписаний")
+
+// Add сохраняет расписание и возвращает его с присвоенным ID
+func (s *ScheduleStore) Add(schedule Schedule) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, existing := range s.schedules {
+		if existing.UserID == schedule.UserID {
+			count++
+		}
+	}
+	if count >= s.maxPerUser {
+		return Schedule{}, errScheduleLimit
+	}
+
+	schedule.ID = s.nextID
+	s.nextID++
+	s.schedules = append(s.schedules, schedule)
+	if err := s.save(); err != nil {
+		slog.Error("Ошибка сохранения расписаний", "path", s.path, "error", err)
+	}
+	return schedule, nil
+}
+
+// List возвращает расписания чата по времени следующего запуска
+func (s *ScheduleStore) List(chatID int64) []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []Schedule
+	for _, schedule := range s.schedules {
+		if schedule.ChatID == chatID {
+			list = append(list, schedule)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NextRun.Before(list[j].NextRun) })
+	return list
+}
+
+// Delete удаляет расписание чата, если allow разрешает; возвращает false,
+// если расписания нет или удалять его нельзя
+func (s *ScheduleStore) Delete(chatID, id int64, allow func(Schedule) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, schedule := range s.schedules {
+		if schedule.ID != id || schedule.ChatID != chatID {
+			continue
+		}
+		if !allow(schedule) {
+			return false
+		}
+		s.schedules = append(s.schedules[:i], s.schedules[i+1:]...)
+		if err := s.save(); err != nil {
+			slog.Error("Ошибка сохранения расписаний", "path", s.path, "error", err)
+		}
+		return true
+	}
+	return false
+}
+
+// Due возвращает расписания, время которых наступило к now, и сразу переносит
+// их на следующий запуск (однократные удаляются). Изменения сохраняются до
+// выполнения запросов, поэтому после перезапуска запрос не повторится.
+// Запуски, пропущенные, пока бот был остановлен, выполняются один раз.
+func (s *ScheduleStore) Due(now time.Time) []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []Schedule
+	kept := s.schedules[:0]
+	for _, schedule := range s.schedules {
+		if schedule.NextRun.After(now) {
+			kept = append(kept, schedule)
+			continue
+		}
+		due = append(due, schedule)
+		if next := schedule.next(now); !next.IsZero() {
+			schedule.NextRun = next
+			kept = append(kept, schedule)
+		}
+	}
+	s.schedules = kept
+
+	if len(due) > 0 {
+		if err := s.save(); err != nil {
+			slog.Error("Ошибка сохранения расписаний", "path", s.path, "error", err)
+		}
+	}
+	return due
+}
+
+// load читает расписания из файла; отсутствие файла не является ошибкой
+func (s *ScheduleStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f scheduleFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	s.schedules = f.Schedules
+	if f.NextID > s.nextID {
+		s.nextID = f.NextID
+	}
+	return nil
+}
+
+// save записывает расписания в файл. Вызывается под s.mu.
+func (s *ScheduleStore) save() error {
+	data, err := json.MarshalIndent(scheduleFile{NextID: s.nextID, Schedules: s.schedules}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// timezoneFor возвращает часовой пояс пользователя: выбранный через /timezone
+// или DEFAULT_TIMEZONE
+func (bot *TelegramBot) timezoneFor(userID int64) string {
+	if tz := bot.Prefs.Get(userID).Timezone; tz != "" {
+		return tz
+	}
+	return defaultTimezone()
+}
+
+// runScheduler запускает наступившие расписания до отмены ctx. Запросы
+// выполняет фиксированное число обработчиков — по одному на место генерации
+// Ollama, поэтому сотни одновременно наступивших расписаний не создают
+// сотни ожидающих горутин.
+func runScheduler(ctx context.Context, bot *TelegramBot) {
+	jobs := bot.scheduleWorkers(ctx, cap(bot.Ollama.slots))
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for {
+		bot.runDueSchedules(ctx, time.Now(), jobs)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scheduleWorkers запускает n обработчиков расписаний до отмены ctx
+// и возвращает канал для передачи им заданий
+func (bot *TelegramBot) scheduleWorkers(ctx context.Context, n int) chan<- Schedule {
+	jobs := make(chan Schedule)
+	for i := 0; i < max(n, 1); i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case schedule := <-jobs:
+					bot.runSchedule(withCorrelationID(ctx), schedule)
+				}
+			}
+		}()
+	}
+	return jobs
+}
+
+// runDueSchedules передаёт обработчикам расписания, время которых наступило
+// к now. Пока все обработчики заняты, метод ждёт, а следующая проверка
+// расписаний откладывается.
+func (bot *TelegramBot) runDueSchedules(ctx context.Context, now time.Time, jobs chan<- Schedule) {
+	for _, schedule := range bot.Schedules.Due(now) {
+		select {
+		case jobs <- schedule:
+		case <-ctx.Done():
+			slog.WarnContext(ctx, "Запланированный запрос не выполнен из-за остановки бота", "schedule_id", schedule.ID, "chat_id", schedule.ChatID)
+		}
+	}
+}
+
+// runSchedule выполняет запланированный запрос от имени его автора
+// и отправляет ответ в чат. Запрос не сохраняется в истории разговора.
+func (bot *TelegramBot) runSchedule(ctx context.Context, s Schedule) {
+	ctx = withLanguage(ctx, bot.languageFor(&User{ID: s.UserID, LanguageCode: s.Lang}))
+	slog.InfoContext(ctx, "Запуск запланированного запроса", "schedule_id", s.ID, "chat_id", s.ChatID, "user_id", s.UserID)
+
+	// Доступ мог быть отозван после создания расписания
+	if !bot.isUserIDAllowed(s.UserID) {
+		metricScheduledRuns.Inc("denied")
+		slog.WarnContext(ctx, "Автор расписания больше не имеет доступа", "schedule_id", s.ID, "user_id", s.UserID)
+		return
+	}
+	if !bot.checkQuota(ctx, s.ChatID, s.UserID) {
+		metricScheduledRuns.Inc("quota")
+		return
+	}
+
+	result := bot.complete(ctx, s.ChatID, s.UserID, bot.History.Standalone(s.Prompt), nil)
+	if result == nil {
+		metricScheduledRuns.Inc("error")
+		return
+	}
+	metricScheduledRuns.Inc("ok")
+	bot.sendAnswer(ctx, s.ChatID, tr(ctx, "schedule_result", s.ID, truncate(s.Prompt, 100))+"\n\n"+result.Response, nil)
+}
+
+// cmdSchedule создаёт запланированный запрос: /schedule daily 09:00 запрос
+func (bot *TelegramBot) cmdSchedule(ctx context.Context, message *Message, args string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+
+	if args == "" {
+		bot.reply(ctx, chatID, tr(ctx, "schedule_usage"))
+		return
+	}
+	timezone := bot.timezoneFor(userID)
+	schedule, err := parseSchedule(args, timezone, time.Now())
+	if errors.Is(err, errScheduleUsage) {
+		bot.reply(ctx, chatID, tr(ctx, "schedule_usage"))
+		return
+	}
+	if err != nil {
+		bot.reply(ctx, chatID, tr(ctx, "schedule_invalid", err))
+		return
+	}
+	if len(schedule.Prompt) > bot.maxPromptLen {
+		bot.reply(ctx, chatID, tr(ctx, "prompt_too_long", bot.maxPromptLen))
+		return
+	}
+
+	schedule.ChatID = chatID
+	schedule.UserID = userID
+	schedule.Lang = languageFrom(ctx)
+	schedule.Created = time.Now()
+	schedule, err = bot.Schedules.Add(schedule)
+	if err != nil {
+		bot.reply(ctx, chatID, tr(ctx, "schedule_limit", bot.Schedules.maxPerUser))
+		return
+	}
+	slog.InfoContext(ctx, "Создано расписание", "schedule_id", schedule.ID, "chat_id", chatID, "kind", schedule.Kind, "next_run", schedule.NextRun)
+	bot.reply(ctx, chatID, tr(ctx, "schedule_created", schedule.describe(languageFrom(ctx))))
+}
+
+// cmdSchedules показывает расписания чата; /schedules delete <id> удаляет
+// расписание. Удалить можно своё расписание, администратор — любое.
+func (bot *TelegramBot) cmdSchedules(ctx context.Context, message *Message, args string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+	lang := languageFrom(ctx)
+
+	if args == "" {
+		list := bot.Schedules.List(chatID)
+		if len(list) == 0 {
+			bot.reply(ctx, chatID, tr(ctx, "schedules_empty"))
+			return
+		}
+		var b strings.Builder
+		b.WriteString(T(lang, "schedules_header"))
+		for _, s := range list {
+			b.WriteString(s.describe(lang) + "\n")
+		}
+		b.WriteString(T(lang, "schedules_footer"))
+		bot.reply(ctx, chatID, b.String())
+		return
+	}
+
+	action, idStr, _ := strings.Cut(args, " ")
+	id, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(idStr), "#"), 10, 64)
+	if (action != "delete" && action != "del") || err != nil {
+		bot.reply(ctx, chatID, tr(ctx, "schedules_usage"))
+		return
+	}
+	deleted := bot.Schedules.Delete(chatID, id, func(s Schedule) bool {
+		return s.UserID == userID || bot.userRole(userID) == RoleAdmin
+	})
+	if !deleted {
+		bot.reply(ctx, chatID, tr(ctx, "schedule_not_found", id))
+		return
+	}
+	slog.InfoContext(ctx, "Расписание удалено", "schedule_id", id, "chat_id", chatID, "user_id", userID)
+	bot.reply(ctx, chatID, tr(ctx, "schedule_deleted", id))
+}
+
+// cmdTimezone показывает или меняет часовой пояс пользователя для /schedule.
+// Существующие расписания остаются в поясе, в котором были созданы.
+func (bot *TelegramBot) cmdTimezone(ctx context.Context, message *Message, arg string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+
+	switch {
+	case arg == "":
+		bot.reply(ctx, chatID, tr(ctx, "timezone_current", bot.timezoneFor(userID)))
+	case strings.EqualFold(arg, "auto"):
+		bot.Prefs.Update(userID, func(p *UserPrefs) { p.Timezone = "" })
+		bot.reply(ctx, chatID, tr(ctx, "timezone_set", defaultTimezone()))
+	default:
+		if _, err := loadTimezone(arg); err != nil {
+			bot.reply(ctx, chatID, tr(ctx, "timezone_invalid", arg))
+			return
+		}
+		bot.Prefs.Update(userID, func(p *UserPrefs) { p.Timezone = arg })
+		bot.reply(ctx, chatID, tr(ctx, "timezone_set", arg))
+	}
+}
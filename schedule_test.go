@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	berlin := Schedule{Kind: scheduleDaily, Clock: "02:30", Timezone: "Europe/Berlin"}
+	weekdays := Schedule{Kind: scheduleWeekdays, Clock: "09:00", Timezone: "UTC"}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		from     time.Time
+		want     string
+	}{
+		// Перевод часов в Берлине 29.03.2026: 02:30 не существует и переносится на 03:30
+		{"daily при переводе часов", berlin, time.Date(2026, 3, 28, 12, 0, 0, 0, time.UTC), "2026-03-29 03:30 +0200"},
+		{"daily после перевода часов", berlin, time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC), "2026-03-30 02:30 +0200"},
+		{"weekdays после пятницы", weekdays, time.Date(2026, 10, 23, 10, 0, 0, 0, time.UTC), "2026-10-26 09:00 +0000"},
+	}
+	for _, tt := range tests {
+		got := tt.schedule.next(tt.from).In(tt.schedule.location()).Format("2006-01-02 15:04 -0700")
+		if got != tt.want {
+			t.Errorf("%s: %s, ожидалось %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	friday := time.Date(2026, 10, 23, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		text, timezone string
+		wantRun        string
+		wantPrompt     string
+	}{
+		{"weekly пн 08:15 план\nна неделю", "UTC+3", "2026-10-26 05:15", "план\nна неделю"},
+		{"in 90m напомни", "UTC", "2026-10-23 11:30", "напомни"},
+		{"at 08:00 напомни", "UTC", "2026-10-24 08:00", "напомни"},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.text, tt.timezone, friday)
+		if err != nil {
+			t.Errorf("%q: %v", tt.text, err)
+			continue
+		}
+		if got := s.NextRun.UTC().Format("2006-01-02 15:04"); got != tt.wantRun || s.Prompt != tt.wantPrompt {
+			t.Errorf("%q: запуск %s, запрос %q; ожидалось %s, %q", tt.text, got, s.Prompt, tt.wantRun, tt.wantPrompt)
+		}
+	}
+
+	if _, err := parseSchedule("at 2020-01-01 10:00 поздно", "UTC", friday); err == nil {
+		t.Error("ожидалась ошибка для прошедшего времени")
+	}
+	if _, err := parseSchedule("hourly напомни", "UTC", friday); err != errScheduleUsage {
+		t.Errorf("ожидалась справка для неизвестного вида, получено %v", err)
+	}
+}
+
+func TestLoadTimezoneOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+	}{
+		{"UTC", 0},
+		{"UTC+3", 3 * 3600},
+		{"UTC+05:30", 5*3600 + 30*60},
+		{"UTC-05:30", -(5*3600 + 30*60)},
+	}
+	for _, tt := range tests {
+		loc, err := loadTimezone(tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if _, offset := time.Date(2026, 10, 23, 10, 0, 0, 0, time.UTC).In(loc).Zone(); offset != tt.offset {
+			t.Errorf("смещение %s: %d, ожидалось %d", tt.name, offset, tt.offset)
+		}
+	}
+}
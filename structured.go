@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxInlineJSONLen JSON длиннее этого отправляется файлом, а не блоком кода
+const maxInlineJSONLen = 3500
+
+// jsonMaxRetries возвращает число повторных запросов при ответе,
+// не прошедшем проверку, из JSON_MAX_RETRIES (по умолчанию 2)
+func jsonMaxRetries() int {
+	if v := os.Getenv("JSON_MAX_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return 2
+}
+
+// ChatJSON запрашивает у модели ответ в формате JSON. Если schema задана, она
+// передаётся в поле format и ответ проверяется по ней, иначе передаётся format "json"
+// и проверяется только синтаксис. Если ответ не прошёл проверку, модель получает
+// описание ошибки и отвечает заново, не больше retries раз. Возвращает JSON ответа
+// и ответ Ollama с токенами и длительностями всех попыток; ответ Ollama
+// возвращается и при ошибке проверки, чтобы расход токенов можно было учесть.
+func (c *OllamaClient) ChatJSON(ctx context.Context, messages []ChatMessage, schema json.RawMessage, retries int) (json.RawMessage, *OllamaResponse, error) {
+	format := json.RawMessage(`"json"`)
+	var validator *jsonSchema
+	if len(schema) > 0 {
+		var err error
+		if validator, err = parseSchema(schema); err != nil {
+			return nil, nil, fmt.Errorf("некорректная схема: %w", err)
+		}
+		format = schema
+	}
+
+	messages = append([]ChatMessage(nil), messages...)
+	var total *OllamaResponse
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		resp, err := c.chat(ctx, OllamaChatRequest{Messages: messages, Format: format})
+		if err != nil {
+			return nil, total, err
+		}
+		if total != nil {
+			resp.PromptEvalCount += total.PromptEvalCount
+			resp.EvalCount += total.EvalCount
+			resp.TotalDuration += total.TotalDuration
+			resp.EvalDuration += total.EvalDuration
+		}
+		total = resp
+
+		result, err := checkJSON(resp.Response, validator)
+		if err == nil {
+			return result, total, nil
+		}
+		lastErr = err
+		slog.WarnContext(ctx, "Ответ модели не прошёл проверку JSON", "attempt", attempt+1, "error", err)
+
+		messages = append(messages,
+			ChatMessage{Role: "assistant", Content: resp.Response},
+			ChatMessage{Role: "user", Content: fmt.Sprintf("Ответ не прошёл проверку: %v. Верни только исправленный JSON без пояснений.", err)},
+		)
+	}
+	return nil, total, fmt.Errorf("ответ не прошёл проверку после %d попыток: %w", retries+1, lastErr)
+}
+
+// checkJSON проверяет, что текст является JSON и соответствует схеме validator
+// (если она задана), и возвращает JSON без окружающих пробелов
+func checkJSON(text string, validator *jsonSchema) (json.RawMessage, error) {
+	data := []byte(strings.TrimSpace(text))
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("некорректный JSON: %w", err)
+	}
+	if validator != nil {
+		if err := validator.Validate(v); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// jsonInstruction системное сообщение для режима JSON
+func jsonInstruction(schema json.RawMessage) string {
+	instruction := "Отвечай только валидным JSON без пояснений и разметки."
+	if len(schema) > 0 {
+		instruction += "\nОтвет должен соответствовать JSON Schema:\n" + string(schema)
+	}
+	return instruction
+}
+
+// splitSchema отделяет JSON Schema в начале аргументов команды от текста запроса.
+// Если аргументы не начинаются с "{", схемы нет.
+func splitSchema(args string) (json.RawMessage, string, error) {
+	if !strings.HasPrefix(args, "{") {
+		return nil, args, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(args))
+	var schema json.RawMessage
+	if err := dec.Decode(&schema); err != nil {
+		return nil, "", err
+	}
+	if _, err := parseSchema(schema); err != nil {
+		return nil, "", err
+	}
+	return schema, strings.TrimSpace(args[dec.InputOffset():]), nil
+}
+
+// cmdJSON запрашивает у модели машиночитаемый ответ: /json [схема] запрос.
+// Ответ не сохраняется в истории разговора.
+func (bot *TelegramBot) cmdJSON(ctx context.Context, message *Message, args string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+
+	schema, prompt, err := splitSchema(args)
+	if err != nil {
+		bot.reply(ctx, chatID, tr(ctx, "json_bad_schema", err))
+		return
+	}
+	if prompt == "" {
+		bot.reply(ctx, chatID, tr(ctx, "json_usage"))
+		return
+	}
+
+	if !bot.checkRateLimit(chatID) {
+		metricRateLimited.Inc()
+		bot.reply(ctx, chatID, tr(ctx, "rate_limited"))
+		return
+	}
+	// Схема передаётся модели вместе с запросом, поэтому ограничение действует на оба
+	if len(args) > bot.maxPromptLen {
+		bot.reply(ctx, chatID, tr(ctx, "prompt_too_long", bot.maxPromptLen))
+		return
+	}
+	if !bot.checkQuota(ctx, chatID, userID) {
+		return
+	}
+	bot.reply(ctx, chatID, tr(ctx, "processing"))
+
+	messages := bot.History.Standalone(prompt)
+	user := messages[len(messages)-1]
+	messages = append(messages[:len(messages)-1], ChatMessage{Role: "system", Content: jsonInstruction(schema)}, user)
+
+	result, resp, err := bot.Ollama.ChatJSON(ctx, messages, schema, jsonMaxRetries())
+	if resp != nil {
+		bot.Usage.Record(userID, chatID, resp)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка ответа в режиме JSON", "chat_id", chatID, "error", err)
+		if resp == nil {
+			bot.reply(ctx, chatID, tr(ctx, "generation_error"))
+		} else {
+			bot.reply(ctx, chatID, tr(ctx, "json_failed"))
+		}
+		return
+	}
+
+	bot.sendJSON(ctx, chatID, result)
+}
+
+// sendJSON отправляет JSON с отступами блоком кода, а слишком длинный — файлом answer.json
+func (bot *TelegramBot) sendJSON(ctx context.Context, chatID int64, data json.RawMessage) {
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, data, "", "  "); err != nil {
+		pretty.Reset()
+		pretty.Write(data)
+	}
+
+	if pretty.Len() > maxInlineJSONLen {
+		if err := bot.SendDocument(ctx, chatID, "answer.json", pretty.Bytes(), tr(ctx, "json_caption")); err != nil {
+			slog.ErrorContext(ctx, "Ошибка отправки документа", "chat_id", chatID, "error", err)
+		}
+		return
+	}
+
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	_, err := bot.sendMessage(ctx, SendMessageRequest{
+		ChatID:    chatID,
+		Text:      `<pre><code class="language-json">` + escape.Replace(pretty.String()) + "</code></pre>",
+		ParseMode: "HTML",
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка отправки сообщения", "chat_id", chatID, "error", err)
+	}
+}
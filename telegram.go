@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
@@ -21,22 +24,34 @@ const (
 
 // Telegram API структуры
 type Update struct {
-	UpdateID int64    `json:"update_id"`
-	Message  *Message `json:"message,omitempty"`
+	UpdateID      int64          `json:"update_id"`
+	Message       *Message       `json:"message,omitempty"`
+	EditedMessage *Message       `json:"edited_message,omitempty"`
+	CallbackQuery *CallbackQuery `json:"callback_query,omitempty"`
+
+	InlineQuery        *InlineQuery        `json:"inline_query,omitempty"`
+	ChosenInlineResult *ChosenInlineResult `json:"chosen_inline_result,omitempty"`
 }
 
 type Message struct {
-	MessageID int64  `json:"message_id"`
-	From      *User  `json:"from,omitempty"`
-	Chat      *Chat  `json:"chat"`
-	Text      string `json:"text,omitempty"`
-	Date      int64  `json:"date"`
+	MessageID      int64     `json:"message_id"`
+	From           *User     `json:"from,omitempty"`
+	Chat           *Chat     `json:"chat"`
+	Text           string    `json:"text,omitempty"`
+	Caption        string    `json:"caption,omitempty"`
+	Document       *Document `json:"document,omitempty"`
+	Voice          *Voice    `json:"voice,omitempty"`
+	Audio          *Audio    `json:"audio,omitempty"`
+	Date           int64     `json:"date"`
+	ReplyToMessage *Message  `json:"reply_to_message,omitempty"`
 }
 
 type User struct {
-	ID        int64  `json:"id"`
-	FirstName string `json:"first_name"`
-	Username  string `json:"username,omitempty"`
+	ID           int64  `json:"id"`
+	IsBot        bool   `json:"is_bot,omitempty"`
+	FirstName    string `json:"first_name"`
+	Username     string `json:"username,omitempty"`
+	LanguageCode string `json:"language_code,omitempty"`
 }
 
 type Chat struct {
@@ -46,9 +61,35 @@ type Chat struct {
 	Username  string `json:"username,omitempty"`
 }
 
+type CallbackQuery struct {
+	ID      string   `json:"id"`
+	From    *User    `json:"from"`
+	Message *Message `json:"message,omitempty"`
+	Data    string   `json:"data,omitempty"`
+}
+
+type InlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data,omitempty"`
+}
+
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
 type SendMessageRequest struct {
-	ChatID int64  `json:"chat_id"`
-	Text   string `json:"text"`
+	ChatID      int64                 `json:"chat_id"`
+	Text        string                `json:"text"`
+	ParseMode   string                `json:"parse_mode,omitempty"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// File файл на серверах Telegram, полученный методом getFile
+type File struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileSize     int64  `json:"file_size,omitempty"`
+	FilePath     string `json:"file_path,omitempty"`
 }
 
 type TelegramResponse struct {
@@ -61,18 +102,38 @@ type TelegramResponse struct {
 type TelegramBot struct {
 	Token        string
 	APIURL       string
+	FileURL      string
+	LocalMode    bool
 	Ollama       *OllamaClient
+	Usage        *UsageTracker
+	History      *ConversationManager
+	Prefs        *PreferencesStore
+	Documents    *DocumentStore
+	Schedules    *ScheduleStore
+	Templates    *TemplateStore
+	Compares     *CompareStore
 	LastUpdate   int64
 	AllowedUsers map[int64]bool
+	Admins       map[int64]bool
 	rateLimiter  map[int64][]time.Time
 	mu           sync.Mutex
 	maxRequests  int
 	rateWindow   time.Duration
 	maxPromptLen int
+	maxFileSize  int64
+
+	// Transcriber сервис распознавания голосовых сообщений; nil, если не настроен
+	Transcriber Transcriber
+
+	// Client общий HTTP-клиент запросов к Bot API с пулом соединений, прокси
+	// и IPv4-only. Таймауты задаются контекстом запроса. Консольный режим
+	// подменяет его транспорт, чтобы печатать сообщения вместо отправки.
+	Client *http.Client
 }
 
-// NewTelegramBot создает новый экземпляр бота
-func NewTelegramBot(token string) *TelegramBot {
+// NewTelegramBot создает новый экземпляр бота. Возвращает ошибку, если
+// настройки подключения к Telegram или Ollama некорректны.
+func NewTelegramBot(token string) (*TelegramBot, error) {
 	// Парсинг списка разрешённых пользователей
 	allowedUsers := make(map[int64]bool)
 	if ids := os.Getenv("ALLOWED_USER_IDS"); ids != "" {
@@ -82,9 +143,17 @@ func NewTelegramBot(token string) *TelegramBot {
 				allowedUsers[id] = true
 			}
 		}
-		log.Printf("Настроен список разрешённых пользователей: %d пользователь(ей)", len(allowedUsers))
+		slog.Info("Настроен список разрешённых пользователей", "count", len(allowedUsers))
 	} else {
-		log.Println("ВНИМАНИЕ: ALLOWED_USER_IDS не задан — бот доступен всем пользователям")
+		slog.Warn("ALLOWED_USER_IDS не задан — бот доступен всем пользователям")
+	}
+
+	// Парсинг списка администраторов
+	admins := make(map[int64]bool)
+	for _, idStr := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64); err == nil {
+			admins[id] = true
+		}
 	}
 
 	// Настройка rate limiting
@@ -110,17 +179,69 @@ func NewTelegramBot(token string) *TelegramBot {
 		}
 	}
 
+	// Токен скрывается во всех записях лога
+	logRedactor.Add(token)
+
+	ollama, err := NewOllamaClient()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := proxyFromEnv("telegram")
+	if err != nil {
+		return nil, err
+	}
+
+	// Адрес Bot API можно заменить на собственный сервер telegram-bot-api
+	// или на поддельный сервер для проверок
+	apiURL := strings.TrimRight(os.Getenv("TELEGRAM_API_URL"), "/")
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	fileURL := strings.TrimRight(os.Getenv("TELEGRAM_FILE_URL"), "/")
+	if fileURL == "" {
+		fileURL = apiURL + "/file/bot" + token
+	}
+	// Сервер, запущенный с --local, возвращает из getFile абсолютный путь к файлу на своём диске
+	localMode := strings.EqualFold(os.Getenv("TELEGRAM_LOCAL_MODE"), "true")
+
+	// Облачный Bot API отдаёт файлы до 20 МБ; собственный сервер — больше
+	maxFileSize := int64(20)
+	if v := os.Getenv("MAX_FILE_SIZE_MB"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			maxFileSize = n
+		}
+	}
+
+	if apiURL != "https://api.telegram.org" {
+		slog.Info("Используется собственный сервер Bot API", "url", apiURL, "local_mode", localMode)
+	}
+
+	usage := NewUsageTracker()
 	return &TelegramBot{
 		Token:        token,
-		APIURL:       "https://api.telegram.org/bot" + token,
-		Ollama:       NewOllamaClient(),
+		APIURL:       apiURL + "/bot" + token,
+		FileURL:      fileURL,
+		LocalMode:    localMode,
+		Ollama:       ollama,
+		Usage:        usage,
+		History:      NewConversationManager(ollama, usage),
+		Prefs:        NewPreferencesStore(),
+		Documents:    NewDocumentStore(),
+		Schedules:    NewScheduleStore(),
+		Templates:    NewTemplateStore(),
+		Compares:     NewCompareStore(),
 		LastUpdate:   0,
 		AllowedUsers: allowedUsers,
+		Admins:       admins,
 		rateLimiter:  make(map[int64][]time.Time),
 		maxRequests:  maxReq,
 		rateWindow:   rateWindow,
 		maxPromptLen: maxPromptLen,
-	}
+		maxFileSize:  maxFileSize << 20,
+		Transcriber:  NewTranscriber(),
+		// Long polling занимает одно соединение, поэтому пул держит запас для отправки ответов
+		Client: newHTTPClient("telegram", newTransport(proxy, 16)),
+	}, nil
 }
 
 // sanitizeError удаляет токен бота из сообщений об ошибках,
@@ -136,18 +257,37 @@ func (bot *TelegramBot) sanitizeError(err error) error {
 // isUserAllowed проверяет, разрешён ли пользователь.
 // Если ALLOWED_USER_IDS не задан (список пуст), доступ разрешён всем.
 func (bot *TelegramBot) isUserAllowed(message *Message) bool {
+	return bot.isUserIDAllowed(senderID(message))
+}
+
+// isUserIDAllowed проверяет, разрешён ли пользователь с указанным ID.
+// Администраторам доступ разрешён всегда.
+func (bot *TelegramBot) isUserIDAllowed(userID int64) bool {
 	if len(bot.AllowedUsers) == 0 {
 		return true
 	}
+	return bot.AllowedUsers[userID] || bot.Admins[userID]
+}
+
+// senderID возвращает ID отправителя сообщения.
+// Если отправитель неизвестен (например, сообщение канала), используется ID чата.
+func senderID(message *Message) int64 {
 	if message.From != nil {
-		return bot.AllowedUsers[message.From.ID]
+		return message.From.ID
 	}
-	return bot.AllowedUsers[message.Chat.ID]
+	return message.Chat.ID
 }
 
 // checkRateLimit проверяет, не превышен ли лимит запросов для пользователя.
 // Использует алгоритм скользящего окна.
 func (bot *TelegramBot) checkRateLimit(userID int64) bool {
+	return bot.checkRateLimitN(userID, 1)
+}
+
+// checkRateLimitN как checkRateLimit, но учитывает сразу n запросов, например
+// по одному на каждую модель в /compare. Запрос разрешается, только если
+// в окне есть место для всех n.
+func (bot *TelegramBot) checkRateLimitN(userID int64, n int) bool {
 	bot.mu.Lock()
 	defer bot.mu.Unlock()
 
@@ -162,29 +302,40 @@ func (bot *TelegramBot) checkRateLimit(userID int64) bool {
 		}
 	}
 
-	if len(recent) >= bot.maxRequests {
+	if len(recent)+n > bot.maxRequests {
 		bot.rateLimiter[userID] = recent
 		return false
 	}
 
-	bot.rateLimiter[userID] = append(recent, now)
+	for i := 0; i < n; i++ {
+		recent = append(recent, now)
+	}
+	bot.rateLimiter[userID] = recent
 	return true
 }
 
 // GetUpdates получает обновления от Telegram через long polling
-func (bot *TelegramBot) GetUpdates() ([]Update, error) {
+func (bot *TelegramBot) GetUpdates(ctx context.Context) ([]Update, error) {
 	url := fmt.Sprintf("%s/getUpdates?offset=%d&timeout=30", bot.APIURL, bot.LastUpdate+1)
 
-	// Используем клиент с таймаутом: 30с long polling + 10с запас
-	client := newHTTPClient(40 * time.Second)
+	// Таймаут: 30с long polling + 10с запас
+	ctx, cancel := context.WithTimeout(ctx, 40*time.Second)
+	defer cancel()
 
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
+		return nil, fmt.Errorf("ошибка создания HTTP запроса: %w", bot.sanitizeError(err))
+	}
+
+	resp, err := bot.Client.Do(req)
+	if err != nil {
+		metricTelegramErrors.Inc("getUpdates", "network")
 		return nil, fmt.Errorf("ошибка запроса к Telegram API: %w", bot.sanitizeError(err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		metricTelegramErrors.Inc("getUpdates", strconv.Itoa(resp.StatusCode))
 		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
 		return nil, fmt.Errorf("Telegram API вернул статус %d: %s", resp.StatusCode, string(bodyBytes))
 	}
@@ -200,6 +351,7 @@ func (bot *TelegramBot) GetUpdates() ([]Update, error) {
 	}
 
 	if !telegramResp.OK {
+		metricTelegramErrors.Inc("getUpdates", "api")
 		return nil, fmt.Errorf("Telegram API вернул ошибку: %s", telegramResp.Description)
 	}
 
@@ -222,35 +374,94 @@ func (bot *TelegramBot) GetUpdates() ([]Update, error) {
 	return updates, nil
 }
 
+// GetMe проверяет токен и доступность Telegram API вызовом getMe
+func (bot *TelegramBot) GetMe(ctx context.Context) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bot.APIURL+"/getMe", nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания HTTP запроса: %w", bot.sanitizeError(err))
+	}
+
+	resp, err := bot.Client.Do(req)
+	if err != nil {
+		metricTelegramErrors.Inc("getMe", "network")
+		return nil, fmt.Errorf("ошибка запроса к Telegram API: %w", bot.sanitizeError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		metricTelegramErrors.Inc("getMe", strconv.Itoa(resp.StatusCode))
+		return nil, fmt.Errorf("Telegram API вернул статус %d", resp.StatusCode)
+	}
+
+	var telegramResp struct {
+		OK          bool   `json:"ok"`
+		Result      *User  `json:"result"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&telegramResp); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга JSON: %w", err)
+	}
+
+	if !telegramResp.OK || telegramResp.Result == nil {
+		metricTelegramErrors.Inc("getMe", "api")
+		return nil, fmt.Errorf("Telegram API вернул ошибку: %s", telegramResp.Description)
+	}
+
+	return telegramResp.Result, nil
+}
+
 // SendMessage отправляет сообщение в чат
-func (bot *TelegramBot) SendMessage(chatID int64, text string) error {
-	reqBody := SendMessageRequest{
+func (bot *TelegramBot) SendMessage(ctx context.Context, chatID int64, text string) error {
+	_, err := bot.sendMessage(ctx, SendMessageRequest{
 		ChatID: chatID,
 		Text:   text,
+	})
+	return err
+}
+
+// sendMessage отправляет сообщение с дополнительными параметрами
+// и возвращает отправленное сообщение
+func (bot *TelegramBot) sendMessage(ctx context.Context, reqBody SendMessageRequest) (*Message, error) {
+	var sent Message
+	if err := bot.callAPI(ctx, "sendMessage", reqBody, &sent); err != nil {
+		return nil, err
 	}
 
-	jsonData, err := json.Marshal(reqBody)
+	slog.DebugContext(ctx, "Сообщение отправлено", "chat_id", reqBody.ChatID, "length", len(reqBody.Text))
+	return &sent, nil
+}
+
+// callAPI вызывает метод Telegram Bot API с JSON-телом и разбирает поле result.
+// Если result равен nil, содержимое ответа игнорируется.
+func (bot *TelegramBot) callAPI(ctx context.Context, method string, payload, result any) error {
+	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("ошибка сериализации запроса: %w", err)
 	}
 
-	url := bot.APIURL + "/sendMessage"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	url := bot.APIURL + "/" + method
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("ошибка создания HTTP запроса: %w", bot.sanitizeError(err))
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := newHTTPClient(10 * time.Second)
-
-	resp, err := client.Do(req)
+	resp, err := bot.Client.Do(req)
 	if err != nil {
+		metricTelegramErrors.Inc(method, "network")
 		return fmt.Errorf("ошибка выполнения HTTP запроса: %w", bot.sanitizeError(err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		metricTelegramErrors.Inc(method, strconv.Itoa(resp.StatusCode))
 		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
 		return fmt.Errorf("Telegram API вернул статус %d: %s", resp.StatusCode, string(bodyBytes))
 	}
@@ -260,114 +471,371 @@ func (bot *TelegramBot) SendMessage(chatID int64, text string) error {
 		return fmt.Errorf("ошибка чтения ответа: %w", err)
 	}
 
-	var telegramResp TelegramResponse
+	var telegramResp struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		Description string          `json:"description"`
+	}
 	if err := json.Unmarshal(body, &telegramResp); err != nil {
 		return fmt.Errorf("ошибка парсинга JSON: %w", err)
 	}
 
 	if !telegramResp.OK {
+		metricTelegramErrors.Inc(method, "api")
 		return fmt.Errorf("Telegram API вернул ошибку: %s", telegramResp.Description)
 	}
 
+	if result != nil && len(telegramResp.Result) > 0 {
+		if err := json.Unmarshal(telegramResp.Result, result); err != nil {
+			return fmt.Errorf("ошибка парсинга result: %w", err)
+		}
+	}
 	return nil
 }
 
+// SendDocument отправляет файл в чат через multipart/form-data
+func (bot *TelegramBot) SendDocument(ctx context.Context, chatID int64, filename string, data []byte, caption string) error {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	form.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	if caption != "" {
+		form.WriteField("caption", caption)
+	}
+	part, err := form.CreateFormFile("document", filename)
+	if err != nil {
+		return fmt.Errorf("ошибка формирования запроса: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return fmt.Errorf("ошибка формирования запроса: %w", err)
+	}
+	if err := form.Close(); err != nil {
+		return fmt.Errorf("ошибка формирования запроса: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", bot.APIURL+"/sendDocument", &buf)
+	if err != nil {
+		return fmt.Errorf("ошибка создания HTTP запроса: %w", bot.sanitizeError(err))
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := bot.Client.Do(req)
+	if err != nil {
+		metricTelegramErrors.Inc("sendDocument", "network")
+		return fmt.Errorf("ошибка выполнения HTTP запроса: %w", bot.sanitizeError(err))
+	}
+	defer resp.Body.Close()
+
+	var telegramResp TelegramResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&telegramResp); err != nil {
+		metricTelegramErrors.Inc("sendDocument", strconv.Itoa(resp.StatusCode))
+		return fmt.Errorf("ошибка парсинга JSON: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !telegramResp.OK {
+		metricTelegramErrors.Inc("sendDocument", strconv.Itoa(resp.StatusCode))
+		return fmt.Errorf("Telegram API вернул ошибку (статус %d): %s", resp.StatusCode, telegramResp.Description)
+	}
+
+	return nil
+}
+
+// HandleUpdate передаёт обновление обработчику по его типу
+func (bot *TelegramBot) HandleUpdate(ctx context.Context, update Update) {
+	if update.Message != nil {
+		bot.HandleMessage(ctx, update.Message)
+	}
+	if update.EditedMessage != nil {
+		bot.HandleEditedMessage(ctx, update.EditedMessage)
+	}
+	if update.CallbackQuery != nil {
+		bot.HandleCallback(ctx, update.CallbackQuery)
+	}
+	if update.InlineQuery != nil {
+		bot.HandleInlineQuery(ctx, update.InlineQuery)
+	}
+	if update.ChosenInlineResult != nil {
+		bot.HandleChosenInlineResult(ctx, update.ChosenInlineResult)
+	}
+}
+
 // HandleMessage обрабатывает входящее сообщение
-func (bot *TelegramBot) HandleMessage(message *Message) {
+func (bot *TelegramBot) HandleMessage(ctx context.Context, message *Message) {
 	if message == nil || message.Chat == nil {
 		return
 	}
+	ctx = withLanguage(ctx, bot.languageFor(message.From))
 
 	// Проверка авторизации пользователя
 	if !bot.isUserAllowed(message) {
-		log.Printf("Отклонён запрос от неавторизованного пользователя (chat_id: %d)", message.Chat.ID)
+		metricUnauthorized.Inc()
+		slog.WarnContext(ctx, "Отклонён запрос от неавторизованного пользователя", "chat_id", message.Chat.ID)
 		return
 	}
 
 	chatID := message.Chat.ID
+	userID := senderID(message)
 	text := message.Text
 
+	slog.InfoContext(ctx, "Получено сообщение", "chat_id", chatID, "user_id", userID, "message_id", message.MessageID)
+
 	// Обработка команд
 	if len(text) > 0 && text[0] == '/' {
-		bot.handleCommand(chatID, text)
+		metricMessagesHandled.Inc("command")
+		bot.handleCommand(ctx, message, text)
 		return
 	}
 
 	// Обработка обычных сообщений
 	if text != "" {
-		bot.handleTextMessage(chatID, text)
+		metricMessagesHandled.Inc("text")
+		// Шаблон, выбранный кнопкой /t, ждёт этого сообщения как ввода
+		if name, ok := bot.Templates.TakePending(chatID, userID); ok {
+			if t, ok := bot.Templates.Get(userID, name); ok {
+				bot.runTemplate(ctx, message, t, text)
+				return
+			}
+		}
+		bot.handleTextMessage(ctx, message, text)
+	} else if message.Document != nil {
+		metricMessagesHandled.Inc("document")
+		bot.handleDocument(ctx, message)
+	} else if message.Voice != nil || message.Audio != nil {
+		metricMessagesHandled.Inc("voice")
+		bot.handleVoice(ctx, message)
+	} else {
+		metricMessagesHandled.Inc("unsupported")
 	}
 }
 
-// handleCommand обрабатывает команды бота
-func (bot *TelegramBot) handleCommand(chatID int64, command string) {
-	switch command {
-	case "/start":
-		msg := "Привет! Я бот для работы с Ollama LLM.\n\n" +
-			"Просто отправь мне сообщение, и я передам его модели для генерации ответа.\n\n" +
-			"Используй /help для получения справки."
-		if err := bot.SendMessage(chatID, msg); err != nil {
-			log.Printf("Ошибка отправки сообщения: %v", bot.sanitizeError(err))
-		}
-
-	case "/help":
-		msg := "Доступные команды:\n\n" +
-			"/start - приветственное сообщение\n" +
-			"/help - эта справка\n\n" +
-			"Любое другое сообщение будет отправлено в Ollama для генерации ответа."
-		if err := bot.SendMessage(chatID, msg); err != nil {
-			log.Printf("Ошибка отправки сообщения: %v", bot.sanitizeError(err))
-		}
+// handleCommand обрабатывает команды бота по реестру команд
+func (bot *TelegramBot) handleCommand(ctx context.Context, message *Message, command string) {
+	name, args := parseCommand(command)
 
-	default:
+	cmd, ok := findCommand(name)
+	if !ok {
 		// Неизвестная команда - обрабатываем как обычный текст
-		bot.handleTextMessage(chatID, command)
+		bot.handleTextMessage(ctx, message, command)
+		return
 	}
+
+	if cmd.Role > bot.userRole(senderID(message)) {
+		slog.WarnContext(ctx, "Команда недоступна пользователю", "chat_id", message.Chat.ID, "command", cmd.Name)
+		bot.reply(ctx, message.Chat.ID, tr(ctx, "admin_only"))
+		return
+	}
+
+	cmd.Handler(bot, ctx, message, args)
 }
 
-// handleTextMessage обрабатывает текстовые сообщения
-func (bot *TelegramBot) handleTextMessage(chatID int64, text string) {
+// handleTextMessage обрабатывает текстовые сообщения.
+// Если сообщение является ответом (reply) на другое, его текст или ветка
+// разговора с ботом добавляются в промпт.
+func (bot *TelegramBot) handleTextMessage(ctx context.Context, message *Message, text string) {
+	chatID := message.Chat.ID
+
 	// Проверка rate limit
 	if !bot.checkRateLimit(chatID) {
-		bot.SendMessage(chatID, "Слишком много запросов. Пожалуйста, подождите немного.")
+		metricRateLimited.Inc()
+		bot.SendMessage(ctx, chatID, tr(ctx, "rate_limited"))
 		return
 	}
+	bot.answerText(ctx, message, text)
+}
+
+// answerText отвечает на текст сообщения без проверки rate limit: её уже
+// выполнил вызывающий (обычное сообщение или распознанная речь)
+func (bot *TelegramBot) answerText(ctx context.Context, message *Message, text string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
 
 	// Проверка длины промпта
 	if len(text) > bot.maxPromptLen {
-		bot.SendMessage(chatID, fmt.Sprintf("Сообщение слишком длинное. Максимальная длина: %d символов.", bot.maxPromptLen))
+		bot.SendMessage(ctx, chatID, tr(ctx, "prompt_too_long", bot.maxPromptLen))
+		return
+	}
+
+	prompt, messages := bot.buildPrompt(ctx, chatID, text, message.ReplyToMessage)
+
+	// Отправляем запрос в Ollama вместе с историей диалога
+	result := bot.generate(ctx, chatID, userID, messages, nil)
+	if result == nil {
 		return
 	}
 
+	turn := bot.History.AddTurn(ctx, chatID, userID, prompt, result.Response)
+	bot.History.LinkPrompt(chatID, turn, message.MessageID)
+	sent := bot.sendAnswer(ctx, chatID, result.Response, answerKeyboard(languageFrom(ctx), turn, result.DoneReason == "length"))
+	bot.History.LinkAnswer(chatID, turn, sent)
+}
+
+// buildPrompt собирает промпт с учётом сообщения, на которое ответил пользователь.
+// При ответе на сообщение бота, которое ещё есть в истории, модели передаётся
+// ветка разговора до этого ответа; при ответе на любое другое сообщение
+// его текст цитируется в промпте. Возвращает текст для сохранения в истории
+// и сообщения для /api/chat.
+func (bot *TelegramBot) buildPrompt(ctx context.Context, chatID int64, text string, reply *Message) (string, []ChatMessage) {
+	if reply == nil {
+		return text, bot.History.Build(ctx, chatID, text)
+	}
+	if messages, ok := bot.branchPrompt(ctx, chatID, text, reply); ok {
+		return text, messages
+	}
+
+	prompt := quotePrompt(text, reply)
+	return prompt, bot.History.Build(ctx, chatID, prompt)
+}
+
+// buildEditPrompt собирает промпт для исправленного сообщения обмена turn
+// по тем же правилам, что и buildPrompt: ответ на сообщение бота из истории
+// продолжает ветку разговора, ответ на другое сообщение цитирует его
+func (bot *TelegramBot) buildEditPrompt(ctx context.Context, chatID, turn int64, text string, reply *Message) (string, []ChatMessage, bool) {
+	if messages, ok := bot.branchPrompt(ctx, chatID, text, reply); ok {
+		return text, messages, true
+	}
+
+	prompt := quotePrompt(text, reply)
+	messages, ok := bot.History.BuildEdit(ctx, chatID, turn, prompt)
+	return prompt, messages, ok
+}
+
+// branchPrompt собирает промпт в контексте ветки, если reply — ответ бота,
+// который ещё есть в истории
+func (bot *TelegramBot) branchPrompt(ctx context.Context, chatID int64, text string, reply *Message) ([]ChatMessage, bool) {
+	if reply == nil {
+		return nil, false
+	}
+	turn, ok := bot.History.TurnForAnswer(chatID, reply.MessageID)
+	if !ok {
+		return nil, false
+	}
+	messages, ok := bot.History.BuildBranch(ctx, chatID, turn, text)
+	if ok {
+		slog.DebugContext(ctx, "Ответ в контексте ветки разговора", "chat_id", chatID, "turn", turn)
+	}
+	return messages, ok
+}
+
+// quotePrompt добавляет к тексту пользователя цитату сообщения, на которое он ответил
+func quotePrompt(text string, reply *Message) string {
+	if reply == nil {
+		return text
+	}
+	quoted := reply.Text
+	if quoted == "" {
+		quoted = reply.Caption
+	}
+	if quoted == "" {
+		return text
+	}
+
+	author := "собеседника"
+	if reply.From != nil && reply.From.FirstName != "" {
+		author = reply.From.FirstName
+	}
+	return fmt.Sprintf("Сообщение от %s:\n\"\"\"\n%s\n\"\"\"\n\n%s", author, quoted, text)
+}
+
+// generate проверяет квоту, запрашивает ответ модели и учитывает расход токенов.
+// При ошибке пользователь получает общее сообщение, а метод возвращает nil.
+func (bot *TelegramBot) generate(ctx context.Context, chatID, userID int64, messages []ChatMessage, options map[string]any) *OllamaResponse {
+	if !bot.checkQuota(ctx, chatID, userID) {
+		return nil
+	}
+
 	// Отправляем сообщение о том, что запрос обрабатывается
-	bot.SendMessage(chatID, "Обрабатываю запрос...")
+	bot.SendMessage(ctx, chatID, tr(ctx, "processing"))
+
+	return bot.complete(ctx, chatID, userID, messages, options)
+}
 
-	// Отправляем запрос в Ollama
-	response, err := bot.Ollama.SendPrompt(text)
+// checkQuota проверяет квоту токенов пользователя и сообщает ему, если она исчерпана
+func (bot *TelegramBot) checkQuota(ctx context.Context, chatID, userID int64) bool {
+	return bot.checkQuotaFor(ctx, chatID, userID, 0)
+}
+
+// checkQuotaFor как checkQuota, но требует остатка квоты не меньше оценки needed
+func (bot *TelegramBot) checkQuotaFor(ctx context.Context, chatID, userID, needed int64) bool {
+	if err := bot.Usage.CheckQuotaFor(userID, needed); err != nil {
+		slog.InfoContext(ctx, "Квота пользователя исчерпана", "user_id", userID, "reason", err)
+		bot.SendMessage(ctx, chatID, bot.quotaMessage(ctx, err))
+		return false
+	}
+	return true
+}
+
+// quotaMessage возвращает пользователю текст об исчерпанной квоте на его языке
+func (bot *TelegramBot) quotaMessage(ctx context.Context, err error) string {
+	reason := err.Error()
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		reason = quotaErr.Message(languageFrom(ctx))
+	}
+	return tr(ctx, "quota_exceeded", reason)
+}
+
+// complete запрашивает ответ модели и учитывает расход токенов без предварительных
+// проверок и уведомлений. Если в чате включены инструменты, модель может их вызывать.
+// При ошибке пользователь получает общее сообщение.
+func (bot *TelegramBot) complete(ctx context.Context, chatID, userID int64, messages []ChatMessage, options map[string]any) *OllamaResponse {
+	var (
+		result *OllamaResponse
+		err    error
+	)
+	if bot.toolsEnabled(chatID) {
+		result, err = bot.chatWithTools(ctx, chatID, userID, messages, options)
+	} else {
+		result, err = bot.Ollama.ChatWithOptions(ctx, messages, options)
+	}
 	if err != nil {
 		// Логируем полную ошибку на сервере, пользователю — общее сообщение
-		log.Printf("Ошибка от Ollama для chat %d: %v", chatID, err)
-		if sendErr := bot.SendMessage(chatID, "Произошла ошибка при обработке запроса. Попробуйте позже."); sendErr != nil {
-			log.Printf("Ошибка отправки сообщения об ошибке: %v", bot.sanitizeError(sendErr))
+		slog.ErrorContext(ctx, "Ошибка от Ollama", "chat_id", chatID, "error", err)
+		if sendErr := bot.SendMessage(ctx, chatID, tr(ctx, "generation_error")); sendErr != nil {
+			slog.ErrorContext(ctx, "Ошибка отправки сообщения об ошибке", "chat_id", chatID, "error", sendErr)
 		}
-		return
+		return nil
 	}
 
+	slog.InfoContext(ctx, "Ответ Ollama получен",
+		"chat_id", chatID,
+		"prompt_tokens", result.PromptEvalCount,
+		"completion_tokens", result.EvalCount,
+		"done_reason", result.DoneReason,
+		"duration", time.Duration(result.TotalDuration))
+	bot.Usage.Record(userID, chatID, result)
+	return result
+}
+
+// sendAnswer отправляет ответ модели, при необходимости разбивая его на части,
+// и возвращает ID отправленных сообщений. Клавиатура прикрепляется к последней части.
+func (bot *TelegramBot) sendAnswer(ctx context.Context, chatID int64, text string, markup *InlineKeyboardMarkup) []int64 {
+	var sent []int64
+
 	// Разбиваем длинные ответы на части
-	parts := SplitMessage(response, 4000)
+	parts := SplitMessage(text, 4000)
 
 	// Отправляем каждую часть
 	for i, part := range parts {
 		if i == 0 && len(parts) > 1 {
 			// Первая часть с указанием, что будет продолжение
-			part = part + "\n\n[Продолжение следует...]"
+			part = part + "\n\n" + tr(ctx, "to_be_continued")
+		}
+		req := SendMessageRequest{ChatID: chatID, Text: part}
+		if i == len(parts)-1 {
+			req.ReplyMarkup = markup
 		}
-		if err := bot.SendMessage(chatID, part); err != nil {
-			log.Printf("Ошибка отправки части сообщения: %v", bot.sanitizeError(err))
+		msg, err := bot.sendMessage(ctx, req)
+		if err != nil {
+			slog.ErrorContext(ctx, "Ошибка отправки части сообщения", "chat_id", chatID, "part", i, "error", err)
+		} else {
+			sent = append(sent, msg.MessageID)
 		}
 		// Небольшая задержка между сообщениями, чтобы не превысить rate limit
 		if i < len(parts)-1 {
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
+	return sent
 }
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode"
+)
+
+// callbackTemplate префикс callback_data кнопок выбора шаблона
+const callbackTemplate = "tpl"
+
+// templatePendingTTL сколько выбранный кнопкой шаблон ждёт текста пользователя
+const templatePendingTTL = 10 * time.Minute
+
+// templateNamePattern допустимые имена шаблонов; ограничение длины держит
+// callback_data кнопки выбора в пределах 64 байт
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// PromptTemplate именованный шаблон промпта в синтаксисе text/template
+type PromptTemplate struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+	// Shared общий шаблон, созданный администратором и доступный всем
+	Shared  bool      `json:"-"`
+	Author  int64     `json:"author"`
+	Created time.Time `json:"created"`
+}
+
+// templateData данные, доступные в шаблоне
+type templateData struct {
+	// Input текст после имени шаблона и переменных
+	Input string
+	// Vars переменные вида имя=значение перед текстом
+	Vars map[string]string
+	// User имя пользователя в Telegram
+	User string
+	// Date и Time текущие дата и время в часовом поясе пользователя
+	Date string
+	Time string
+	// Lang язык интерфейса пользователя
+	Lang string
+}
+
+// templateFuncs функции, доступные в шаблонах помимо встроенных
+var templateFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	// default возвращает value, если оно не пустое, иначе fallback:
+	// {{default "English" .Vars.to}}
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+	// printf заменяет встроенную функцию: ширина вида %999999999d заняла бы
+	// память раньше, чем limitedWriter увидит результат
+	"printf": func(format string, args ...any) (string, error) {
+		if printfWidthPattern.MatchString(format) {
+			return "", errTemplateWidth
+		}
+		return fmt.Sprintf(format, args...), nil
+	},
+}
+
+// printfWidthPattern ширина или точность в printf больше трёх цифр или из аргумента (*)
+var printfWidthPattern = regexp.MustCompile(`%[-+# 0]*(\*|\d{4}|\d*\.(\*|\d{4}))`)
+
+var (
+	errTemplateWidth = errors.New("ширина или точность в printf слишком велика")
+	errTemplateLoop  = errors.New("range, template, define и block в шаблонах не поддерживаются")
+)
+
+// parseTemplate разбирает текст шаблона. Циклы и вызовы других шаблонов
+// запрещены: без них время подстановки ограничено размером шаблона, а бот
+// обрабатывает обновления по одному и не должен зависать на чужом шаблоне.
+func parseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// define и block добавляют в набор именованные шаблоны
+	if len(tmpl.Templates()) > 1 {
+		return nil, errTemplateLoop
+	}
+	if tmpl.Tree == nil {
+		return tmpl, nil
+	}
+	var loop bool
+	walkTemplate(tmpl.Root, func(node parse.Node) {
+		switch node.(type) {
+		case *parse.RangeNode, *parse.TemplateNode:
+			loop = true
+		}
+	})
+	if loop {
+		return nil, errTemplateLoop
+	}
+	return tmpl, nil
+}
+
+// walkTemplate обходит дерево разбора шаблона, вызывая visit для каждого узла
+func walkTemplate(node parse.Node, visit func(parse.Node)) {
+	if node == nil {
+		return
+	}
+	visit(node)
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkTemplate(child, visit)
+		}
+	case *parse.ActionNode:
+		walkTemplate(n.Pipe, visit)
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, visit)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, visit)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, visit)
+	case *parse.TemplateNode:
+		walkTemplate(n.Pipe, visit)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walkTemplate(cmd, visit)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkTemplate(arg, visit)
+		}
+	case *parse.ChainNode:
+		walkTemplate(n.Node, visit)
+	}
+}
+
+// walkBranch обходит условие и ветки if, with и range
+func walkBranch(n *parse.BranchNode, visit func(parse.Node)) {
+	walkTemplate(n.Pipe, visit)
+	walkTemplate(n.List, visit)
+	walkTemplate(n.ElseList, visit)
+}
+
+// errTemplateTooLong результат подстановки превысил допустимую длину
+var errTemplateTooLong = errors.New("результат слишком длинный")
+
+// limitedWriter прерывает подстановку, если результат превысил limit байт
+type limitedWriter struct {
+	b     strings.Builder
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.b.Len()+len(p) > w.limit {
+		return 0, errTemplateTooLong
+	}
+	return w.b.Write(p)
+}
+
+// Render подставляет данные в шаблон; результат длиннее limit байт считается ошибкой
+func (t PromptTemplate) Render(data templateData, limit int) (string, error) {
+	tmpl, err := parseTemplate(t.Name, t.Text)
+	if err != nil {
+		return "", err
+	}
+	w := &limitedWriter{limit: limit}
+	if err := tmpl.Execute(w, data); err != nil {
+		if errors.Is(err, errTemplateTooLong) {
+			return "", errTemplateTooLong
+		}
+		return "", err
+	}
+	return strings.TrimSpace(w.b.String()), nil
+}
+
+// needsInput проверяет по дереву разбора, обращается ли шаблон к .Input
+// (в том числе как $.Input). Шаблон с ошибкой ввода не ждёт: ошибку покажет подстановка.
+func (t PromptTemplate) needsInput() bool {
+	tmpl, err := parseTemplate(t.Name, t.Text)
+	if err != nil || tmpl.Tree == nil {
+		return false
+	}
+	var uses bool
+	walkTemplate(tmpl.Root, func(node parse.Node) {
+		var ident []string
+		switch n := node.(type) {
+		case *parse.FieldNode:
+			ident = n.Ident
+		case *parse.VariableNode:
+			if len(n.Ident) > 1 && n.Ident[0] == "$" {
+				ident = n.Ident[1:]
+			}
+		}
+		if len(ident) > 0 && ident[0] == "Input" {
+			uses = true
+		}
+	})
+	return uses
+}
+
+// cutWord отделяет первое слово от остального текста
+func cutWord(s string) (word, rest string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexFunc(s, unicode.IsSpace); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
+
+// varPattern переменная шаблона в начале текста: имя=значение или имя="значение с пробелами"
+var varPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=`)
+
+// parseTemplateInput отделяет переменные имя=значение в начале текста от остального ввода
+func parseTemplateInput(text string) (map[string]string, string) {
+	vars := make(map[string]string)
+	text = strings.TrimSpace(text)
+	for {
+		m := varPattern.FindStringSubmatch(text)
+		if m == nil {
+			return vars, text
+		}
+		rest := text[len(m[0]):]
+		var value string
+		if quoted, err := strconv.QuotedPrefix(rest); err == nil {
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			end := strings.IndexFunc(rest, func(r rune) bool { return r == ' ' || r == '\n' || r == '\t' })
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		vars[m[1]] = value
+		text = strings.TrimSpace(rest)
+	}
+}
+
+// templatesFile формат файла шаблонов
+type templatesFile struct {
+	Shared map[string]PromptTemplate           `json:"shared,omitempty"`
+	Users  map[int64]map[string]PromptTemplate `json:"users,omitempty"`
+}
+
+// pendingTemplate шаблон, выбранный кнопкой и ожидающий текста пользователя
+type pendingTemplate struct {
+	name    string
+	expires time.Time
+}
+
+// TemplateStore хранит общие и личные шаблоны промптов в JSON-файле
+type TemplateStore struct {
+	path       string
+	maxPerUser int
+
+	mu      sync.Mutex
+	shared  map[string]PromptTemplate
+	users   map[int64]map[string]PromptTemplate
+	pending map[[2]int64]pendingTemplate
+}
+
+// NewTemplateStore создаёт хранилище шаблонов из TEMPLATES_FILE
+// и загружает ранее сохранённые данные
+func NewTemplateStore() *TemplateStore {
+	path := os.Getenv("TEMPLATES_FILE")
+	if path == "" {
+		path = "templates.json"
+	}
+	maxPerUser := 20
+	if v := os.Getenv("TEMPLATES_MAX_PER_USER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			maxPerUser = n
+		}
+	}
+
+	s := &TemplateStore{
+		path:       path,
+		maxPerUser: maxPerUser,
+		shared:     make(map[string]PromptTemplate),
+		users:      make(map[int64]map[string]PromptTemplate),
+		pending:    make(map[[2]int64]pendingTemplate),
+	}
+	if err := s.load(); err != nil {
+		slog.Error("Ошибка загрузки шаблонов", "path", path, "error", err)
+	}
+	return s
+}
+
+// errTemplateLimit пользователь достиг TEMPLATES_MAX_PER_USER
+var errTemplateLimit = errors.New("достигнут лимит шаблонов")
+
+// Get ищет шаблон для пользователя: личный шаблон важнее общего с тем же именем
+func (s *TemplateStore) Get(userID int64, name string) (PromptTemplate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.users[userID][name]; ok {
+		return t, true
+	}
+	t, ok := s.shared[name]
+	return t, ok
+}
+
+// List возвращает шаблоны, доступные пользователю: сначала личные, затем общие,
+// не перекрытые личными, каждые по имени
+func (s *TemplateStore) List(userID int64) []PromptTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var personal, shared []PromptTemplate
+	for _, t := range s.users[userID] {
+		personal = append(personal, t)
+	}
+	for name, t := range s.shared {
+		if _, ok := s.users[userID][name]; !ok {
+			shared = append(shared, t)
+		}
+	}
+	sort.Slice(personal, func(i, j int) bool { return personal[i].Name < personal[j].Name })
+	sort.Slice(shared, func(i, j int) bool { return shared[i].Name < shared[j].Name })
+	return append(personal, shared...)
+}
+
+// Save сохраняет личный шаблон пользователя или, если t.Shared, общий шаблон.
+// Шаблон с тем же именем заменяется.
+func (s *TemplateStore) Save(t PromptTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.Shared {
+		s.shared[t.Name] = t
+	} else {
+		templates := s.users[t.Author]
+		if _, exists := templates[t.Name]; !exists && len(templates) >= s.maxPerUser {
+			return errTemplateLimit
+		}
+		if templates == nil {
+			templates = make(map[string]PromptTemplate)
+			s.users[t.Author] = templates
+		}
+		templates[t.Name] = t
+	}
+	if err := s.save(); err != nil {
+		slog.Error("Ошибка сохранения шаблонов", "path", s.path, "error", err)
+	}
+	return nil
+}
+
+// Delete удаляет личный шаблон пользователя или общий шаблон; возвращает false,
+// если шаблона нет
+func (s *TemplateStore) Delete(userID int64, name string, shared bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if shared {
+		if _, ok := s.shared[name]; !ok {
+			return false
+		}
+		delete(s.shared, name)
+	} else {
+		if _, ok := s.users[userID][name]; !ok {
+			return false
+		}
+		delete(s.users[userID], name)
+		if len(s.users[userID]) == 0 {
+			delete(s.users, userID)
+		}
+	}
+	if err := s.save(); err != nil {
+		slog.Error("Ошибка сохранения шаблонов", "path", s.path, "error", err)
+	}
+	return true
+}
+
+// SetPending запоминает шаблон, выбранный кнопкой: следующее сообщение
+// пользователя в чате станет его вводом
+func (s *TemplateStore) SetPending(chatID, userID int64, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[[2]int64{chatID, userID}] = pendingTemplate{name: name, expires: time.Now().Add(templatePendingTTL)}
+}
+
+// TakePending возвращает и сбрасывает ожидающий ввода шаблон пользователя в чате
+func (s *TemplateStore) TakePending(chatID, userID int64) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]int64{chatID, userID}
+	p, ok := s.pending[key]
+	if !ok {
+		return "", false
+	}
+	delete(s.pending, key)
+	if time.Now().After(p.expires) {
+		return "", false
+	}
+	return p.name, true
+}
+
+// load читает шаблоны из файла; отсутствие файла не является ошибкой
+func (s *TemplateStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f templatesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	for name, t := range f.Shared {
+		t.Shared = true
+		s.shared[name] = t
+	}
+	for userID, templates := range f.Users {
+		s.users[userID] = templates
+	}
+	return nil
+}
+
+// save записывает шаблоны в файл. Вызывается под s.mu.
+func (s *TemplateStore) save() error {
+	data, err := json.MarshalIndent(templatesFile{Shared: s.shared, Users: s.users}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// templateKeyboard кнопки выбора шаблона, по одной в строке
+func templateKeyboard(templates []PromptTemplate) *InlineKeyboardMarkup {
+	markup := &InlineKeyboardMarkup{}
+	for _, t := range templates {
+		label := "👤 " + t.Name
+		if t.Shared {
+			label = "👥 " + t.Name
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []InlineKeyboardButton{
+			{Text: label, CallbackData: callbackTemplate + ":" + t.Name},
+		})
+	}
+	return markup
+}
+
+// runTemplate подставляет ввод пользователя в шаблон и обрабатывает результат
+// как обычное сообщение
+func (bot *TelegramBot) runTemplate(ctx context.Context, message *Message, t PromptTemplate, input string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+
+	vars, text := parseTemplateInput(input)
+	now := time.Now()
+	if loc, err := loadTimezone(bot.timezoneFor(userID)); err == nil {
+		now = now.In(loc)
+	}
+	data := templateData{
+		Input: text,
+		Vars:  vars,
+		Date:  now.Format("2006-01-02"),
+		Time:  now.Format("15:04"),
+		Lang:  languageFrom(ctx),
+	}
+	if message.From != nil {
+		data.User = message.From.FirstName
+	}
+
+	prompt, err := t.Render(data, bot.maxPromptLen)
+	if err != nil {
+		slog.WarnContext(ctx, "Ошибка подстановки в шаблон", "chat_id", chatID, "template", t.Name, "error", err)
+		bot.reply(ctx, chatID, tr(ctx, "template_failed", t.Name, err))
+		return
+	}
+	if prompt == "" {
+		bot.reply(ctx, chatID, tr(ctx, "template_empty", t.Name))
+		return
+	}
+	metricTemplatesUsed.Inc(strconv.FormatBool(t.Shared))
+	slog.InfoContext(ctx, "Применён шаблон", "chat_id", chatID, "template", t.Name, "shared", t.Shared)
+	bot.handleTextMessage(ctx, message, prompt)
+}
+
+// cmdT применяет шаблон: /t имя [переменные] текст. Без аргументов
+// показывает кнопки выбора шаблона.
+func (bot *TelegramBot) cmdT(ctx context.Context, message *Message, args string) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+
+	if args == "" {
+		templates := bot.Templates.List(userID)
+		if len(templates) == 0 {
+			bot.reply(ctx, chatID, tr(ctx, "templates_empty"))
+			return
+		}
+		_, err := bot.sendMessage(ctx, SendMessageRequest{
+			ChatID:      chatID,
+			Text:        tr(ctx, "template_pick"),
+			ReplyMarkup: templateKeyboard(templates),
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Ошибка отправки сообщения", "chat_id", chatID, "error", err)
+		}
+		return
+	}
+
+	name, input := cutWord(args)
+	t, ok := bot.Templates.Get(userID, strings.ToLower(name))
+	if !ok {
+		bot.reply(ctx, chatID, tr(ctx, "template_not_found", name))
+		return
+	}
+	if input == "" && t.needsInput() {
+		bot.reply(ctx, chatID, tr(ctx, "template_needs_input", t.Name))
+		return
+	}
+	bot.runTemplate(ctx, message, t, input)
+}
+
+// pickTemplate обрабатывает нажатие кнопки выбора шаблона. Шаблон без ввода
+// применяется сразу, иначе бот ждёт следующего сообщения пользователя.
+func (bot *TelegramBot) pickTemplate(ctx context.Context, query *CallbackQuery, name string) {
+	chatID := query.Message.Chat.ID
+	userID := query.From.ID
+
+	t, ok := bot.Templates.Get(userID, name)
+	if !ok {
+		bot.answerCallback(ctx, query.ID, tr(ctx, "template_not_found", name))
+		return
+	}
+	bot.answerCallback(ctx, query.ID, "")
+
+	if !t.needsInput() {
+		bot.runTemplate(ctx, &Message{MessageID: query.Message.MessageID, From: query.From, Chat: query.Message.Chat}, t, "")
+		return
+	}
+	bot.Templates.SetPending(chatID, userID, t.Name)
+	bot.reply(ctx, chatID, tr(ctx, "template_send_input", t.Name))
+}
+
+// cmdTemplates показывает доступные пользователю шаблоны
+func (bot *TelegramBot) cmdTemplates(ctx context.Context, message *Message, _ string) {
+	chatID := message.Chat.ID
+	lang := languageFrom(ctx)
+
+	templates := bot.Templates.List(senderID(message))
+	if len(templates) == 0 {
+		bot.reply(ctx, chatID, tr(ctx, "templates_empty"))
+		return
+	}
+
+	var personal, shared strings.Builder
+	for _, t := range templates {
+		line := "• " + t.Name + " — " + truncate(t.Text, 80) + "\n"
+		if t.Shared {
+			shared.WriteString(line)
+		} else {
+			personal.WriteString(line)
+		}
+	}
+	var b strings.Builder
+	if personal.Len() > 0 {
+		b.WriteString(T(lang, "templates_personal") + personal.String() + "\n")
+	}
+	if shared.Len() > 0 {
+		b.WriteString(T(lang, "templates_shared") + shared.String() + "\n")
+	}
+	b.WriteString(T(lang, "templates_footer"))
+	bot.reply(ctx, chatID, b.String())
+}
+
+// cmdTemplate управляет личными шаблонами:
+//
+//	/template add имя текст
+//	/template delete имя
+//	/template show имя
+func (bot *TelegramBot) cmdTemplate(ctx context.Context, message *Message, args string) {
+	action, rest := cutWord(args)
+	switch strings.ToLower(action) {
+	case "add":
+		bot.saveTemplate(ctx, message, rest, false)
+	case "delete", "del":
+		bot.deleteTemplate(ctx, message, rest, false)
+	case "show":
+		name, _ := cutWord(rest)
+		t, ok := bot.Templates.Get(senderID(message), strings.ToLower(name))
+		if !ok {
+			bot.reply(ctx, message.Chat.ID, tr(ctx, "template_not_found", name))
+			return
+		}
+		bot.reply(ctx, message.Chat.ID, t.Name+":\n\n"+t.Text)
+	default:
+		bot.reply(ctx, message.Chat.ID, tr(ctx, "template_usage"))
+	}
+}
+
+// cmdSharedTemplate управляет общими шаблонами. Команда зарегистрирована
+// с RoleAdmin, поэтому права проверяет handleCommand:
+//
+//	/sharedtemplate add имя текст
+//	/sharedtemplate delete имя
+func (bot *TelegramBot) cmdSharedTemplate(ctx context.Context, message *Message, args string) {
+	action, rest := cutWord(args)
+	switch strings.ToLower(action) {
+	case "add":
+		bot.saveTemplate(ctx, message, rest, true)
+	case "delete", "del":
+		bot.deleteTemplate(ctx, message, rest, true)
+	default:
+		bot.reply(ctx, message.Chat.ID, tr(ctx, "template_usage"))
+	}
+}
+
+// saveTemplate проверяет и сохраняет шаблон из аргументов "имя текст"
+func (bot *TelegramBot) saveTemplate(ctx context.Context, message *Message, args string, shared bool) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+
+	name, text := cutWord(args)
+	name = strings.ToLower(name)
+	if !templateNamePattern.MatchString(name) || text == "" {
+		bot.reply(ctx, chatID, tr(ctx, "template_usage"))
+		return
+	}
+	if len(text) > bot.maxPromptLen {
+		bot.reply(ctx, chatID, tr(ctx, "prompt_too_long", bot.maxPromptLen))
+		return
+	}
+	if _, err := parseTemplate(name, text); err != nil {
+		bot.reply(ctx, chatID, tr(ctx, "template_invalid", err))
+		return
+	}
+	err := bot.Templates.Save(PromptTemplate{Name: name, Text: text, Shared: shared, Author: userID, Created: time.Now()})
+	if err != nil {
+		bot.reply(ctx, chatID, tr(ctx, "template_limit", bot.Templates.maxPerUser))
+		return
+	}
+	slog.InfoContext(ctx, "Шаблон сохранён", "user_id", userID, "template", name, "shared", shared)
+	bot.reply(ctx, chatID, tr(ctx, "template_saved", name))
+}
+
+// deleteTemplate удаляет личный или общий шаблон по имени
+func (bot *TelegramBot) deleteTemplate(ctx context.Context, message *Message, args string, shared bool) {
+	chatID := message.Chat.ID
+	userID := senderID(message)
+
+	name, _ := cutWord(args)
+	name = strings.ToLower(name)
+	if !bot.Templates.Delete(userID, name, shared) {
+		bot.reply(ctx, chatID, tr(ctx, "template_not_found", name))
+		return
+	}
+	slog.InfoContext(ctx, "Шаблон удалён", "user_id", userID, "template", name, "shared", shared)
+	bot.reply(ctx, chatID, tr(ctx, "template_deleted", name))
+}
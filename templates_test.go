@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTemplateInput(t *testing.T) {
+	tests := []struct {
+		text      string
+		wantVars  map[string]string
+		wantInput string
+	}{
+		{"to=\"Brazilian Portuguese\" tone=formal Hello, world", map[string]string{"to": "Brazilian Portuguese", "tone": "formal"}, "Hello, world"},
+		{"Hello, world", map[string]string{}, "Hello, world"},
+	}
+	for _, tt := range tests {
+		vars, input := parseTemplateInput(tt.text)
+		if input != tt.wantInput || len(vars) != len(tt.wantVars) {
+			t.Errorf("%q: переменные %v, ввод %q", tt.text, vars, input)
+			continue
+		}
+		for name, want := range tt.wantVars {
+			if vars[name] != want {
+				t.Errorf("%q: %s=%q, ожидалось %q", tt.text, name, vars[name], want)
+			}
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tmpl := PromptTemplate{Name: "echo", Text: "{{upper .Input}} {{.Vars.missing}}{{.Input}}"}
+	if got, err := tmpl.Render(templateData{Input: "abc"}, 100); err != nil || got != "ABC abc" {
+		t.Errorf("подстановка %q, %v", got, err)
+	}
+	if _, err := tmpl.Render(templateData{Input: strings.Repeat("x", 60)}, 100); err != errTemplateTooLong {
+		t.Errorf("ожидалась ошибка длины, получено %v", err)
+	}
+	if _, err := parseTemplate("bad", "{{.Input"); err == nil {
+		t.Error("ожидалась ошибка разбора")
+	}
+}
+
+func TestParseTemplateRejectsLoops(t *testing.T) {
+	for _, text := range []string{
+		"{{range 1000000000000}}{{end}}",
+		"{{range .Vars}}{{range $.Vars}}{{end}}{{end}}",
+		"{{if .Input}}{{range .Vars}}{{end}}{{end}}",
+		`{{define "x"}}{{template "x" .}}{{end}}{{template "x" .}}`,
+		`{{block "x" .}}{{.Input}}{{end}}`,
+	} {
+		if _, err := parseTemplate("loop", text); !errors.Is(err, errTemplateLoop) {
+			t.Errorf("parseTemplate(%q) = %v, ожидалась errTemplateLoop", text, err)
+		}
+	}
+}
+
+func TestRenderLimitsWork(t *testing.T) {
+	tmpl := PromptTemplate{Name: "wide", Text: `{{printf "%0999999999d" 1}}`}
+	done := make(chan error, 1)
+	go func() {
+		_, err := tmpl.Render(templateData{}, 1000)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errTemplateWidth) {
+			t.Fatalf("Render = %v, ожидалась errTemplateWidth", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Render не завершился")
+	}
+
+	ok := PromptTemplate{Name: "narrow", Text: `{{printf "%05.1f|%-3s" 3.14159 "a"}}`}
+	if got, err := ok.Render(templateData{}, 100); err != nil || got != "003.1|a" {
+		t.Fatalf("Render = %q, %v", got, err)
+	}
+}
+
+func TestNeedsInput(t *testing.T) {
+	for text, want := range map[string]bool{
+		"Переведи: {{.Input}}":                true,
+		"{{upper .Input}}":                    true,
+		"{{with .Vars}}{{$.Input}}{{end}}":    true,
+		"{{if .Input}}есть{{end}}":            true,
+		"Сегодня {{.Date}}":                   false,
+		"Текст .Input без подстановки":        false,
+		"{{.Vars.Input_note}} {{.Vars.text}}": false,
+		"{{.Input":                            false,
+	} {
+		if got := (PromptTemplate{Name: "t", Text: text}).needsInput(); got != want {
+			t.Errorf("needsInput(%q) = %v, ожидалось %v", text, got, want)
+		}
+	}
+}
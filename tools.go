@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tool локальная функция, которую модель может вызвать через tool calling.
+// Инструменты только читают данные и не обращаются к сети и файловой системе.
+type Tool struct {
+	// Name имя функции для модели
+	Name string
+	// Description описания по кодам языков; модели передаётся описание на defaultLanguage
+	Description map[string]string
+	// Parameters JSON Schema аргументов
+	Parameters map[string]any
+	// Run выполняет вызов в чате chatID по сообщению пользователя userID
+	Run func(bot *TelegramBot, ctx context.Context, chatID, userID int64, args json.RawMessage) (string, error)
+}
+
+// describe возвращает описание инструмента на языке lang или на языке по умолчанию
+func (t Tool) describe(lang string) string {
+	if d, ok := t.Description[lang]; ok {
+		return d
+	}
+	return t.Description[defaultLanguage]
+}
+
+// spec возвращает описание инструмента для запроса к Ollama
+func (t Tool) spec() ToolSpec {
+	var s ToolSpec
+	s.Type = "function"
+	s.Function.Name = t.Name
+	s.Function.Description = t.describe(defaultLanguage)
+	s.Function.Parameters = t.Parameters
+	return s
+}
+
+// toolRegistry встроенные инструменты в порядке показа в /tools
+var toolRegistry = []Tool{
+	{
+		Name: "current_datetime",
+		Description: map[string]string{
+			"ru": "Текущие дата, время и день недели в часовом поясе пользователя или в заданном, например Europe/Moscow.",
+			"en": "Current date, time and weekday in the user's time zone or in the given one, for example Europe/London.",
+		},
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"timezone": map[string]any{"type": "string", "description": "Часовой пояс IANA или смещение вида UTC+3, по умолчанию часовой пояс пользователя"},
+			},
+		},
+		Run: (*TelegramBot).toolDateTime,
+	},
+	{
+		Name: "calculator",
+		Description: map[string]string{
+			"ru": "Вычисляет арифметическое выражение: + - * / % ^, скобки, pi, e, sqrt, abs, round, floor, ceil, ln, log10, sin, cos, tan.",
+			"en": "Evaluates an arithmetic expression: + - * / % ^, parentheses, pi, e, sqrt, abs, round, floor, ceil, ln, log10, sin, cos, tan.",
+		},
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"expression": map[string]any{"type": "string", "description": "Выражение, например (2+3)*4^2"},
+			},
+			"required": []string{"expression"},
+		},
+		Run: (*TelegramBot).toolCalculator,
+	},
+	{
+		Name: "convert_units",
+		Description: map[string]string{
+			"ru": "Переводит значение между единицами длины, массы, объёма, скорости, времени и температуры, например km в mi или c в f.",
+			"en": "Converts a value between units of length, mass, volume, speed, time and temperature, for example km to mi or c to f.",
+		},
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"value": map[string]any{"type": "number"},
+				"from":  map[string]any{"type": "string", "description": "Исходная единица, например km"},
+				"to":    map[string]any{"type": "string", "description": "Целевая единица, например mi"},
+			},
+			"required": []string{"value", "from", "to"},
+		},
+		Run: (*TelegramBot).toolConvertUnits,
+	},
+	{
+		Name: "search_documents",
+		Description: map[string]string{
+			"ru": "Ищет фрагменты текстовых документов, загруженных в этот чат, по ключевым словам.",
+			"en": "Searches fragments of the text documents uploaded to this chat by keywords.",
+		},
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"query": map[string]any{"type": "string", "description": "Ключевые слова для поиска"},
+			},
+			"required": []string{"query"},
+		},
+		Run: (*TelegramBot).toolSearchDocuments,
+	},
+}
+
+// findTool ищет инструмент в реестре по имени
+func findTool(name string) (Tool, bool) {
+	for _, t := range toolRegistry {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Tool{}, false
+}
+
+// toolSpecs возвращает описания всех инструментов для запроса к Ollama
+func toolSpecs() []ToolSpec {
+	specs := make([]ToolSpec, len(toolRegistry))
+	for i, t := range toolRegistry {
+		specs[i] = t.spec()
+	}
+	return specs
+}
+
+// toolsEnabledByDefault возвращает значение TOOLS_ENABLED для чатов без настройки /tools.
+// По умолчанию инструменты выключены: не все модели поддерживают tool calling.
+func toolsEnabledByDefault() bool {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv("TOOLS_ENABLED")))
+	return v == "true" || v == "1" || v == "yes"
+}
+
+// toolsMaxIterations возвращает лимит раундов вызова инструментов из TOOLS_MAX_ITERATIONS
+func toolsMaxIterations() int {
+	if v := os.Getenv("TOOLS_MAX_ITERATIONS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 5
+}
+
+// toolsEnabled проверяет, включены ли инструменты в чате
+func (bot *TelegramBot) toolsEnabled(chatID int64) bool {
+	switch bot.Prefs.GetChat(chatID).Tools {
+	case "on":
+		return true
+	case "off":
+		return false
+	default:
+		return toolsEnabledByDefault()
+	}
+}
+
+// chatWithTools запрашивает ответ модели с доступом к инструментам: вызовы,
+// которые запросила модель, выполняются, а результаты передаются ей обратно,
+// пока она не даст окончательный ответ. После TOOLS_MAX_ITERATIONS раундов
+// модель отвечает без инструментов. Токены и длительности всех раундов
+// суммируются в возвращаемом ответе.
+func (bot *TelegramBot) chatWithTools(ctx context.Context, chatID, userID int64, messages []ChatMessage, options map[string]any) (*OllamaResponse, error) {
+	messages = append([]ChatMessage(nil), messages...)
+	specs := toolSpecs()
+	maxIterations := toolsMaxIterations()
+
+	var total OllamaResponse
+	for i := 0; ; i++ {
+		if i == maxIterations {
+			slog.WarnContext(ctx, "Достигнут лимит вызовов инструментов", "chat_id", chatID, "iterations", i)
+			specs = nil
+		}
+
+		resp, err := bot.Ollama.ChatWithTools(ctx, messages, options, specs)
+		if err != nil && specs != nil && strings.Contains(err.Error(), "does not support tools") {
+			slog.WarnContext(ctx, "Модель не поддерживает инструменты", "model", bot.Ollama.Model)
+			specs = nil
+			resp, err = bot.Ollama.ChatWithOptions(ctx, messages, options)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		total.PromptEvalCount += resp.PromptEvalCount
+		total.EvalCount += resp.EvalCount
+		total.TotalDuration += resp.TotalDuration
+		total.EvalDuration += resp.EvalDuration
+
+		if resp.Message == nil || len(resp.Message.ToolCalls) == 0 || specs == nil {
+			resp.PromptEvalCount = total.PromptEvalCount
+			resp.EvalCount = total.EvalCount
+			resp.TotalDuration = total.TotalDuration
+			resp.EvalDuration = total.EvalDuration
+			return resp, nil
+		}
+
+		messages = append(messages, *resp.Message)
+		for _, call := range resp.Message.ToolCalls {
+			messages = append(messages, ChatMessage{
+				Role:     "tool",
+				ToolName: call.Function.Name,
+				Content:  bot.runTool(ctx, chatID, userID, call),
+			})
+		}
+	}
+}
+
+// runTool выполняет вызов инструмента и возвращает результат для модели.
+// Ошибка тоже передаётся модели текстом, чтобы она могла исправить аргументы.
+func (bot *TelegramBot) runTool(ctx context.Context, chatID, userID int64, call ToolCall) string {
+	name := call.Function.Name
+	tool, ok := findTool(name)
+	if !ok {
+		metricToolCalls.Inc("other", "unknown")
+		return fmt.Sprintf("ошибка: инструмент %q не существует", name)
+	}
+
+	result, err := tool.Run(bot, ctx, chatID, userID, call.Function.Arguments)
+	if err != nil {
+		metricToolCalls.Inc(name, "error")
+		slog.InfoContext(ctx, "Ошибка инструмента", "chat_id", chatID, "tool", name, "error", err)
+		return "ошибка: " + err.Error()
+	}
+	metricToolCalls.Inc(name, "ok")
+	slog.DebugContext(ctx, "Вызван инструмент", "chat_id", chatID, "tool", name, "result_length", len(result))
+	return result
+}
+
+// parseToolArgs разбирает аргументы вызова. Некоторые модели передают объект
+// аргументов строкой с JSON, поэтому такая строка разбирается повторно.
+func parseToolArgs(raw json.RawMessage, v any) error {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		raw = json.RawMessage(s)
+	}
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("некорректные аргументы: %w", err)
+	}
+	return nil
+}
+
+// toolDateTime возвращает текущее время в заданном часовом поясе или, если он
+// не указан, в часовом поясе пользователя из /timezone (DEFAULT_TIMEZONE)
+func (bot *TelegramBot) toolDateTime(_ context.Context, _, userID int64, raw json.RawMessage) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := parseToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+
+	name := args.Timezone
+	if name == "" {
+		name = bot.timezoneFor(userID)
+	}
+	loc, err := loadTimezone(name)
+	if err != nil {
+		return "", fmt.Errorf("неизвестный часовой пояс %q", name)
+	}
+	now := time.Now().In(loc)
+	return fmt.Sprintf("%s, %s (%s)", now.Format("2006-01-02 15:04:05 -07:00"), now.Weekday(), loc), nil
+}
+
+func (bot *TelegramBot) toolCalculator(_ context.Context, _, _ int64, raw json.RawMessage) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := parseToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	v, err := evalExpression(args.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(v, 'g', 12, 64), nil
+}
+
+// unitFactors множители перевода в базовую единицу величины:
+// метр, килограмм, литр, метр в секунду и секунду
+var unitFactors = map[string]struct {
+	kind   string
+	factor float64
+}{
+	"mm": {"length", 0.001}, "cm": {"length", 0.01}, "m": {"length", 1}, "km": {"length", 1000},
+	"in": {"length", 0.0254}, "ft": {"length", 0.3048}, "yd": {"length", 0.9144}, "mi": {"length", 1609.344},
+	"nmi": {"length", 1852},
+
+	"mg": {"mass", 1e-6}, "g": {"mass", 0.001}, "kg": {"mass", 1}, "t": {"mass", 1000},
+	"oz": {"mass", 0.028349523125}, "lb": {"mass", 0.45359237},
+
+	"ml": {"volume", 0.001}, "l": {"volume", 1}, "m3": {"volume", 1000},
+	"floz": {"volume", 0.0295735295625}, "cup": {"volume", 0.2365882365}, "gal": {"volume", 3.785411784},
+
+	"m/s": {"speed", 1}, "km/h": {"speed", 1 / 3.6}, "mph": {"speed", 0.44704}, "kn": {"speed", 1852.0 / 3600},
+
+	"s": {"time", 1}, "min": {"time", 60}, "h": {"time", 3600}, "d": {"time", 86400}, "wk": {"time", 604800},
+}
+
+// convertTemperature переводит температуру между шкалами c, f и k
+func convertTemperature(v float64, from, to string) (float64, bool) {
+	var celsius float64
+	switch from {
+	case "c":
+		celsius = v
+	case "f":
+		celsius = (v - 32) * 5 / 9
+	case "k":
+		celsius = v - 273.15
+	default:
+		return 0, false
+	}
+	switch to {
+	case "c":
+		return celsius, true
+	case "f":
+		return celsius*9/5 + 32, true
+	case "k":
+		return celsius + 273.15, true
+	}
+	return 0, false
+}
+
+func (bot *TelegramBot) toolConvertUnits(_ context.Context, _, _ int64, raw json.RawMessage) (string, error) {
+	var args struct {
+		Value json.Number `json:"value"`
+		From  string      `json:"from"`
+		To    string      `json:"to"`
+	}
+	if err := parseToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	value, err := args.Value.Float64()
+	if err != nil {
+		return "", fmt.Errorf("некорректное значение %q", args.Value)
+	}
+	from := strings.ToLower(strings.TrimSpace(args.From))
+	to := strings.ToLower(strings.TrimSpace(args.To))
+
+	result, ok := convertTemperature(value, from, to)
+	if !ok {
+		f, okFrom := unitFactors[from]
+		t, okTo := unitFactors[to]
+		switch {
+		case !okFrom:
+			return "", fmt.Errorf("неизвестная единица %q", args.From)
+		case !okTo:
+			return "", fmt.Errorf("неизвестная единица %q", args.To)
+		case f.kind != t.kind:
+			return "", fmt.Errorf("нельзя перевести %s в %s", args.From, args.To)
+		}
+		result = value * f.factor / t.factor
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return "", fmt.Errorf("результат не является конечным числом")
+	}
+	return fmt.Sprintf("%s %s = %s %s", args.Value, from, strconv.FormatFloat(result, 'g', 10, 64), to), nil
+}
+
+func (bot *TelegramBot) toolSearchDocuments(_ context.Context, chatID, _ int64, raw json.RawMessage) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+	}
+	if err := parseToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	if bot.Documents.Count(chatID) == 0 {
+		return "В этом чате нет загруженных документов.", nil
+	}
+
+	matches := bot.Documents.Search(chatID, args.Query, documentSearchResults)
+	if len(matches) == 0 {
+		return "Ничего не найдено.", nil
+	}
+	var b strings.Builder
+	for i, m := range matches {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "[%s]\n%s", m.Name, m.Text)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvalExpression(t *testing.T) {
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"(2+3)*4^2", 80},
+		{"-2^2", -4},
+		{"2^3^2", 512},
+		{"sqrt(16) + 1,5", 5.5},
+		{"10 % 4", 2},
+	}
+	for _, tt := range tests {
+		got, err := evalExpression(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v, ожидалось %v", tt.expr, got, tt.want)
+		}
+	}
+	for _, expr := range []string{"1/0", "2+", "os.Exit(1)", "(1"} {
+		if _, err := evalExpression(expr); err == nil {
+			t.Errorf("ожидалась ошибка для %q", expr)
+		}
+	}
+}
+
+func TestToolConvertUnits(t *testing.T) {
+	bot := &TelegramBot{}
+	tests := []struct {
+		args, want string
+	}{
+		{`{"value":100,"from":"C","to":"f"}`, "= 212 f"},
+		{`{"value":"1","from":"mi","to":"km"}`, "= 1.609344 km"},
+		{`{"value":90,"from":"km/h","to":"m/s"}`, "= 25 m/s"},
+	}
+	for _, tt := range tests {
+		got, err := bot.toolConvertUnits(context.Background(), 0, 0, json.RawMessage(tt.args))
+		if err != nil {
+			t.Errorf("%s: %v", tt.args, err)
+			continue
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("%s: %q, ожидалось %q", tt.args, got, tt.want)
+		}
+	}
+	if _, err := bot.toolConvertUnits(context.Background(), 0, 0, json.RawMessage(`{"value":1,"from":"kg","to":"km"}`)); err == nil {
+		t.Error("ожидалась ошибка перевода kg в km")
+	}
+}
+
+func TestToolDateTimeTimezone(t *testing.T) {
+	t.Setenv("PREFS_FILE", filepath.Join(t.TempDir(), "prefs.json"))
+	bot := &TelegramBot{Prefs: NewPreferencesStore()}
+
+	// Без аргумента время показывается в часовом поясе пользователя из /timezone
+	bot.Prefs.Update(42, func(p *UserPrefs) { p.Timezone = "Asia/Tokyo" })
+	tests := []struct {
+		args, want string
+	}{
+		{`{}`, "+09:00"},
+		{`{"timezone":"UTC-05:30"}`, "-05:30"},
+	}
+	for _, tt := range tests {
+		got, err := bot.toolDateTime(context.Background(), 0, 42, json.RawMessage(tt.args))
+		if err != nil {
+			t.Errorf("%s: %v", tt.args, err)
+			continue
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("%s: %q, ожидалось %q", tt.args, got, tt.want)
+		}
+	}
+}
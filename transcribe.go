@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// voiceEchoMaxLen сколько символов распознанного текста показывается пользователю;
+// с запасом меньше лимита Telegram в 4096 символов на сообщение
+const voiceEchoMaxLen = 3500
+
+// Voice голосовое сообщение
+type Voice struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Duration     int    `json:"duration"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// Audio аудиофайл, отправленный как музыка
+type Audio struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Duration     int    `json:"duration"`
+	FileName     string `json:"file_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// Transcriber распознаёт речь в аудиофайле. Реализация по умолчанию обращается
+// к локальному HTTP-сервису; в проверках её заменяет TranscriberFunc.
+type Transcriber interface {
+	Transcribe(ctx context.Context, filename string, audio []byte) (string, error)
+}
+
+// TranscriberFunc функция-адаптер для интерфейса Transcriber
+type TranscriberFunc func(ctx context.Context, filename string, audio []byte) (string, error)
+
+func (f TranscriberFunc) Transcribe(ctx context.Context, filename string, audio []byte) (string, error) {
+	return f(ctx, filename, audio)
+}
+
+// WhisperTranscriber клиент сервиса распознавания речи с multipart-API:
+// сервера whisper.cpp (/inference) или OpenAI-совместимого
+// (/v1/audio/transcriptions, например faster-whisper-server)
+type WhisperTranscriber struct {
+	// URL полный адрес эндпоинта распознавания
+	URL string
+	// Model имя модели для OpenAI-совместимых сервисов; whisper.cpp его не использует
+	Model string
+	// Language код языка речи или "auto"
+	Language string
+	Client   *http.Client
+}
+
+// NewTranscriber создаёт клиент распознавания речи из TRANSCRIBE_URL.
+// Если адрес не задан, возвращает nil: голосовые сообщения не распознаются.
+func NewTranscriber() Transcriber {
+	url := strings.TrimSpace(os.Getenv("TRANSCRIBE_URL"))
+	if url == "" {
+		return nil
+	}
+	language := os.Getenv("TRANSCRIBE_LANGUAGE")
+	if language == "" {
+		language = "auto"
+	}
+	slog.Info("Настроено распознавание речи", "url", url, "language", language)
+	return &WhisperTranscriber{
+		URL:      url,
+		Model:    os.Getenv("TRANSCRIBE_MODEL"),
+		Language: language,
+		Client:   newHTTPClient("transcribe", newTransport(http.ProxyFromEnvironment, 2)),
+	}
+}
+
+// Transcribe отправляет аудио в сервис и возвращает распознанный текст
+func (w *WhisperTranscriber) Transcribe(ctx context.Context, filename string, audio []byte) (string, error) {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return "", fmt.Errorf("ошибка формирования запроса: %w", err)
+	}
+	if _, err := part.Write(audio); err != nil {
+		return "", fmt.Errorf("ошибка формирования запроса: %w", err)
+	}
+	form.WriteField("response_format", "json")
+	form.WriteField("temperature", "0")
+	if w.Language != "" && w.Language != "auto" {
+		form.WriteField("language", w.Language)
+	}
+	if w.Model != "" {
+		form.WriteField("model", w.Model)
+	}
+	if err := form.Close(); err != nil {
+		return "", fmt.Errorf("ошибка формирования запроса: %w", err)
+	}
+
+	// Распознавание длинной записи на CPU занимает время
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, &buf)
+	if err != nil {
+		return "", fmt.Errorf("ошибка создания HTTP запроса: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("ошибка запроса к сервису распознавания: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("сервис распознавания вернул статус %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Text  string `json:"text"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("ошибка парсинга JSON ответа: %w", err)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("ошибка сервиса распознавания: %s", result.Error)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// transcribeMaxDuration максимальная длительность записи в секундах из TRANSCRIBE_MAX_DURATION
+func transcribeMaxDuration() int {
+	if v := os.Getenv("TRANSCRIBE_MAX_DURATION"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 300
+}
+
+// handleVoice распознаёт голосовое сообщение или аудиофайл, показывает
+// распознанный текст и обрабатывает его как обычный запрос
+func (bot *TelegramBot) handleVoice(ctx context.Context, message *Message) {
+	chatID := message.Chat.ID
+
+	if bot.Transcriber == nil {
+		bot.reply(ctx, chatID, tr(ctx, "voice_unsupported"))
+		return
+	}
+
+	fileID, filename, duration, size := "", "voice.ogg", 0, int64(0)
+	if v := message.Voice; v != nil {
+		fileID, duration, size = v.FileID, v.Duration, v.FileSize
+	} else if a := message.Audio; a != nil {
+		fileID, duration, size = a.FileID, a.Duration, a.FileSize
+		if a.FileName != "" {
+			filename = a.FileName
+		}
+	}
+	if maxDuration := transcribeMaxDuration(); duration > maxDuration {
+		bot.reply(ctx, chatID, tr(ctx, "voice_too_long", maxDuration))
+		return
+	}
+
+	// Лимиты проверяются до скачивания: распознавание нагружает процессор
+	// не меньше генерации и не должно быть доступно в обход них
+	if !bot.checkRateLimit(chatID) {
+		metricRateLimited.Inc()
+		bot.reply(ctx, chatID, tr(ctx, "rate_limited"))
+		return
+	}
+	if !bot.checkQuota(ctx, chatID, senderID(message)) {
+		return
+	}
+
+	if err := bot.SendChatAction(ctx, chatID, "typing"); err != nil {
+		slog.WarnContext(ctx, "Ошибка отправки статуса", "chat_id", chatID, "error", err)
+	}
+
+	text, err := bot.transcribe(ctx, fileID, filename, size)
+	if err != nil {
+		metricTranscriptions.Inc("error")
+		slog.ErrorContext(ctx, "Ошибка распознавания речи", "chat_id", chatID, "error", err)
+		bot.reply(ctx, chatID, tr(ctx, "voice_failed"))
+		return
+	}
+	if text == "" {
+		metricTranscriptions.Inc("empty")
+		bot.reply(ctx, chatID, tr(ctx, "voice_empty"))
+		return
+	}
+	metricTranscriptions.Inc("ok")
+	slog.InfoContext(ctx, "Речь распознана", "chat_id", chatID, "duration", duration, "text_length", len(text))
+
+	// Эхо распознанного текста — одно сообщение: длинная расшифровка обрезается,
+	// а модели передаётся целиком
+	bot.reply(ctx, chatID, tr(ctx, "voice_recognized", truncate(text, voiceEchoMaxLen)))
+	bot.answerText(ctx, message, text)
+}
+
+// transcribe скачивает файл через getFile и передаёт его в сервис распознавания
+func (bot *TelegramBot) transcribe(ctx context.Context, fileID, filename string, size int64) (string, error) {
+	if size > bot.maxFileSize {
+		return "", fmt.Errorf("файл больше %d байт", bot.maxFileSize)
+	}
+	file, err := bot.GetFile(ctx, fileID)
+	if err != nil {
+		return "", err
+	}
+	audio, err := bot.DownloadFile(ctx, file)
+	if err != nil {
+		return "", err
+	}
+	return bot.Transcriber.Transcribe(ctx, filename, audio)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageStats накопленная статистика использования модели
+type UsageStats struct {
+	Requests         int   `json:"requests"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	DurationNs       int64 `json:"duration_ns"`
+}
+
+// Tokens возвращает суммарное количество токенов (промпт + ответ)
+func (s UsageStats) Tokens() int64 {
+	return s.PromptTokens + s.CompletionTokens
+}
+
+// add добавляет к статистике данные одного ответа Ollama
+func (s *UsageStats) add(resp *OllamaResponse) {
+	s.Requests++
+	s.PromptTokens += int64(resp.PromptEvalCount)
+	s.CompletionTokens += int64(resp.EvalCount)
+	s.DurationNs += resp.TotalDuration
+}
+
+// merge суммирует статистику другого периода или пользователя
+func (s *UsageStats) merge(o UsageStats) {
+	s.Requests += o.Requests
+	s.PromptTokens += o.PromptTokens
+	s.CompletionTokens += o.CompletionTokens
+	s.DurationNs += o.DurationNs
+}
+
+// usageRecord статистика пользователя или чата за текущие сутки, месяц и всё время
+type usageRecord struct {
+	Day     string     `json:"day"`
+	Daily   UsageStats `json:"daily"`
+	Month   string     `json:"month"`
+	Monthly UsageStats `json:"monthly"`
+	Total   UsageStats `json:"total"`
+}
+
+// rollover сбрасывает дневную и месячную статистику при смене периода
+func (r *usageRecord) rollover(now time.Time) {
+	day := now.Format("2006-01-02")
+	if r.Day != day {
+		r.Day = day
+		r.Daily = UsageStats{}
+	}
+	month := now.Format("2006-01")
+	if r.Month != month {
+		r.Month = month
+		r.Monthly = UsageStats{}
+	}
+}
+
+// usageSaveDelay задержка записи статистики после ответа: ответы, полученные
+// за это время, сохраняются в файл одной записью
+const usageSaveDelay = 5 * time.Second
+
+// QuotaTier лимиты токенов для группы пользователей (0 — без ограничения)
+type QuotaTier struct {
+	Name    string
+	Daily   int64
+	Monthly int64
+}
+
+// UsageTracker учитывает расход токенов по пользователям и чатам,
+// проверяет квоты и сохраняет данные в JSON-файл, чтобы они переживали перезапуск.
+// Файл записывается не чаще раза в usageSaveDelay и при остановке бота (Flush).
+type UsageTracker struct {
+	path      string
+	tiers     map[string]QuotaTier
+	userTiers map[int64]string
+	users     map[int64]*usageRecord
+	chats     map[int64]*usageRecord
+	mu        sync.Mutex
+	dirty     bool
+	saveTimer *time.Timer
+}
+
+// usageFile формат файла с сохранённой статистикой
+type usageFile struct {
+	Users map[int64]*usageRecord `json:"users"`
+	Chats map[int64]*usageRecord `json:"chats"`
+}
+
+// NewUsageTracker создаёт трекер с настройками из переменных окружения
+// и загружает ранее сохранённую статистику
+func NewUsageTracker() *UsageTracker {
+	path := os.Getenv("USAGE_FILE")
+	if path == "" {
+		path = "usage.json"
+	}
+
+	defaultTier := QuotaTier{
+		Name:    "default",
+		Daily:   parseTokenLimit(os.Getenv("QUOTA_DAILY_TOKENS")),
+		Monthly: parseTokenLimit(os.Getenv("QUOTA_MONTHLY_TOKENS")),
+	}
+
+	t := &UsageTracker{
+		path:      path,
+		tiers:     parseQuotaTiers(os.Getenv("QUOTA_TIERS")),
+		userTiers: parseUserTiers(os.Getenv("QUOTA_USER_TIERS")),
+		users:     make(map[int64]*usageRecord),
+		chats:     make(map[int64]*usageRecord),
+	}
+	// Тариф default из QUOTA_TIERS задан явно и важнее QUOTA_DAILY_TOKENS и QUOTA_MONTHLY_TOKENS
+	if _, ok := t.tiers[defaultTier.Name]; !ok {
+		t.tiers[defaultTier.Name] = defaultTier
+	} else if defaultTier.Daily > 0 || defaultTier.Monthly > 0 {
+		slog.Warn("Тариф default задан в QUOTA_TIERS, QUOTA_DAILY_TOKENS и QUOTA_MONTHLY_TOKENS не используются")
+	}
+
+	if err := t.load(); err != nil {
+		slog.Error("Ошибка загрузки статистики использования", "path", path, "error", err)
+	}
+
+	return t
+}
+
+// parseTokenLimit разбирает лимит токенов; некорректное значение означает отсутствие лимита
+func parseTokenLimit(v string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// parseQuotaTiers разбирает QUOTA_TIERS в формате "имя:дневной:месячный,..."
+func parseQuotaTiers(v string) map[string]QuotaTier {
+	tiers := make(map[string]QuotaTier)
+	for _, item := range strings.Split(v, ",") {
+		fields := strings.Split(strings.TrimSpace(item), ":")
+		if len(fields) != 3 || fields[0] == "" {
+			continue
+		}
+		tiers[fields[0]] = QuotaTier{
+			Name:    fields[0],
+			Daily:   parseTokenLimit(fields[1]),
+			Monthly: parseTokenLimit(fields[2]),
+		}
+	}
+	return tiers
+}
+
+// parseUserTiers разбирает QUOTA_USER_TIERS в формате "user_id:имя,..."
+func parseUserTiers(v string) map[int64]string {
+	userTiers := make(map[int64]string)
+	for _, item := range strings.Split(v, ",") {
+		idStr, tier, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			continue
+		}
+		if id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64); err == nil {
+			userTiers[id] = strings.TrimSpace(tier)
+		}
+	}
+	return userTiers
+}
+
+// tierFor возвращает тариф пользователя; неизвестные тарифы заменяются тарифом по умолчанию
+func (t *UsageTracker) tierFor(userID int64) QuotaTier {
+	if tier, ok := t.tiers[t.userTiers[userID]]; ok {
+		return tier
+	}
+	return t.tiers["default"]
+}
+
+// record возвращает запись статистики, создавая её при необходимости
+func record(m map[int64]*usageRecord, id int64, now time.Time) *usageRecord {
+	r, ok := m[id]
+	if !ok {
+		r = &usageRecord{}
+		m[id] = r
+	}
+	r.rollover(now)
+	return r
+}
+
+// QuotaError ошибка исчерпанной квоты. Текст для пользователя формируется
+// методом Message на его языке.
+type QuotaError struct {
+	Monthly bool
+	Used    int64
+	Limit   int64
+	// Needed оценка расхода запроса, которая не помещается в остаток квоты
+	Needed int64
+}
+
+func (e *QuotaError) Error() string {
+	period := "дневная"
+	if e.Monthly {
+		period = "месячная"
+	}
+	if e.Needed > 0 {
+		return fmt.Sprintf("%s квота недостаточна (%d из %d токенов, нужно около %d)", period, e.Used, e.Limit, e.Needed)
+	}
+	return fmt.Sprintf("%s квота исчерпана (%d из %d токенов)", period, e.Used, e.Limit)
+}
+
+// Message возвращает описание исчерпанной квоты на языке lang
+func (e *QuotaError) Message(lang string) string {
+	key := "quota_daily"
+	if e.Monthly {
+		key = "quota_monthly"
+	}
+	msg := T(lang, key, e.Used, e.Limit)
+	if e.Needed > 0 {
+		msg += T(lang, "quota_needed", e.Needed)
+	}
+	return msg
+}
+
+// CheckQuota проверяет, не исчерпал ли пользователь дневную или месячную квоту.
+// Возвращает nil, если запрос разрешён, иначе *QuotaError. Расход заранее
+// неизвестен, поэтому последний разрешённый запрос (и запросы, начатые
+// одновременно с ним) может превысить квоту на размер своего ответа.
+func (t *UsageTracker) CheckQuota(userID int64) error {
+	return t.CheckQuotaFor(userID, 0)
+}
+
+// CheckQuotaFor как CheckQuota, но дополнительно требует, чтобы в остатке квоты
+// поместилась оценка расхода needed. Используется для команд, которые
+// выполняют несколько генераций на одно сообщение.
+func (t *UsageTracker) CheckQuotaFor(userID, needed int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tier := t.tierFor(userID)
+	r := record(t.users, userID, time.Now())
+
+	if used := r.Daily.Tokens(); tier.Daily > 0 && (used >= tier.Daily || used+needed > tier.Daily) {
+		return &QuotaError{Used: used, Limit: tier.Daily, Needed: needed}
+	}
+	if used := r.Monthly.Tokens(); tier.Monthly > 0 && (used >= tier.Monthly || used+needed > tier.Monthly) {
+		return &QuotaError{Monthly: true, Used: used, Limit: tier.Monthly, Needed: needed}
+	}
+	return nil
+}
+
+// Record учитывает ответ Ollama для пользователя и чата. Статистика
+// сохраняется в файл через usageSaveDelay.
+func (t *UsageTracker) Record(userID, chatID int64, resp *OllamaResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, r := range []*usageRecord{record(t.users, userID, now), record(t.chats, chatID, now)} {
+		r.Daily.add(resp)
+		r.Monthly.add(resp)
+		r.Total.add(resp)
+	}
+
+	t.dirty = true
+	if t.saveTimer == nil {
+		t.saveTimer = time.AfterFunc(usageSaveDelay, t.Flush)
+	}
+}
+
+// Flush сохраняет несохранённую статистику в файл. Вызывается по таймеру
+// после Record и при остановке бота.
+func (t *UsageTracker) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.saveTimer != nil {
+		t.saveTimer.Stop()
+		t.saveTimer = nil
+	}
+	if !t.dirty {
+		return
+	}
+	if err := t.save(); err != nil {
+		slog.Error("Ошибка сохранения статистики использования", "path", t.path, "error", err)
+		return
+	}
+	t.dirty = false
+}
+
+// Report формирует текстовый отчёт о расходе токенов пользователем на языке lang
+func (t *UsageTracker) Report(lang string, userID int64) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tier := t.tierFor(userID)
+	r := record(t.users, userID, time.Now())
+
+	return T(lang, "usage_report",
+		tier.Name,
+		formatQuota(lang, r.Daily, tier.Daily),
+		formatQuota(lang, r.Monthly, tier.Monthly),
+		r.Total.Tokens(), r.Total.Requests,
+		time.Duration(r.Total.DurationNs).Round(time.Second))
+}
+
+// Summary формирует сводку расхода токенов по всем пользователям бота
+func (t *UsageTracker) Summary(lang string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var daily, monthly, total UsageStats
+	active := 0
+	for _, r := range t.users {
+		r.rollover(now)
+		if r.Daily.Requests > 0 {
+			active++
+		}
+		daily.merge(r.Daily)
+		monthly.merge(r.Monthly)
+		total.merge(r.Total)
+	}
+
+	return T(lang, "stats_report",
+		len(t.users), active,
+		daily.Tokens(), daily.Requests,
+		monthly.Tokens(), monthly.Requests,
+		total.Tokens(), total.Requests)
+}
+
+// formatQuota форматирует расход за период с учётом лимита
+func formatQuota(lang string, s UsageStats, limit int64) string {
+	if limit == 0 {
+		return T(lang, "usage_unlimited", s.Tokens(), s.Requests)
+	}
+	return T(lang, "usage_limited", s.Tokens(), limit, s.Requests)
+}
+
+// load читает статистику из файла; отсутствие файла не является ошибкой
+func (t *UsageTracker) load() error {
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f usageFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if f.Users != nil {
+		t.users = f.Users
+	}
+	if f.Chats != nil {
+		t.chats = f.Chats
+	}
+	return nil
+}
+
+// save записывает статистику в файл. Вызывается под t.mu.
+func (t *UsageTracker) save() error {
+	data, err := json.MarshalIndent(usageFile{Users: t.users, Chats: t.chats}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data)
+}
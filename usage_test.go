@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultTierFromQuotaTiers(t *testing.T) {
+	t.Setenv("USAGE_FILE", filepath.Join(t.TempDir(), "usage.json"))
+	t.Setenv("QUOTA_DAILY_TOKENS", "100")
+	t.Setenv("QUOTA_MONTHLY_TOKENS", "1000")
+
+	t.Setenv("QUOTA_TIERS", "default:500:5000,premium:0:0")
+	if tier := NewUsageTracker().tierFor(1); tier.Daily != 500 || tier.Monthly != 5000 {
+		t.Fatalf("явный тариф default перезаписан: %+v", tier)
+	}
+
+	t.Setenv("QUOTA_TIERS", "premium:0:0")
+	if tier := NewUsageTracker().tierFor(1); tier.Daily != 100 || tier.Monthly != 1000 {
+		t.Fatalf("тариф по умолчанию из QUOTA_DAILY_TOKENS: %+v", tier)
+	}
+}
+
+func TestRecordSavesOnFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	t.Setenv("USAGE_FILE", path)
+
+	usage := NewUsageTracker()
+	for i := 0; i < 3; i++ {
+		usage.Record(1, 2, &OllamaResponse{PromptEvalCount: 10, EvalCount: 5})
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("файл записан до истечения задержки: %v", err)
+	}
+
+	usage.Flush()
+	r := NewUsageTracker().users[1]
+	if r == nil || r.Total.Requests != 3 || r.Total.Tokens() != 45 {
+		t.Fatalf("после Flush сохранено %+v", r)
+	}
+}
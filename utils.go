@@ -2,27 +2,34 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// ipv4OnlyTransport — HTTP-транспорт, принудительно использующий только IPv4.
+// dialIPv4 открывает TCP-соединение только по IPv4.
 // Решает проблему таймаутов при подключении к Telegram API через IPv6.
-var ipv4OnlyTransport = &http.Transport{
-	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-		dialer := &net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
+// Применяется ко всем настроенным адресам: Bot API, файлам, Ollama и прокси.
+func dialIPv4(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	// Явно заданный IPv6-адрес (например, [::1] собственного сервера Bot API)
+	// нельзя открыть через tcp4, поэтому он подключается как есть
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return dialer.DialContext(ctx, "tcp6", addr)
 		}
-		return dialer.DialContext(ctx, "tcp4", addr)
-	},
-	MaxIdleConns:        100,
-	IdleConnTimeout:     90 * time.Second,
-	TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return dialer.DialContext(ctx, "tcp4", addr)
 }
 
 // useIPv4Only определяет, нужно ли принудительно использовать только IPv4.
@@ -36,21 +43,59 @@ func useIPv4Only() bool {
 	return false
 }
 
-// newHTTPClient создаёт HTTP-клиент с заданным таймаутом.
-// Если USE_IPV4_ONLY=true (по умолчанию), использует только IPv4-соединения.
-func newHTTPClient(timeout time.Duration) *http.Client {
-	client := &http.Client{
-		Timeout: timeout,
+// newHTTPClient создаёт долгоживущий HTTP-клиент для направления трафика upstream
+// ("telegram" или "ollama") поверх транспорта base с метриками переиспользования
+// соединений. У клиента нет общего таймаута: long polling, генерация и короткие
+// вызовы задают его контекстом запроса.
+func newHTTPClient(upstream string, base http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: &tracingTransport{upstream: upstream, base: base},
+	}
+}
+
+// tracingTransport учитывает в метриках, получил ли запрос новое
+// или переиспользованное соединение из пула
+type tracingTransport struct {
+	upstream string
+	base     http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metricHTTPConnections.Inc(t.upstream, strconv.FormatBool(info.Reused))
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// newTransport создаёт HTTP-транспорт для одного направления трафика с прокси proxy
+// и не более maxIdlePerHost простаивающими соединениями на хост.
+// Если USE_IPV4_ONLY=true (по умолчанию), использует только IPv4-соединения,
+// в том числе с прокси-сервером.
+func newTransport(proxy func(*http.Request) (*url.URL, error), maxIdlePerHost int) *http.Transport {
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
 	}
 	if useIPv4Only() {
-		client.Transport = ipv4OnlyTransport
+		transport.DialContext = dialIPv4
 	}
-	return client
+	return transport
 }
 
 func init() {
 	if useIPv4Only() {
-		log.Println("Режим IPv4-only включён (USE_IPV4_ONLY=true)")
+		slog.Info("Режим IPv4-only включён", "USE_IPV4_ONLY", true)
 	}
 }
 
@@ -109,3 +154,22 @@ func SplitMessage(text string, maxLen int) []string {
 
 	return parts
 }
+
+// writeFileAtomic записывает данные во временный файл и переименовывает его,
+// чтобы при сбое не остался наполовину записанный файл
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}